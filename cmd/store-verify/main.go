@@ -0,0 +1,172 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Command store-verify checks a store, and optionally repairs it.
+//
+// Usage:
+//
+//	store-verify [-repair] [-json] [-key-file path] <store>
+//
+// The store is either a directory (the default, diskv backend), or a file (the log backend).
+// It exits with 0 if the store is healthy (or has been fully repaired), 1 if problems are left, and 2 on error.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"go.farcloser.world/core/store"
+)
+
+const (
+	exitProblems = 1
+	exitError    = 2
+)
+
+var errUsage = errors.New("expected a single store path")
+
+func main() {
+	report, err := run(os.Args[1:])
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "store-verify:", err)
+
+		os.Exit(exitError)
+	}
+
+	if !report.Healthy() {
+		os.Exit(exitProblems)
+	}
+}
+
+func run(args []string) (*store.Report, error) {
+	flags := flag.NewFlagSet("store-verify", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix what can be fixed, while holding the write lock")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	keyFile := flags.String("key-file", "", "file holding the encryption key of the store, raw or hex encoded")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+
+		return nil, errUsage
+	}
+
+	options, closeBackend, err := open(flags.Arg(0), *keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	st := store.New(options)
+
+	var report *store.Report
+
+	if *repair {
+		report, err = st.Repair()
+	} else {
+		report, err = st.Verify()
+	}
+
+	if err = errors.Join(err, closeBackend()); err != nil {
+		return nil, err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		return report, encoder.Encode(report)
+	}
+
+	return report, printReport(report)
+}
+
+// open returns the options for the store at path, and a function closing its backend.
+func open(path, keyFile string) (*store.Options, func() error, error) {
+	// Caching is pointless when reading everything once.
+	options := &store.Options{Path: path, CacheSize: -1}
+	closeBackend := func() error { return nil }
+
+	if keyFile != "" {
+		key, err := readKey(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		options.EncryptionKey = key
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !info.IsDir() {
+		backend, err := store.OpenLogBackend(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		options.Backend = backend
+		closeBackend = backend.Close
+	}
+
+	return options, closeBackend, nil
+}
+
+// readKey reads an encryption key from path, either raw, or hex encoded.
+func readKey(path string) ([]byte, error) {
+	//nolint:gosec
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == store.KeySize {
+		return data, nil
+	}
+
+	return hex.DecodeString(string(bytes.TrimSpace(data)))
+}
+
+func printReport(report *store.Report) error {
+	for _, problem := range report.Problems {
+		line := fmt.Sprintf("%s\t%s", problem.Kind, problem.Key)
+		if problem.Detail != "" {
+			line += "\t" + problem.Detail
+		}
+
+		if problem.Repaired {
+			line += "\t(repaired)"
+		}
+
+		if _, err := fmt.Fprintln(os.Stdout, line); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(os.Stdout, "%d entries, %d blobs, %d problems\n", report.Entries, report.Blobs,
+		len(report.Problems))
+
+	return err
+}
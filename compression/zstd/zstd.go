@@ -29,6 +29,10 @@ type (
 	Encoder = cmp.Encoder
 	// EOption is an option for creating a encoder.
 	EOption = cmp.EOption
+	// Decoder provides decoding of Zstandard streams.
+	Decoder = cmp.Decoder
+	// DOption is an option for creating a decoder.
+	DOption = cmp.DOption
 )
 
 // EncoderLevelFromZstd converts a zstd compression level to an EncoderLevel.
@@ -47,3 +51,16 @@ func NewWriter(w io.Writer, opts ...EOption) (*Encoder, error) {
 func WithEncoderLevel(l EncoderLevel) EOption {
 	return cmp.WithEncoderLevel(l)
 }
+
+// NewReader creates a new Zstandard decoder that reads from the provided io.Reader.
+// The decoder must be closed when no longer needed, to release its resources.
+//
+//nolint:wrapcheck
+func NewReader(r io.Reader, opts ...DOption) (*Decoder, error) {
+	return cmp.NewReader(r, opts...)
+}
+
+// WithDecoderConcurrency sets the number of concurrent decoders. With 1, streams are decoded synchronously.
+func WithDecoderConcurrency(n int) DOption {
+	return cmp.WithDecoderConcurrency(n)
+}
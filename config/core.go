@@ -17,13 +17,15 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
 
 	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/loader"
 	"go.farcloser.world/core/log"
 	"go.farcloser.world/core/network"
 	"go.farcloser.world/core/reporter"
@@ -33,6 +35,7 @@ import (
 // New creates a new Core configuration object.
 func New(appName string, location ...string) *Core {
 	conf := &Core{
+		appName:  appName,
 		location: append([]string{appName}, location...),
 
 		Client: &network.Config{
@@ -66,6 +69,9 @@ func New(appName string, location ...string) *Core {
 
 // Core is the core configuration object.
 type Core struct {
+	// Secrets referenced by the settings (e.g. "env:SENTRY_DSN"), resolved by the loader.
+	loader.Secrets `json:"-"`
+
 	Reporter  *reporter.Config  `json:"reporter,omitempty"`
 	Logger    *log.Config       `json:"logger,omitempty"`
 	Telemetry *telemetry.Config `json:"telemetry,omitempty"`
@@ -74,7 +80,9 @@ type Core struct {
 
 	Umask uint32 `json:"umask,omitempty"`
 
+	appName  string
 	location []string
+	format   loader.Format
 }
 
 // Trust does trust a certificate for both client and server.
@@ -126,67 +134,70 @@ func (obj *Core) OnIO() {
 	filesystem.SetUmask(obj.Umask)
 }
 
-// GetLocation returns the location of the config file.
-func (obj *Core) GetLocation() []string {
-	return obj.location
-}
-
-// GetDataRoot returns the data root directory for the application.
-func (obj *Core) GetDataRoot() string {
-	var loc string
+// Validate checks the client and server settings (see network.Config.Validate). The default certificate and key may
+// not exist, as they may not have been generated yet.
+func (obj *Core) Validate() error {
+	errs := []error{}
 
-	base, _ := os.UserHomeDir()
-
-	switch runtime.GOOS {
-	case "darwin":
-		// XXX figure out impact on iCloud auto backup thing and containers
-		loc = path.Join(base, "Library", "Application Support", obj.location[0])
-	default:
-		loc = path.Join(base, "."+obj.location[0])
+	if obj.Client != nil {
+		errs = append(errs, loader.WithPath("client", ungenerated(obj.Client, obj.Client.Validate())))
 	}
 
-	// XXX ignore errors?
-	_ = os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault)
+	if obj.Server != nil {
+		errs = append(errs, loader.WithPath("server", ungenerated(obj.Server, obj.Server.Validate())))
+	}
 
-	return loc
+	return errors.Join(errs...)
 }
 
-// GetHome returns the home directory of the current user.
-func (*Core) GetHome() string {
-	home, _ := os.UserHomeDir()
+// ungenerated drops the errors of conf about the default certificate or key not existing.
+func ungenerated(conf *network.Config, err error) error {
+	joined, ok := err.(interface{ Unwrap() []error }) //nolint:errorlint
+	if !ok {
+		return err
+	}
 
-	return home
-}
+	errs := []error{}
 
-// GetCacheRoot returns the cache root directory for the application.
-func (obj *Core) GetCacheRoot() string {
-	base, _ := os.UserCacheDir()
+	for _, inner := range joined.Unwrap() {
+		var fieldError *loader.FieldError
+		if errors.As(inner, &fieldError) && errors.Is(inner, fs.ErrNotExist) &&
+			(fieldError.Path == "certPath" && conf.CertPath == defaultCertPath ||
+				fieldError.Path == "keyPath" && conf.KeyPath == defaultKeyPath) {
+			continue
+		}
 
-	loc := path.Join(base, obj.location[0])
+		errs = append(errs, inner)
+	}
 
-	// XXX ignore errors?
-	_ = os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault)
+	return errors.Join(errs...)
+}
 
-	return loc
+// GetAppName returns the name of the application the configuration is for.
+func (obj *Core) GetAppName() string {
+	return obj.appName
 }
 
-// GetLogRoot returns the log root directory for the application.
-func (obj *Core) GetLogRoot() string {
-	var loc string
+// GetLocation returns the location of the config file.
+func (obj *Core) GetLocation() []string {
+	return obj.location
+}
 
-	base, _ := os.UserHomeDir()
+// SetFormat sets the format of the config file, which is otherwise detected from its extension.
+func (obj *Core) SetFormat(format loader.Format) {
+	obj.format = format
+}
 
-	switch runtime.GOOS {
-	case "darwin":
-		loc = path.Join(base, "Library", "Logs", obj.location[0])
-	default:
-		loc = "/var/log/" + obj.location[0]
-	}
+// GetFormat returns the format of the config file, if set (see SetFormat).
+func (obj *Core) GetFormat() loader.Format {
+	return obj.format
+}
 
-	// XXX ignore errors?
-	_ = os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault)
+// GetHome returns the home directory of the current user.
+func (*Core) GetHome() string {
+	home, _ := os.UserHomeDir()
 
-	return loc
+	return home
 }
 
 func absolute(location ...string) string {
@@ -0,0 +1,386 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"go.farcloser.world/core/filesystem"
+)
+
+// On Linux (and other unix-es, save for macOS), directories follow the XDG Base Directory specification: every
+// XDG_*_HOME (and XDG_RUNTIME_DIR) variable is honored if set, and defaults to the location of the specification for
+// regular users, or to the FHS location for root (/var/lib, /var/cache, /var/log and /run).
+// Get*Root accessors only create the parent directory, and ignore errors: prefer their Ensure*Root variants, which
+// create the directory itself, and fail if there is no usable location.
+
+// GetDataRoot returns the data root directory for the application (e.g. ~/.local/share/<app>).
+// Data of regular users from older versions, in ~/.<app>, is moved there the first time, or used in place if it cannot
+// be moved.
+func (obj *Core) GetDataRoot() string {
+	loc, _ := obj.dataRoot()
+
+	// XXX ignore errors?
+	_ = os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault)
+
+	return loc
+}
+
+// GetStateRoot returns the state root directory for the application (e.g. ~/.local/state/<app>), for data that
+// should persist, but is not worth backing up (history, recently used files, etc.). It returns an empty string if the
+// directory is unavailable: see EnsureStateRoot for why.
+func (obj *Core) GetStateRoot() string {
+	return withParent(obj.stateRoot)
+}
+
+// GetCacheRoot returns the cache root directory for the application (e.g. ~/.cache/<app>).
+func (obj *Core) GetCacheRoot() string {
+	loc, _ := obj.cacheRoot()
+
+	// XXX ignore errors?
+	_ = os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault)
+
+	return loc
+}
+
+// GetLogRoot returns the log root directory for the application (e.g. ~/.local/state/<app>/log, or /var/log/<app> for
+// root).
+func (obj *Core) GetLogRoot() string {
+	loc, _ := obj.logRoot()
+
+	// XXX ignore errors?
+	_ = os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault)
+
+	return loc
+}
+
+// GetRuntimeRoot returns the runtime directory for the application (e.g. $XDG_RUNTIME_DIR/<app>), for sockets, pid
+// files and the like. It falls back to /run/<app> for root, and to a per user directory in the temporary directory
+// otherwise. It returns an empty string if the directory is unavailable: see EnsureRuntimeRoot for why.
+func (obj *Core) GetRuntimeRoot() string {
+	return withParent(obj.runtimeRoot)
+}
+
+// withParent returns the location returned by locate, after creating its parent directory, or an empty string if
+// either fails.
+func withParent(locate func() (string, error)) string {
+	loc, err := locate()
+	if err != nil || !filepath.IsAbs(loc) {
+		return ""
+	}
+
+	if err = os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault); err != nil {
+		return ""
+	}
+
+	return loc
+}
+
+// EnsureDataRoot returns the data root directory for the application (see GetDataRoot), after creating it with private
+// permissions if needed, or making it private if it exists already. It fails with ErrDirectoryUnavailable if there is
+// no usable location (e.g. without a home directory), or the directory cannot be created or made private.
+func (obj *Core) EnsureDataRoot() (string, error) {
+	return ensureDir("data", obj.dataRoot, nil)
+}
+
+// EnsureStateRoot returns the state root directory for the application (see GetStateRoot), after creating it as per
+// EnsureDataRoot.
+func (obj *Core) EnsureStateRoot() (string, error) {
+	return ensureDir("state", obj.stateRoot, nil)
+}
+
+// EnsureCacheRoot returns the cache root directory for the application (see GetCacheRoot), after creating it as per
+// EnsureDataRoot.
+func (obj *Core) EnsureCacheRoot() (string, error) {
+	return ensureDir("cache", obj.cacheRoot, nil)
+}
+
+// EnsureLogRoot returns the log root directory for the application (see GetLogRoot), after creating it as per
+// EnsureDataRoot.
+func (obj *Core) EnsureLogRoot() (string, error) {
+	return ensureDir("log", obj.logRoot, nil)
+}
+
+// EnsureRuntimeRoot returns the runtime directory for the application (see GetRuntimeRoot), after creating it as per
+// EnsureDataRoot. The fallback location in the temporary directory, shared by all users, is rejected if it belongs to
+// another user, or if others can access it.
+func (obj *Core) EnsureRuntimeRoot() (string, error) {
+	return ensureDir("runtime", obj.runtimeRoot, func(loc string) error {
+		if runtime.GOOS == "windows" || !strings.HasPrefix(loc, os.TempDir()) {
+			return nil
+		}
+
+		// Symbolic links are not followed: they could point anywhere.
+		info, err := os.Lstat(loc)
+		if err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+
+		if !info.IsDir() || !ownedByUser(info) || info.Mode().Perm()&^filesystem.DirPermissionsPrivate != 0 {
+			return fmt.Errorf("%w: %s", errInsecureRuntime, loc)
+		}
+
+		return nil
+	})
+}
+
+// ensureDir creates the kind of directory returned by locate, with private permissions, or restricts the permissions of
+// the existing directory. If not nil, check is called on the directory before anything is done to it.
+func ensureDir(kind string, locate func() (string, error), check func(loc string) error) (string, error) {
+	loc, err := locate()
+	if err != nil {
+		return "", errors.Join(ErrDirectoryUnavailable, fmt.Errorf("%s directory: %w", kind, err))
+	}
+
+	if !filepath.IsAbs(loc) {
+		return "", errors.Join(ErrDirectoryUnavailable, fmt.Errorf("%s directory: %w: %s", kind, errRelativeLocation, loc))
+	}
+
+	if err = os.MkdirAll(loc, filesystem.DirPermissionsPrivate); err != nil {
+		return "", errors.Join(ErrDirectoryUnavailable, fmt.Errorf("%s directory: %w", kind, err))
+	}
+
+	if check != nil {
+		if err = check(loc); err != nil {
+			return "", errors.Join(ErrDirectoryUnavailable, fmt.Errorf("%s directory: %w", kind, err))
+		}
+	}
+
+	info, err := os.Stat(loc)
+	if err != nil {
+		return "", errors.Join(ErrDirectoryUnavailable, fmt.Errorf("%s directory: %w", kind, err))
+	}
+
+	if !info.IsDir() {
+		return "", errors.Join(ErrDirectoryUnavailable, fmt.Errorf("%s directory: %w: %s", kind, errNotADirectory, loc))
+	}
+
+	// Windows permissions are not expressed as mode bits.
+	if runtime.GOOS != "windows" && info.Mode().Perm()&^filesystem.DirPermissionsPrivate != 0 {
+		if err = os.Chmod(loc, filesystem.DirPermissionsPrivate); err != nil {
+			return "", errors.Join(ErrDirectoryUnavailable, fmt.Errorf("%s directory: %w", kind, err))
+		}
+	}
+
+	return loc, nil
+}
+
+func (obj *Core) dataRoot() (string, error) {
+	app := obj.location[0]
+
+	switch runtime.GOOS {
+	case "darwin":
+		// XXX figure out impact on iCloud auto backup thing and containers
+		return homeDir("Library", "Application Support", app)
+	case "windows":
+		return homeDir("." + app)
+	}
+
+	loc, err := xdgDir("XDG_DATA_HOME", "/var/lib", ".local", "share")
+	if err != nil {
+		return "", err
+	}
+
+	return migrateLegacy(path.Join(loc, app), app), nil
+}
+
+func (obj *Core) stateRoot() (string, error) {
+	app := obj.location[0]
+
+	switch runtime.GOOS {
+	case "darwin":
+		return homeDir("Library", "Application Support", app, "State")
+	case "windows":
+		return homeDir("."+app, "state")
+	}
+
+	loc, err := xdgDir("XDG_STATE_HOME", "/var/lib", ".local", "state")
+	if err != nil {
+		return "", err
+	}
+
+	// For root, state is kept along with the data.
+	if systemDefault("XDG_STATE_HOME") {
+		return path.Join(loc, app, "state"), nil
+	}
+
+	return path.Join(loc, app), nil
+}
+
+func (obj *Core) cacheRoot() (string, error) {
+	app := obj.location[0]
+
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			//nolint:wrapcheck
+			return "", err
+		}
+
+		return path.Join(base, app), nil
+	}
+
+	loc, err := xdgDir("XDG_CACHE_HOME", "/var/cache", ".cache")
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(loc, app), nil
+}
+
+func (obj *Core) logRoot() (string, error) {
+	app := obj.location[0]
+
+	switch runtime.GOOS {
+	case "darwin":
+		return homeDir("Library", "Logs", app)
+	case "windows":
+		return homeDir("."+app, "log")
+	}
+
+	if systemDefault("XDG_STATE_HOME") {
+		return path.Join("/var/log", app), nil
+	}
+
+	loc, err := obj.stateRoot()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(loc, "log"), nil
+}
+
+func (obj *Core) runtimeRoot() (string, error) {
+	app := obj.location[0]
+
+	if runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); filepath.IsAbs(dir) {
+			return path.Join(dir, app), nil
+		}
+
+		if isRoot() {
+			return path.Join("/run", app), nil
+		}
+	}
+
+	if uid := os.Getuid(); uid >= 0 {
+		app += "-" + strconv.Itoa(uid)
+	}
+
+	return filepath.Join(os.TempDir(), app), nil
+}
+
+// xdgDir returns the directory in the XDG variable if it is set (and absolute, as per the specification), or root for
+// root, or the fallback path in the home directory otherwise.
+func xdgDir(variable, root string, fallback ...string) (string, error) {
+	if dir := os.Getenv(variable); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+
+	if isRoot() {
+		return root, nil
+	}
+
+	return homeDir(fallback...)
+}
+
+// systemDefault tells whether xdgDir returns the default location for root, for the XDG variable.
+func systemDefault(variable string) bool {
+	return !filepath.IsAbs(os.Getenv(variable)) && isRoot()
+}
+
+// homeDir joins location to the home directory of the user.
+func homeDir(location ...string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil || !filepath.IsAbs(home) {
+		return "", errors.Join(errNoHome, err)
+	}
+
+	return path.Join(append([]string{home}, location...)...), nil
+}
+
+// migrateLegacy moves the legacy data directory of app (~/.<app>) to loc, if it does not exist yet. It returns where
+// the data is: the legacy directory is used in place if it cannot be moved (e.g. to another file system).
+// Only the data of regular users is moved, and only within their home directory. Directories holding XDG base
+// directories (e.g. ~/.config, or ~/.local for ~/.local/share) are never moved.
+func migrateLegacy(loc, app string) string {
+	if isRoot() {
+		return loc
+	}
+
+	home, err := homeDir()
+	if err != nil {
+		return loc
+	}
+
+	legacy := path.Join(home, "."+app)
+	if !within(loc, home) || within(loc, legacy) || holdsXDG(legacy) {
+		return loc
+	}
+
+	if info, err := os.Stat(legacy); err != nil || !info.IsDir() {
+		return loc
+	}
+
+	if _, err = os.Stat(loc); !errors.Is(err, os.ErrNotExist) {
+		return loc
+	}
+
+	if err = os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault); err != nil {
+		return legacy
+	}
+
+	if err = os.Rename(legacy, loc); err != nil {
+		return legacy
+	}
+
+	return loc
+}
+
+// holdsXDG tells whether loc is, or contains, one of the XDG base directories of the user.
+func holdsXDG(loc string) bool {
+	for variable, fallback := range map[string][]string{
+		"XDG_CONFIG_HOME": {".config"},
+		"XDG_DATA_HOME":   {".local", "share"},
+		"XDG_STATE_HOME":  {".local", "state"},
+		"XDG_CACHE_HOME":  {".cache"},
+	} {
+		dir, err := xdgDir(variable, "", fallback...)
+		if err != nil || dir == loc || within(dir, loc) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// within tells whether loc is inside the directory parent.
+func within(loc, parent string) bool {
+	return strings.HasPrefix(loc, parent+"/")
+}
+
+func isRoot() bool {
+	return os.Geteuid() == 0
+}
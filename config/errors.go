@@ -0,0 +1,29 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import "errors"
+
+var (
+	// ErrDirectoryUnavailable is returned when an application directory cannot be located or created.
+	ErrDirectoryUnavailable = errors.New("directory unavailable")
+
+	errNoHome           = errors.New("no home directory")
+	errNotADirectory    = errors.New("not a directory")
+	errInsecureRuntime  = errors.New("runtime directory is not private to the user")
+	errRelativeLocation = errors.New("location is not absolute")
+)
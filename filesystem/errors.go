@@ -25,6 +25,8 @@ var (
 	ErrUnlockFail = errors.New("failed to release lock")
 	// ErrAtomicWriteFail is returned when an atomic write operation fails.
 	ErrAtomicWriteFail = errors.New("failed to write file atomically")
+	// ErrLockTimeout is returned when a lock cannot be acquired in time. See LockTimeoutError.
+	ErrLockTimeout = errors.New("timed out acquiring lock")
 	// ErrLockIsNil is returned when a lock is nil.
 	ErrLockIsNil = errors.New("nil lock")
 	// ErrInvalidPath is returned when a path is invalid.
@@ -27,10 +27,49 @@ package filesystem
 // advisory locks will return errors for which IsNotSupported returns true.
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
+	"time"
 )
 
+const (
+	lockRetryMin = time.Millisecond
+	lockRetryMax = 100 * time.Millisecond
+)
+
+// LockTimeoutError is returned by LockContext and TryLock (and their read-only variants) when the lock is not acquired.
+// It matches ErrLockTimeout.
+type LockTimeoutError struct {
+	Path string
+	// PID of a process holding the lock, or 0 if the platform cannot tell.
+	PID int
+	// Cause is the context error, or nil for TryLock.
+	Cause error
+}
+
+func (e *LockTimeoutError) Error() string {
+	msg := ErrLockTimeout.Error() + " on " + e.Path
+	if e.PID > 0 {
+		msg += fmt.Sprintf(" (held by process %d)", e.PID)
+	}
+
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+
+	return msg
+}
+
+func (e *LockTimeoutError) Unwrap() []error {
+	if e.Cause == nil {
+		return []error{ErrLockTimeout}
+	}
+
+	return []error{ErrLockTimeout, e.Cause}
+}
+
 // Lock places an advisory write lock on the file, blocking until it can be
 // locked.
 //
@@ -58,6 +97,49 @@ func ReadOnlyLock(path string) (*os.File, error) {
 	return file, err
 }
 
+// LockContext places an advisory write lock on the file like Lock, but gives up with a LockTimeoutError once ctx is done.
+func LockContext(ctx context.Context, path string) (*os.File, error) {
+	file, err := lockContext(ctx, path, writeLock)
+	if err != nil {
+		err = errors.Join(ErrLockFail, err)
+	}
+
+	return file, err
+}
+
+// ReadOnlyLockContext places an advisory read lock on the file like ReadOnlyLock, but gives up with a LockTimeoutError
+// once ctx is done.
+func ReadOnlyLockContext(ctx context.Context, path string) (*os.File, error) {
+	file, err := lockContext(ctx, path, readLock)
+	if err != nil {
+		err = errors.Join(ErrLockFail, err)
+	}
+
+	return file, err
+}
+
+// TryLock places an advisory write lock on the file if it can be done right away, and fails with a LockTimeoutError
+// otherwise.
+func TryLock(path string) (*os.File, error) {
+	file, err := tryLock(path, writeLock)
+	if err != nil {
+		err = errors.Join(ErrLockFail, err)
+	}
+
+	return file, err
+}
+
+// TryReadOnlyLock places an advisory read lock on the file if it can be done right away, and fails with a
+// LockTimeoutError otherwise.
+func TryReadOnlyLock(path string) (*os.File, error) {
+	file, err := tryLock(path, readLock)
+	if err != nil {
+		err = errors.Join(ErrLockFail, err)
+	}
+
+	return file, err
+}
+
 // Unlock removes an advisory lock placed on f by this process.
 func Unlock(lock *os.File) error {
 	if lock == nil {
@@ -99,3 +181,58 @@ func WithReadOnlyLock(path string, function func() error) (err error) {
 
 	return function()
 }
+
+func lockContext(ctx context.Context, path string, lockType lockType) (*os.File, error) {
+	// Nothing can interrupt the wait: block in the kernel instead of polling.
+	if ctx.Done() == nil {
+		return platformLock(path, lockType)
+	}
+
+	file, err := platformOpen(path)
+	if err != nil {
+		return nil, err
+	}
+
+	delay := lockRetryMin
+
+	for {
+		acquired, err := platformTryLock(file, lockType)
+		if err != nil {
+			return nil, errors.Join(err, file.Close())
+		}
+
+		if acquired {
+			return file, nil
+		}
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return nil, errors.Join(&LockTimeoutError{Path: path, PID: lockHolder(file), Cause: ctx.Err()}, file.Close())
+		case <-timer.C:
+		}
+
+		delay = min(delay*2, lockRetryMax)
+	}
+}
+
+func tryLock(path string, lockType lockType) (*os.File, error) {
+	file, err := platformOpen(path)
+	if err != nil {
+		return nil, err
+	}
+
+	acquired, err := platformTryLock(file, lockType)
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+
+	if !acquired {
+		return nil, errors.Join(&LockTimeoutError{Path: path, PID: lockHolder(file)}, file.Close())
+	}
+
+	return file, nil
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const procLocks = "/proc/locks"
+
+// lockHolder returns the PID of a process holding a lock on file, as listed in /proc/locks, or 0 if there is none.
+func lockHolder(file *os.File) int {
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(file.Fd()), &stat); err != nil {
+		return 0
+	}
+
+	id := fmt.Sprintf("%02x:%02x:%d", unix.Major(stat.Dev), unix.Minor(stat.Dev), stat.Ino)
+
+	data, err := os.ReadFile(procLocks)
+	if err != nil {
+		return 0
+	}
+
+	// 1: FLOCK  ADVISORY  WRITE 1234 08:02:131 0 EOF
+	// Processes waiting for the lock are listed too, as "1: -> FLOCK ...".
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[1] == "->" || fields[5] != id {
+			continue
+		}
+
+		if pid, err := strconv.Atoi(fields[4]); err == nil && pid > 0 {
+			return pid
+		}
+	}
+
+	return 0
+}
@@ -20,6 +20,10 @@
 package filesystem_test
 
 import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -252,3 +256,54 @@ func TestLockWriteBlocksRead(t *testing.T) {
 
 	waitGroup.Wait()
 }
+
+func TestLockContext(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+
+	file, err := filesystem.Lock(tempDir)
+	assert.NilError(t, err)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = filesystem.LockContext(ctx, tempDir)
+	assert.ErrorIs(t, err, filesystem.ErrLockTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Assert(t, time.Since(start) >= 50*time.Millisecond)
+
+	var timeoutErr *filesystem.LockTimeoutError
+	assert.Assert(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, timeoutErr.Path, tempDir)
+
+	if runtime.GOOS == "linux" {
+		assert.Equal(t, timeoutErr.PID, os.Getpid())
+	}
+
+	_, err = filesystem.TryReadOnlyLock(tempDir)
+	assert.ErrorIs(t, err, filesystem.ErrLockTimeout)
+
+	// Released while waiting.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		assert.Check(t, filesystem.Unlock(file))
+	}()
+
+	file, err = filesystem.LockContext(t.Context(), tempDir)
+	assert.NilError(t, err)
+	assert.NilError(t, filesystem.Unlock(file))
+
+	file, err = filesystem.TryReadOnlyLock(tempDir)
+	assert.NilError(t, err)
+
+	file2, err := filesystem.TryReadOnlyLock(tempDir)
+	assert.NilError(t, err)
+
+	_, err = filesystem.TryLock(tempDir)
+	assert.ErrorIs(t, err, filesystem.ErrLockTimeout)
+
+	assert.NilError(t, filesystem.Unlock(file))
+	assert.NilError(t, filesystem.Unlock(file2))
+}
@@ -38,9 +38,14 @@ const (
 )
 
 //nolint:wrapcheck
-func platformLock(path string, lockType lockType) (*os.File, error) {
+func platformOpen(path string) (*os.File, error) {
 	//nolint:gosec
-	file, err := os.Open(path)
+	return os.Open(path)
+}
+
+//nolint:wrapcheck
+func platformLock(path string, lockType lockType) (*os.File, error) {
+	file, err := platformOpen(path)
 	if err != nil {
 		return nil, err
 	}
@@ -63,6 +68,24 @@ func platformLock(path string, lockType lockType) (*os.File, error) {
 	return file, nil
 }
 
+// platformTryLock attempts to lock file without blocking, and tells whether it succeeded.
+//
+//nolint:wrapcheck
+func platformTryLock(file *os.File, lockType lockType) (bool, error) {
+	for {
+		err := syscall.Flock(int(file.Fd()), int(lockType)|syscall.LOCK_NB)
+
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, syscall.EWOULDBLOCK):
+			return false, nil
+		case !errors.Is(err, syscall.EINTR):
+			return false, err
+		}
+	}
+}
+
 //nolint:wrapcheck
 func platformUnlock(file *os.File) (err error) {
 	defer func() {
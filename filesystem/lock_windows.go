@@ -47,9 +47,14 @@ const (
 )
 
 //nolint:wrapcheck
-func platformLock(path string, lockType lockType) (file *os.File, err error) {
+func platformOpen(path string) (*os.File, error) {
 	//nolint:gosec
-	file, err = os.OpenFile(path+".lock", os.O_CREATE, lockPermission)
+	return os.OpenFile(path+".lock", os.O_CREATE, lockPermission)
+}
+
+//nolint:wrapcheck
+func platformLock(path string, lockType lockType) (file *os.File, err error) {
+	file, err = platformOpen(path)
 	if err != nil {
 		return nil, err
 	}
@@ -67,6 +72,20 @@ func platformLock(path string, lockType lockType) (file *os.File, err error) {
 	return file, nil
 }
 
+// platformTryLock attempts to lock file without blocking, and tells whether it succeeded.
+//
+//nolint:wrapcheck
+func platformTryLock(file *os.File, lockType lockType) (bool, error) {
+	err := windows.LockFileEx(
+		windows.Handle(file.Fd()),
+		uint32(lockType)|windows.LOCKFILE_FAIL_IMMEDIATELY, reserved, allBytes, allBytes, new(windows.Overlapped))
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
 //nolint:wrapcheck
 func platformUnlock(file *os.File) (err error) {
 	defer func() {
@@ -0,0 +1,210 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultWatchInterval = time.Second
+
+// WatchOp is the kind of change reported by Watch.
+type WatchOp uint8
+
+const (
+	// WatchWrite reports that a file was created or modified.
+	WatchWrite WatchOp = iota + 1
+	// WatchRemove reports that a file was removed.
+	WatchRemove
+)
+
+// WatchEvent describes a change to a file.
+type WatchEvent struct {
+	Path string
+	Op   WatchOp
+}
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	// Interval is how often root is scanned when polling. Defaults to one second.
+	Interval time.Duration
+	// Poll forces polling, even where native notifications are available (they typically do not see changes made by
+	// other hosts on network filesystems).
+	Poll bool
+	// SkipDir, if set, tells whether a directory (other than root) must be ignored, along with everything inside it.
+	SkipDir func(path string) bool
+}
+
+// Watch reports changes to regular files under root, recursively, until ctx is done, at which point the returned
+// channel is closed. Changes are reported as they are observed: rapid successive changes to a file may be coalesced.
+// On Linux, it relies on inotify. Elsewhere, root is polled.
+func Watch(ctx context.Context, root string, options *WatchOptions) (<-chan *WatchEvent, error) {
+	if options == nil {
+		options = &WatchOptions{}
+	}
+
+	if _, err := os.Stat(root); err != nil {
+		return nil, errors.Join(ErrGenericFailure, err)
+	}
+
+	wtc := &watcher{
+		root:    filepath.Clean(root),
+		options: options,
+		files:   map[string]*fileState{},
+		events:  make(chan *WatchEvent),
+	}
+
+	if !options.Poll {
+		started, err := wtc.native(ctx)
+		if err != nil {
+			return nil, errors.Join(ErrGenericFailure, err)
+		}
+
+		if started {
+			return wtc.events, nil
+		}
+	}
+
+	wtc.scan(ctx, wtc.root, false)
+
+	go wtc.poll(ctx)
+
+	return wtc.events, nil
+}
+
+type fileState struct {
+	size     int64
+	modified time.Time
+}
+
+type watcher struct {
+	root    string
+	options *WatchOptions
+	files   map[string]*fileState
+	events  chan *WatchEvent
+	// addDir, if set, is called for every directory found while scanning.
+	addDir func(path string)
+}
+
+func (wtc *watcher) poll(ctx context.Context) {
+	defer close(wtc.events)
+
+	interval := wtc.options.Interval
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !wtc.scan(ctx, wtc.root, true) {
+				return
+			}
+		}
+	}
+}
+
+// scan walks dir and records the state of the files under it, reporting differences with what was known if report is
+// set. It returns false if ctx is done.
+func (wtc *watcher) scan(ctx context.Context, dir string, report bool) bool {
+	current := map[string]*fileState{}
+
+	// Errors are ignored: whatever cannot be walked (e.g. removed meanwhile) is simply not there anymore.
+	_ = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if entry.IsDir() {
+			if path != wtc.root && wtc.options.SkipDir != nil && wtc.options.SkipDir(path) {
+				return filepath.SkipDir
+			}
+
+			if wtc.addDir != nil {
+				wtc.addDir(path)
+			}
+
+			return nil
+		}
+
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				current[path] = &fileState{size: info.Size(), modified: info.ModTime()}
+			}
+		}
+
+		return nil
+	})
+
+	prefix := dir + string(filepath.Separator)
+
+	for path := range wtc.files {
+		if _, ok := current[path]; ok || (path != dir && !strings.HasPrefix(path, prefix)) {
+			continue
+		}
+
+		delete(wtc.files, path)
+
+		if report && !wtc.emit(ctx, &WatchEvent{Path: path, Op: WatchRemove}) {
+			return false
+		}
+	}
+
+	for path, state := range current {
+		if !wtc.update(path, state) || !report {
+			continue
+		}
+
+		if !wtc.emit(ctx, &WatchEvent{Path: path, Op: WatchWrite}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// update records the state of a file, and tells whether it changed.
+func (wtc *watcher) update(path string, state *fileState) bool {
+	known, ok := wtc.files[path]
+	if ok && known.size == state.size && known.modified.Equal(state.modified) {
+		return false
+	}
+
+	wtc.files[path] = state
+
+	return true
+}
+
+func (wtc *watcher) emit(ctx context.Context, event *WatchEvent) bool {
+	select {
+	case wtc.events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
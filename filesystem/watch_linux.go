@@ -0,0 +1,152 @@
+//go:build linux
+
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	inotifyMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE |
+		unix.IN_ONLYDIR
+	inotifyBufferSize = 64 * 1024
+)
+
+// native watches root with inotify. Every directory needs its own watch, which is added as soon as the directory is
+// found - files created before that are caught by scanning the directory right after.
+// If inotify is not usable (e.g. out of instances), Watch falls back to polling.
+func (wtc *watcher) native(ctx context.Context) (bool, error) {
+	// Non-blocking, so that reads go through the runtime poller, and closing the file interrupts them.
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		//nolint:nilerr
+		return false, nil
+	}
+
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	if _, err = unix.InotifyAddWatch(fd, wtc.root, inotifyMask); err != nil {
+		//nolint:nilerr
+		return false, file.Close()
+	}
+
+	watches := map[int32]string{}
+
+	wtc.addDir = func(path string) {
+		// A directory that cannot be watched (e.g. removed meanwhile) is treated as gone.
+		if wd, err := unix.InotifyAddWatch(fd, path, inotifyMask); err == nil {
+			watches[int32(wd)] = path //nolint:gosec
+		}
+	}
+
+	wtc.scan(ctx, wtc.root, false)
+
+	go func() {
+		<-ctx.Done()
+
+		_ = file.Close()
+	}()
+
+	go wtc.read(ctx, file, watches)
+
+	return true, nil
+}
+
+func (wtc *watcher) read(ctx context.Context, file *os.File, watches map[int32]string) {
+	defer close(wtc.events)
+
+	buf := make([]byte, inotifyBufferSize)
+
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset])) //nolint:gosec
+			start := offset + unix.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+
+			if !wtc.handle(ctx, watches, event, name) {
+				return
+			}
+		}
+	}
+}
+
+// handle processes a single inotify event. It returns false if ctx is done.
+func (wtc *watcher) handle(ctx context.Context, watches map[int32]string, event *unix.InotifyEvent, name string) bool {
+	// Events were dropped: resynchronize.
+	if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+		return wtc.scan(ctx, wtc.root, true)
+	}
+
+	dir, ok := watches[event.Wd]
+	if !ok {
+		return true
+	}
+
+	if event.Mask&unix.IN_IGNORED != 0 {
+		delete(watches, event.Wd)
+
+		return true
+	}
+
+	path := filepath.Join(dir, name)
+
+	switch {
+	case event.Mask&unix.IN_ISDIR != 0:
+		if event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 &&
+			wtc.options.SkipDir != nil && wtc.options.SkipDir(path) {
+			return true
+		}
+
+		// Watches (and reports) what appeared, or reports what disappeared.
+		return wtc.scan(ctx, path, true)
+	case event.Mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0:
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return true
+		}
+
+		if !wtc.update(path, &fileState{size: info.Size(), modified: info.ModTime()}) {
+			return true
+		}
+
+		return wtc.emit(ctx, &WatchEvent{Path: path, Op: WatchWrite})
+	case event.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		if _, ok = wtc.files[path]; !ok {
+			return true
+		}
+
+		delete(wtc.files, path)
+
+		return wtc.emit(ctx, &WatchEvent{Path: path, Op: WatchRemove})
+	}
+
+	return true
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package filesystem_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/filesystem"
+)
+
+func nextWatchEvent(t *testing.T, events <-chan *filesystem.WatchEvent) *filesystem.WatchEvent {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	for _, poll := range []bool{false, true} {
+		t.Run(map[bool]string{false: "native", true: "poll"}[poll], func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			ctx, cancel := context.WithCancel(t.Context())
+
+			assert.NilError(t, os.WriteFile(filepath.Join(root, "existing"), []byte("existing"), 0o600))
+
+			events, err := filesystem.Watch(ctx, root, &filesystem.WatchOptions{
+				Interval: 10 * time.Millisecond,
+				Poll:     poll,
+				SkipDir: func(path string) bool {
+					return strings.HasPrefix(filepath.Base(path), ".")
+				},
+			})
+			assert.NilError(t, err)
+
+			// Skipped directories are not reported.
+			assert.NilError(t, os.Mkdir(filepath.Join(root, ".skipped"), 0o700))
+			assert.NilError(t, os.WriteFile(filepath.Join(root, ".skipped", "file"), []byte("file"), 0o600))
+
+			nested := filepath.Join(root, "dir", "file")
+			assert.NilError(t, os.MkdirAll(filepath.Dir(nested), 0o700))
+			assert.NilError(t, os.WriteFile(nested, []byte("file"), 0o600))
+			assert.DeepEqual(t, nextWatchEvent(t, events), &filesystem.WatchEvent{Path: nested, Op: filesystem.WatchWrite})
+
+			assert.NilError(t, os.WriteFile(nested, []byte("modified"), 0o600))
+			assert.DeepEqual(t, nextWatchEvent(t, events), &filesystem.WatchEvent{Path: nested, Op: filesystem.WatchWrite})
+
+			assert.NilError(t, os.RemoveAll(filepath.Dir(nested)))
+			assert.DeepEqual(t, nextWatchEvent(t, events), &filesystem.WatchEvent{Path: nested, Op: filesystem.WatchRemove})
+
+			assert.NilError(t, os.Remove(filepath.Join(root, "existing")))
+			assert.DeepEqual(t, nextWatchEvent(t, events), &filesystem.WatchEvent{
+				Path: filepath.Join(root, "existing"),
+				Op:   filesystem.WatchRemove,
+			})
+
+			cancel()
+
+			for range events {
+				// Drain until closed.
+			}
+		})
+	}
+}
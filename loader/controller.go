@@ -19,8 +19,10 @@
 package loader
 
 import (
+	"bytes"
 	"errors"
 	"os"
+	"sync"
 )
 
 // IConfiguration inherits CoreConfig and provides default implementation.
@@ -35,8 +37,12 @@ type IConfiguration interface {
 		GetHome() string
 		// GetDataRoot returns the app persistent storage location
 		GetDataRoot() string
+		// GetStateRoot returns the app persistent state location (history, etc.)
+		GetStateRoot() string
 		// GetCacheRoot returns the app transient storage location
 		GetCacheRoot() string
+		// GetRuntimeRoot returns the app runtime location (sockets, etc.)
+		GetRuntimeRoot() string
 		// GetLogRoot returns the app logs location
 		GetLogRoot() string
 	*/
@@ -56,33 +62,193 @@ func Exist(obj IConfiguration) bool {
 }
 
 // Load reads the configuration from the specified location and applies it to the provided object.
+// Settings the object does not have are rejected (with ErrUnknownField), and the object is validated after OnIO, if it
+// implements IValidator.
+// Files at an older version are migrated (see RegisterMigration): the original file is then backed up next to it (as
+// <file>.v<version>.bak), and the upgraded configuration saved in its place.
+// The file is read under a read lock (see Save).
 func Load(obj IConfiguration) error {
-	err := read(obj, obj.GetLocation()...)
+	return load(obj, false)
+}
+
+// load is Load, without locking the file if held is set.
+func load(obj IConfiguration, held bool) error {
+	lock, err := lockRead(obj, held)
 	if err != nil {
 		return errors.Join(ErrConfigLoadFail, err)
 	}
 
+	up, err := read(obj, obj.GetLocation()...)
+
+	if err = unlock(lock, err); err != nil {
+		return errors.Join(ErrConfigLoadFail, err)
+	}
+
 	obj.OnIO()
 
+	if err = validate(obj); err != nil {
+		return err
+	}
+
+	if up == nil {
+		return nil
+	}
+
+	return upgradeFile(obj, up, held)
+}
+
+// upgradeFile saves obj, upgraded from the file, unless another process has changed it since (typically to upgrade it
+// as well).
+func upgradeFile(obj IConfiguration, up *upgrade, held bool) (err error) {
+	lock, err := lockWrite(obj, held)
+	if err != nil {
+		return errors.Join(ErrConfigSaveFail, err)
+	}
+
+	defer func() {
+		err = unlock(lock, err)
+	}()
+
+	//nolint:gosec
+	current, err := os.ReadFile(absolute(obj.GetLocation()...))
+	if err != nil || !bytes.Equal(current, up.original) {
+		return nil
+	}
+
+	if err = backup(up, obj.GetLocation()...); err != nil {
+		return errors.Join(ErrConfigMigrateFail, err)
+	}
+
+	if err = write(obj, obj.GetLocation()...); err != nil {
+		return errors.Join(ErrConfigSaveFail, err)
+	}
+
 	return nil
 }
 
 // Save writes the current state of the configuration object to the specified location.
+// The file is written under a write lock on a sidecar file (<file>.lock), so that other processes never read it while
+// it is being saved. Use Modify to change settings without losing changes saved concurrently by other processes.
 func Save(obj IConfiguration) error {
-	obj.OnIO()
+	return save(obj, false)
+}
 
-	err := write(obj, obj.GetLocation()...)
+// save is Save, without locking the file if held is set.
+func save(obj IConfiguration, held bool) error {
+	lock, err := lockWrite(obj, held)
 	if err != nil {
+		return errors.Join(ErrConfigSaveFail, err)
+	}
+
+	obj.OnIO()
+
+	if err = unlock(lock, write(obj, obj.GetLocation()...)); err != nil {
 		err = errors.Join(ErrConfigSaveFail, err)
 	}
 
 	return err
 }
 
-// Remove deletes the configuration file at the specified location.
+// Modify reloads the configuration from its file (if it exists), calls mutate to change it, then saves it, all under
+// a write lock, so that no other process can save the file in between. The file is not saved if mutate fails.
+// As with Load, settings missing from the file keep their current values in obj, which should only hold defaults.
+// mutate must load, save or remove the file through locked: Load, Save and Remove wait for Modify to return, as they
+// would in other processes (and so deadlock if called by mutate).
+func Modify(obj IConfiguration, mutate func(locked *Locked) error) (err error) {
+	lock, err := lockWrite(obj, false)
+	if err != nil {
+		return errors.Join(ErrConfigSaveFail, err)
+	}
+
+	defer func() {
+		err = unlock(lock, err)
+	}()
+
+	up, err := read(obj, obj.GetLocation()...)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Join(ErrConfigLoadFail, err)
+	}
+
+	obj.OnIO()
+
+	if err = validate(obj); err != nil {
+		return err
+	}
+
+	if up != nil {
+		if err = backup(up, obj.GetLocation()...); err != nil {
+			return errors.Join(ErrConfigMigrateFail, err)
+		}
+	}
+
+	locked := &Locked{obj: obj}
+
+	err = mutate(locked)
+
+	locked.mu.Lock()
+	locked.done = true
+	locked.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	obj.OnIO()
+
+	if err = write(obj, obj.GetLocation()...); err != nil {
+		return errors.Join(ErrConfigSaveFail, err)
+	}
+
+	return nil
+}
+
+// Locked gives access to the file of a configuration while Modify holds its lock, until Modify returns.
+type Locked struct {
+	obj  IConfiguration
+	mu   sync.Mutex
+	done bool
+}
+
+// Load is Load, with the lock held by Modify.
+func (locked *Locked) Load() error {
+	return locked.with(ErrConfigLoadFail, load)
+}
+
+// Save is Save, with the lock held by Modify.
+func (locked *Locked) Save() error {
+	return locked.with(ErrConfigSaveFail, save)
+}
+
+// Remove is Remove, with the lock held by Modify.
+func (locked *Locked) Remove() error {
+	return locked.with(ErrConfigRemoveFail, erase)
+}
+
+// with calls function with the lock held, unless Modify has returned, in which case it fails with failure.
+func (locked *Locked) with(failure error, function func(obj IConfiguration, held bool) error) error {
+	locked.mu.Lock()
+	defer locked.mu.Unlock()
+
+	if locked.done {
+		return errors.Join(failure, errNotModifying)
+	}
+
+	return function(locked.obj, true)
+}
+
+// Remove deletes the configuration file at the specified location, under a write lock (see Save).
 func Remove(obj IConfiguration) error {
-	err := remove(obj.GetLocation()...)
+	return erase(obj, false)
+}
+
+// erase is Remove, without locking the file if held is set.
+func erase(obj IConfiguration, held bool) error {
+	lock, err := lockWrite(obj, held)
 	if err != nil {
+		return errors.Join(ErrConfigRemoveFail, err)
+	}
+
+	if err = unlock(lock, remove(obj.GetLocation()...)); err != nil {
 		err = errors.Join(ErrConfigRemoveFail, err)
 	}
 
@@ -0,0 +1,165 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loader
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidValue = errors.New("invalid value")
+
+// convert turns a raw value, from the environment or a flag, into a generic value for a setting of type typ:
+//   - durations are either Go durations (e.g. "1m30s") or nanoseconds
+//   - uint16 settings also accept TLS versions (e.g. "1.2", "TLS1.3" or "TLS 1.3")
+//   - slices are either JSON arrays, or comma separated items
+//   - types with their own JSON decoding get raw as JSON if it is valid for them, or as a JSON string otherwise
+//   - anything else that is not a string or a scalar is JSON.
+func convert(raw string, typ reflect.Type) (any, error) {
+	if typ == reflect.TypeFor[time.Duration]() {
+		return convertDuration(raw)
+	}
+
+	if decodesItself(typ) {
+		if json.Unmarshal([]byte(raw), reflect.New(typ).Interface()) == nil {
+			return convertJSON(raw)
+		}
+
+		return raw, nil
+	}
+
+	//nolint:exhaustive
+	switch typ.Kind() {
+	case reflect.String:
+		return raw, nil
+	case reflect.Bool:
+		value, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, errors.Join(errInvalidValue, err)
+		}
+
+		return value, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value, err := strconv.ParseInt(strings.TrimSpace(raw), 0, typ.Bits())
+		if err != nil {
+			return nil, errors.Join(errInvalidValue, err)
+		}
+
+		return value, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		value, err := strconv.ParseUint(strings.TrimSpace(raw), 0, typ.Bits())
+		if err == nil {
+			return value, nil
+		}
+
+		if typ.Kind() == reflect.Uint16 {
+			if version, ok := tlsVersion(raw); ok {
+				return version, nil
+			}
+		}
+
+		return nil, errors.Join(errInvalidValue, err)
+	case reflect.Float32, reflect.Float64:
+		value, err := strconv.ParseFloat(strings.TrimSpace(raw), typ.Bits())
+		if err != nil {
+			return nil, errors.Join(errInvalidValue, err)
+		}
+
+		return value, nil
+	case reflect.Slice, reflect.Array:
+		return convertList(raw, typ)
+	default:
+		return convertJSON(raw)
+	}
+}
+
+func convertDuration(raw string) (any, error) {
+	raw = strings.TrimSpace(raw)
+
+	if nanoseconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return nanoseconds, nil
+	}
+
+	duration, err := time.ParseDuration(raw)
+	if err != nil {
+		return nil, errors.Join(errInvalidValue, err)
+	}
+
+	return int64(duration), nil
+}
+
+func convertList(raw string, typ reflect.Type) (any, error) {
+	// Byte slices are base64 strings in JSON.
+	if typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8 {
+		return raw, nil
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(raw), "[") {
+		return convertJSON(raw)
+	}
+
+	list := []any{}
+
+	if strings.TrimSpace(raw) == "" {
+		return list, nil
+	}
+
+	for _, item := range strings.Split(raw, ",") {
+		value, err := convert(strings.TrimSpace(item), typ.Elem())
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, value)
+	}
+
+	return list, nil
+}
+
+func convertJSON(raw string) (any, error) {
+	var generic any
+	if err := json.Unmarshal([]byte(raw), &generic); err != nil {
+		return nil, errors.Join(errInvalidValue, err)
+	}
+
+	return normalize(generic, false), nil
+}
+
+// tlsVersion parses a TLS version, such as "1.2", "TLS1.2", "TLS 1.2" or "tls12".
+func tlsVersion(raw string) (uint16, bool) {
+	version := strings.ToUpper(strings.TrimSpace(raw))
+	version = strings.TrimSpace(strings.TrimPrefix(version, "TLS"))
+	version = strings.TrimPrefix(strings.TrimPrefix(version, "V"), "_")
+
+	switch strings.ReplaceAll(strings.ReplaceAll(version, ".", ""), "_", "") {
+	case "10":
+		return tls.VersionTLS10, true
+	case "11":
+		return tls.VersionTLS11, true
+	case "12":
+		return tls.VersionTLS12, true
+	case "13":
+		return tls.VersionTLS13, true
+	}
+
+	return 0, false
+}
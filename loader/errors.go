@@ -25,4 +25,25 @@ var (
 	ErrConfigSaveFail = errors.New("failed saving config file")
 	// ErrConfigRemoveFail is returned when the configuration file cannot be removed.
 	ErrConfigRemoveFail = errors.New("failed removing config file")
+	// ErrConfigWatchFail is returned when the configuration file cannot be watched.
+	ErrConfigWatchFail = errors.New("failed watching config file")
+	// ErrUnknownFormat is returned when the configuration format has no registered codec.
+	ErrUnknownFormat = errors.New("unknown config format")
+	// ErrUnknownField is returned when the configuration file has a setting the configuration object does not have.
+	ErrUnknownField = errors.New("unknown field")
+	// ErrConfigInvalid is returned when the configuration fails validation (see IValidator).
+	ErrConfigInvalid = errors.New("invalid config")
+	// ErrConfigVersion is returned when the configuration file version is invalid, or newer than supported.
+	ErrConfigVersion = errors.New("unsupported config version")
+	// ErrConfigMigrateFail is returned when the configuration file cannot be migrated to the current version.
+	ErrConfigMigrateFail = errors.New("failed migrating config file")
+	// ErrSecretResolveFail is returned when a secret referenced by the configuration cannot be resolved.
+	ErrSecretResolveFail = errors.New("failed resolving secret")
+	// ErrSecretNotFound is returned by resolvers when the referenced secret does not exist.
+	ErrSecretNotFound = errors.New("secret not found")
+
+	errNotAnObject  = errors.New("configuration is not an object")
+	errNoLocation   = errors.New("configuration has no location")
+	errNoAppName    = errors.New("configuration has no application name")
+	errNotModifying = errors.New("configuration is no longer being modified")
 )
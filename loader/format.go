@@ -0,0 +1,337 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml/v2"
+	"go.yaml.in/yaml/v3"
+)
+
+// Configuration objects only describe their JSON form (with json tags, or custom JSON marshalling). Other formats are
+// converted to and from JSON, through generic values (maps, slices and scalars), so that they map to the same fields.
+
+// Format names a configuration file format.
+type Format string
+
+const (
+	// FormatJSON is plain JSON. It is the default, for files without a known extension.
+	FormatJSON Format = "json"
+	// FormatJSONC is JSON with comments (// and /* */) and trailing commas. Comments are not preserved by Save.
+	FormatJSONC Format = "jsonc"
+	// FormatYAML is YAML. Comments are not preserved by Save.
+	FormatYAML Format = "yaml"
+	// FormatTOML is TOML. Comments are not preserved by Save.
+	FormatTOML Format = "toml"
+)
+
+// Codec reads and writes configuration files of a given format.
+type Codec interface {
+	Marshal(value any) ([]byte, error)
+	Unmarshal(data []byte, value any) error
+}
+
+// IFormat may be implemented by configurations to choose the format of their file, regardless of its extension.
+type IFormat interface {
+	// GetFormat returns the format of the configuration file, or an empty string to detect it from the extension.
+	GetFormat() Format
+}
+
+//nolint:gochecknoglobals
+var (
+	formatsMu sync.RWMutex
+	formats   = map[Format]Codec{
+		FormatJSON:  JSONCodec{},
+		FormatJSONC: JSONCCodec{},
+		FormatYAML:  YAMLCodec{},
+		FormatTOML:  TOMLCodec{},
+	}
+	extensions = map[string]Format{
+		".json":  FormatJSON,
+		".jsonc": FormatJSONC,
+		".yaml":  FormatYAML,
+		".yml":   FormatYAML,
+		".toml":  FormatTOML,
+	}
+)
+
+// RegisterFormat registers codec for format, and for files with the given extensions (with their leading dot).
+// Built-in formats and extensions can be overridden.
+func RegisterFormat(format Format, codec Codec, exts ...string) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+
+	formats[format] = codec
+
+	for _, ext := range exts {
+		extensions[strings.ToLower(ext)] = format
+	}
+}
+
+// codecFor returns the codec to use for obj, stored at loc.
+func codecFor(obj IConfiguration, loc string) (Codec, error) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	format := FormatJSON
+
+	if ext, ok := extensions[strings.ToLower(filepath.Ext(loc))]; ok {
+		format = ext
+	}
+
+	if override, ok := obj.(IFormat); ok && override.GetFormat() != "" {
+		format = override.GetFormat()
+	}
+
+	codec, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+
+	return codec, nil
+}
+
+// JSONCodec reads and writes JSON.
+type JSONCodec struct{}
+
+// Marshal encodes value as indented JSON.
+//
+//nolint:wrapcheck
+func (JSONCodec) Marshal(value any) ([]byte, error) {
+	return json.MarshalIndent(value, "", " ")
+}
+
+// Unmarshal decodes JSON data into value.
+//
+//nolint:wrapcheck
+func (JSONCodec) Unmarshal(data []byte, value any) error {
+	return json.Unmarshal(data, value)
+}
+
+// JSONCCodec reads JSON with comments and trailing commas, and writes JSON.
+type JSONCCodec struct{}
+
+// Marshal encodes value as indented JSON.
+func (JSONCCodec) Marshal(value any) ([]byte, error) {
+	return JSONCodec{}.Marshal(value)
+}
+
+// Unmarshal decodes JSON data, with comments and trailing commas, into value.
+func (JSONCCodec) Unmarshal(data []byte, value any) error {
+	return JSONCodec{}.Unmarshal(standardize(data), value)
+}
+
+// YAMLCodec reads and writes YAML.
+type YAMLCodec struct{}
+
+// Marshal encodes value as YAML.
+//
+//nolint:wrapcheck
+func (YAMLCodec) Marshal(value any) ([]byte, error) {
+	generic, err := toGeneric(value, false)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2) //revive:disable-line:add-constant
+
+	if err = encoder.Encode(generic); err != nil {
+		return nil, err
+	}
+
+	if err = encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes YAML data into value.
+//
+//nolint:wrapcheck
+func (YAMLCodec) Unmarshal(data []byte, value any) error {
+	var generic any
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+
+	return fromGeneric(generic, value)
+}
+
+// TOMLCodec reads and writes TOML.
+type TOMLCodec struct{}
+
+// Marshal encodes value as TOML. Null values cannot be represented, and are left out.
+//
+//nolint:wrapcheck
+func (TOMLCodec) Marshal(value any) ([]byte, error) {
+	generic, err := toGeneric(value, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return toml.Marshal(generic)
+}
+
+// Unmarshal decodes TOML data into value.
+//
+//nolint:wrapcheck
+func (TOMLCodec) Unmarshal(data []byte, value any) error {
+	generic := map[string]any{}
+	if err := toml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+
+	return fromGeneric(generic, value)
+}
+
+// toGeneric turns value into generic values, as per its JSON form. Nulls are dropped if skipNulls is set.
+//
+//nolint:wrapcheck
+func toGeneric(value any, skipNulls bool) (any, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var generic any
+	if err = decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	return normalize(generic, skipNulls), nil
+}
+
+// normalize turns JSON numbers into integers where possible (floats otherwise), and drops nulls if skipNulls is set.
+func normalize(value any, skipNulls bool) any {
+	switch typed := value.(type) {
+	case json.Number:
+		if integer, err := typed.Int64(); err == nil {
+			return integer
+		}
+
+		float, _ := typed.Float64()
+
+		return float
+	case map[string]any:
+		for key, item := range typed {
+			if item == nil && skipNulls {
+				delete(typed, key)
+
+				continue
+			}
+
+			typed[key] = normalize(item, skipNulls)
+		}
+	case []any:
+		for index, item := range typed {
+			typed[index] = normalize(item, skipNulls)
+		}
+	}
+
+	return value
+}
+
+// fromGeneric decodes generic values into value, as per its JSON form.
+//
+//nolint:wrapcheck
+func fromGeneric(generic, value any) error {
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+// standardize turns JSON with comments and trailing commas into plain JSON. Comments are replaced with spaces (newlines
+// are kept), so that offsets in syntax errors still match the original data.
+func standardize(data []byte) []byte {
+	out := bytes.Clone(data)
+	// comma is the position of the last comma seen outside strings, if only whitespace and comments followed.
+	comma := -1
+
+	blank := func(from, until int) {
+		for index := from; index < until; index++ {
+			if out[index] != '\n' {
+				out[index] = ' '
+			}
+		}
+	}
+
+	for index := 0; index < len(out); index++ {
+		switch char := out[index]; {
+		case char == '"':
+			comma = -1
+			index = skipString(out, index)
+		case char == '/' && index+1 < len(out) && out[index+1] == '/':
+			end := bytes.IndexByte(out[index:], '\n')
+			if end < 0 {
+				end = len(out) - index
+			}
+
+			blank(index, index+end)
+			index += end - 1
+		case char == '/' && index+1 < len(out) && out[index+1] == '*':
+			end := bytes.Index(out[index+2:], []byte("*/"))
+			if end < 0 {
+				// Left as is, for the decoder to report.
+				return out
+			}
+
+			blank(index, index+end+4) //revive:disable-line:add-constant
+			index += end + 3          //revive:disable-line:add-constant
+		case char == ',':
+			comma = index
+		case char == '}' || char == ']':
+			if comma >= 0 {
+				out[comma] = ' '
+			}
+
+			comma = -1
+		case char != ' ' && char != '\t' && char != '\n' && char != '\r':
+			comma = -1
+		}
+	}
+
+	return out
+}
+
+// skipString returns the position of the quote closing the string starting at start (or the end of data).
+func skipString(data []byte, start int) int {
+	for index := start + 1; index < len(data); index++ {
+		switch data[index] {
+		case '\\':
+			index++
+		case '"':
+			return index
+		}
+	}
+
+	return len(data)
+}
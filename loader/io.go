@@ -19,7 +19,6 @@
 package loader
 
 import (
-	"encoding/json"
 	"os"
 	"path"
 	"path/filepath"
@@ -41,35 +40,104 @@ func absolute(location ...string) string {
 	return loc
 }
 
+// upgrade records the original content of a configuration file upgraded by read, to back it up.
+type upgrade struct {
+	from     int
+	original []byte
+}
+
+// read loads the file at location into obj, migrating it first if needed (in which case it returns an upgrade).
+//
 //nolint:wrapcheck
-func read(cfg any, location ...string) error {
+func read(obj IConfiguration, location ...string) (*upgrade, error) {
 	loc := absolute(location...)
 
+	codec, err := codecFor(obj, loc)
+	if err != nil {
+		return nil, err
+	}
+
 	mut.Lock()
 	defer mut.Unlock()
 
 	//nolint:gosec
 	data, err := os.ReadFile(loc)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var generic any
+	if err = codec.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+
+	generic = normalize(generic, false)
+
+	var up *upgrade
+
+	if doc, ok := generic.(map[string]any); ok {
+		from, err := migrate(obj, doc)
+		if err != nil {
+			return nil, err
+		}
+
+		if from < currentVersion(obj) {
+			up = &upgrade{from: from, original: data}
+		}
+	}
+
+	// Unknown settings are rejected, rather than silently ignored.
+	if err = strict(generic, obj); err != nil {
+		return nil, err
+	}
+
+	if err = resolveSecrets(obj, generic, nil); err != nil {
+		return nil, err
+	}
+
+	if up != nil || hasSecrets(obj) {
+		return up, fromGeneric(generic, obj)
 	}
 
-	return json.Unmarshal(data, &cfg)
+	return nil, codec.Unmarshal(data, obj)
 }
 
-func write(cfg any, location ...string) error {
+func write(obj IConfiguration, location ...string) error {
 	loc := absolute(location...)
 
+	codec, err := codecFor(obj, loc)
+	if err != nil {
+		return err
+	}
+
 	mut.Lock()
 	defer mut.Unlock()
 
-	err := os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault)
+	err = os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault)
 	if err != nil {
 		//nolint:wrapcheck
 		return err
 	}
 
-	data, err := json.MarshalIndent(&cfg, "", " ")
+	var value any = obj
+
+	// Versioned configurations are saved along with their version, and secrets are replaced by their references.
+	if current := currentVersion(obj); current > 0 || hasSecrets(obj) {
+		generic, err := toGeneric(obj, false)
+		if err != nil {
+			return err
+		}
+
+		restoreSecrets(obj, generic, "")
+
+		if doc, ok := generic.(map[string]any); ok && current > 0 {
+			doc[versionKey] = current
+		}
+
+		value = generic
+	}
+
+	data, err := codec.Marshal(value)
 	if err != nil {
 		//nolint:wrapcheck
 		return err
@@ -79,6 +147,17 @@ func write(cfg any, location ...string) error {
 	return filesystem.WriteFile(loc, data, filesystem.FilePermissionsDefault)
 }
 
+// backup saves the original content of a configuration file before it is upgraded.
+func backup(up *upgrade, location ...string) error {
+	loc := absolute(location...)
+
+	mut.Lock()
+	defer mut.Unlock()
+
+	//nolint:wrapcheck
+	return filesystem.WriteFile(backupPath(loc, up.from), up.original, filesystem.FilePermissionsDefault)
+}
+
 func remove(location ...string) error {
 	loc := absolute(location...)
 
@@ -0,0 +1,427 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loader
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Names of the layers returned by DefaultLayers.
+const (
+	// LayerDefaults is the origin of settings no layer has set: the values of the object before loading.
+	LayerDefaults = "defaults"
+	// LayerSystem is the system-wide configuration file (e.g. /etc/<app>/config.json).
+	LayerSystem = "system"
+	// LayerUser is the configuration file in the user configuration directory, as used by Load and Save.
+	LayerUser = "user"
+	// LayerProject is the configuration file in the current directory (e.g. .<app>.json).
+	LayerProject = "project"
+	// LayerEnv is the environment (e.g. APP_LOGGER_LEVEL).
+	LayerEnv = "env"
+	// LayerFlags is the command line flags (e.g. --logger-level).
+	LayerFlags = "flags"
+)
+
+// Layer is a source of settings, applied on top of the previous ones by LoadLayers.
+type Layer interface {
+	// Name identifies the layer in Origins.
+	Name() string
+	// settings returns the settings of the layer for obj, as a generic JSON document.
+	settings(obj IConfiguration, fields []*field) (map[string]any, error)
+}
+
+// FileLayer returns a layer reading the file at loc, in the format of obj (see IFormat) or as per its extension.
+// Missing files are skipped.
+func FileLayer(name, loc string) Layer {
+	return &fileLayer{name: name, loc: loc}
+}
+
+type fileLayer struct {
+	name string
+	loc  string
+}
+
+func (layer *fileLayer) Name() string {
+	return layer.name
+}
+
+func (layer *fileLayer) settings(obj IConfiguration, _ []*field) (map[string]any, error) {
+	codec, err := codecFor(obj, layer.loc)
+	if err != nil {
+		return nil, err
+	}
+
+	//nolint:gosec
+	data, err := os.ReadFile(layer.loc)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		//nolint:wrapcheck
+		return nil, err
+	}
+
+	var generic any
+	if err = codec.Unmarshal(data, &generic); err != nil {
+		return nil, fmt.Errorf("%s: %w", layer.loc, err)
+	}
+
+	doc, ok := normalize(generic, false).(map[string]any)
+	if !ok {
+		if generic != nil {
+			return nil, fmt.Errorf("%s: %w", layer.loc, errNotAnObject)
+		}
+
+		return nil, nil
+	}
+
+	// Files at an older version are only migrated in memory.
+	if _, err = migrate(obj, doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", layer.loc, err)
+	}
+
+	return doc, nil
+}
+
+// EnvLayer returns a layer reading environment variables named after the JSON path of every setting, in upper snake
+// case, after prefix (e.g. APP_CLIENT_TLS_HANDSHAKE_TIMEOUT for the "client.tlsHandshakeTimeout" setting, with prefix
+// "APP").
+func EnvLayer(prefix string) Layer {
+	return &envLayer{prefix: strings.TrimSuffix(prefix, "_")}
+}
+
+type envLayer struct {
+	prefix string
+}
+
+func (*envLayer) Name() string {
+	return LayerEnv
+}
+
+func (layer *envLayer) settings(_ IConfiguration, fields []*field) (map[string]any, error) {
+	doc := map[string]any{}
+
+	for _, fld := range fields {
+		name := layer.prefix + "_" + fld.key()
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		value, err := convert(raw, fld.typ)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		set(doc, fld.path, value)
+	}
+
+	return doc, nil
+}
+
+// FlagLayer returns a layer reading the flags of flags that have been set, and are named after the JSON path of a
+// setting, words separated with dashes or dots (e.g. --client-tls-handshake-timeout or --client.tlsHandshakeTimeout).
+// Other flags are ignored.
+func FlagLayer(flags *flag.FlagSet) Layer {
+	return &flagLayer{flags: flags}
+}
+
+type flagLayer struct {
+	flags *flag.FlagSet
+}
+
+func (*flagLayer) Name() string {
+	return LayerFlags
+}
+
+func (layer *flagLayer) settings(_ IConfiguration, fields []*field) (map[string]any, error) {
+	byKey := map[string]*field{}
+	for _, fld := range fields {
+		byKey[fld.key()] = fld
+	}
+
+	doc := map[string]any{}
+
+	var errs []error
+
+	layer.flags.Visit(func(flg *flag.Flag) {
+		fld, ok := byKey[snake(flg.Name)]
+		if !ok {
+			return
+		}
+
+		value, err := convert(flg.Value.String(), fld.typ)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("--%s: %w", flg.Name, err))
+
+			return
+		}
+
+		set(doc, fld.path, value)
+	})
+
+	return doc, errors.Join(errs...)
+}
+
+// DefaultLayers returns the usual layers for obj, from lowest to highest precedence: the system configuration files
+// (see SystemConfigDirs), the user configuration file (as used by Load), the project file in the current directory,
+// the environment (prefixed with the application name, e.g. APP_), and flags (if not nil).
+// The system and project files are left out if the location of obj is absolute.
+// It fails if obj has no location, or no application name (see EnvPrefix).
+func DefaultLayers(obj IConfiguration, flags *flag.FlagSet) ([]Layer, error) {
+	location := obj.GetLocation()
+	if len(location) == 0 {
+		return nil, errors.Join(ErrConfigLoadFail, errNoLocation)
+	}
+
+	app, err := appName(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	loc := path.Join(location...)
+	layers := []Layer{}
+
+	if !filepath.IsAbs(loc) {
+		for _, dir := range SystemConfigDirs() {
+			layers = append(layers, FileLayer(LayerSystem, filepath.Join(dir, loc)))
+		}
+	}
+
+	layers = append(layers, FileLayer(LayerUser, absolute(location...)))
+
+	if !filepath.IsAbs(loc) {
+		layers = append(layers, FileLayer(LayerProject, "."+app+filepath.Ext(loc)))
+	}
+
+	layers = append(layers, EnvLayer(snake(app)))
+
+	if flags != nil {
+		layers = append(layers, FlagLayer(flags))
+	}
+
+	return layers, nil
+}
+
+// IAppNamed is implemented by configurations that know the name of their application.
+type IAppNamed interface {
+	// GetAppName returns the name of the application (e.g. "my-app").
+	GetAppName() string
+}
+
+// EnvPrefix returns the prefix of the environment variables for obj: its application name in upper snake case (e.g.
+// MY_APP for "my-app"). It fails unless obj implements IAppNamed, with a name that is not a path.
+func EnvPrefix(obj IConfiguration) (string, error) {
+	app, err := appName(obj)
+	if err != nil {
+		return "", err
+	}
+
+	return snake(app), nil
+}
+
+func appName(obj IConfiguration) (string, error) {
+	named, ok := obj.(IAppNamed)
+	if !ok {
+		return "", errors.Join(ErrConfigLoadFail, errNoAppName)
+	}
+
+	app := named.GetAppName()
+	if app == "" || strings.ContainsAny(app, `/\`) {
+		return "", errors.Join(ErrConfigLoadFail, fmt.Errorf("%w: %q", errNoAppName, app))
+	}
+
+	return app, nil
+}
+
+// ApplyEnv applies the environment variables named after the settings of obj (see EnvLayer) on top of its current
+// values, typically right after Load, then calls OnIO.
+func ApplyEnv(obj IConfiguration, prefix string) error {
+	_, err := LoadLayers(obj, EnvLayer(prefix))
+
+	return err
+}
+
+// SystemConfigDirs returns the directories of system-wide configuration files, from lowest to highest precedence:
+// %ProgramData% on Windows, /etc elsewhere, followed on Linux (and other unix-es, save for macOS) by the directories
+// of XDG_CONFIG_DIRS (/etc/xdg by default), the first one of which has the highest precedence.
+func SystemConfigDirs() []string {
+	switch runtime.GOOS {
+	case "windows":
+		return []string{os.Getenv("ProgramData")}
+	case "darwin":
+		return []string{"/etc"}
+	}
+
+	dirs := []string{}
+
+	for _, dir := range filepath.SplitList(os.Getenv("XDG_CONFIG_DIRS")) {
+		// Relative paths are invalid, as per the specification.
+		if filepath.IsAbs(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	if len(dirs) == 0 {
+		dirs = []string{"/etc/xdg"}
+	}
+
+	slices.Reverse(dirs)
+
+	return append([]string{"/etc"}, dirs...)
+}
+
+// Origins tells which layer set every setting.
+type Origins struct {
+	layers map[string]string
+}
+
+// Of returns the name of the layer that set the setting at the dotted JSON path (e.g. "logger.level"), or
+// LayerDefaults if none did. For settings with children, the layer that set the whole setting is returned, if any.
+func (origins *Origins) Of(setting string) string {
+	for current := setting; current != ""; {
+		if layer, ok := origins.layers[current]; ok {
+			return layer
+		}
+
+		index := strings.LastIndex(current, ".")
+		if index < 0 {
+			break
+		}
+
+		current = current[:index]
+	}
+
+	return LayerDefaults
+}
+
+// All returns the layer that set every setting, by dotted JSON path. Settings left to their defaults are not included.
+func (origins *Origins) All() map[string]string {
+	all := make(map[string]string, len(origins.layers))
+	for setting, layer := range origins.layers {
+		all[setting] = layer
+	}
+
+	return all
+}
+
+// LoadLayers applies layers on top of the current values of obj (its defaults), in order, then calls OnIO, and
+// validates obj as per Load.
+// Settings are merged: a layer only overrides the settings it has, except for lists, which are replaced as a whole.
+// It returns the layer that set every setting.
+func LoadLayers(obj IConfiguration, layers ...Layer) (*Origins, error) {
+	origins := &Origins{layers: map[string]string{}}
+
+	generic, err := toGeneric(obj, false)
+	if err != nil {
+		return nil, errors.Join(ErrConfigLoadFail, err)
+	}
+
+	merged, ok := generic.(map[string]any)
+	if !ok {
+		return nil, errors.Join(ErrConfigLoadFail, errNotAnObject)
+	}
+
+	fields := fieldsOf(obj)
+
+	for _, layer := range layers {
+		doc, err := layer.settings(obj, fields)
+		if err != nil {
+			return nil, errors.Join(ErrConfigLoadFail, fmt.Errorf("layer %s: %w", layer.Name(), err))
+		}
+
+		merge(merged, doc, "", layer.Name(), origins.layers)
+	}
+
+	if err = strict(merged, obj); err != nil {
+		return nil, errors.Join(ErrConfigLoadFail, err)
+	}
+
+	if err = resolveSecrets(obj, merged, origins); err != nil {
+		return nil, errors.Join(ErrConfigLoadFail, err)
+	}
+
+	if err = fromGeneric(merged, obj); err != nil {
+		return nil, errors.Join(ErrConfigLoadFail, err)
+	}
+
+	obj.OnIO()
+
+	if err = validate(obj); err != nil {
+		return nil, err
+	}
+
+	return origins, nil
+}
+
+// merge copies the settings of src into dst, recording name as the origin of every setting copied.
+func merge(dst, src map[string]any, prefix, name string, origins map[string]string) {
+	for key, value := range src {
+		setting := key
+		if prefix != "" {
+			setting = prefix + "." + key
+		}
+
+		if object, ok := value.(map[string]any); ok {
+			target, ok := dst[key].(map[string]any)
+			if !ok {
+				target = map[string]any{}
+				dst[key] = target
+			}
+
+			merge(target, object, setting, name, origins)
+
+			continue
+		}
+
+		dst[key] = value
+
+		// The whole setting is replaced, children included.
+		for other := range origins {
+			if strings.HasPrefix(other, setting+".") {
+				delete(origins, other)
+			}
+		}
+
+		origins[setting] = name
+	}
+}
+
+// set stores value at path in doc, creating objects as needed.
+func set(doc map[string]any, path []string, value any) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := doc[key].(map[string]any)
+		if !ok {
+			child = map[string]any{}
+			doc[key] = child
+		}
+
+		doc = child
+	}
+
+	doc[path[len(path)-1]] = value
+}
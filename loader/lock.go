@@ -0,0 +1,114 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loader
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"go.farcloser.world/core/filesystem"
+)
+
+// Configuration files are guarded across processes by an advisory lock on a sidecar file (<file>.lock), which is never
+// removed: removing it while another process waits on it would let a third one lock a new file concurrently.
+// Locks conflict within a process as well: while Modify holds the lock, mutate goes through Locked, which does not lock
+// the file again, instead of deadlocking.
+
+func lockPath(loc string) string {
+	return loc + ".lock"
+}
+
+// lockWrite places a write lock on the configuration file of obj, creating its directory if needed. It returns nil if
+// the lock is already held (by Modify).
+func lockWrite(obj IConfiguration, held bool) (*os.File, error) {
+	if held {
+		return nil, nil
+	}
+
+	loc := lockPath(absolute(obj.GetLocation()...))
+
+	err := os.MkdirAll(path.Dir(loc), filesystem.DirPermissionsDefault)
+	if err != nil {
+		//nolint:wrapcheck
+		return nil, err
+	}
+
+	if err = touch(loc); err != nil {
+		return nil, err
+	}
+
+	//nolint:wrapcheck
+	return filesystem.Lock(loc)
+}
+
+// lockRead places a read lock on the configuration file of obj. If the file is missing (or not a regular file), or its
+// lock file does not exist and cannot be created (as for system-wide configuration files), there is nothing to lock, and
+// it returns nil, as it does if the lock is already held (by Modify).
+func lockRead(obj IConfiguration, held bool) (*os.File, error) {
+	if held {
+		return nil, nil
+	}
+
+	loc := absolute(obj.GetLocation()...)
+
+	// Reading will fail anyway.
+	if info, err := os.Stat(loc); err != nil || !info.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	loc = lockPath(loc)
+
+	err := touch(loc)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	//nolint:wrapcheck
+	return filesystem.ReadOnlyLock(loc)
+}
+
+// unlock releases lock (if not nil), joining any error to err.
+func unlock(lock *os.File, err error) error {
+	if lock == nil {
+		return err
+	}
+
+	return errors.Join(err, filesystem.Unlock(lock))
+}
+
+// touch creates the file at loc if it does not exist.
+func touch(loc string) error {
+	//nolint:gosec
+	file, err := os.OpenFile(loc, os.O_RDONLY|os.O_CREATE, filesystem.FilePermissionsDefault)
+	if err != nil {
+		// Existing files are fine, even if they cannot be opened here (the lock will tell).
+		if _, statErr := os.Stat(loc); statErr == nil {
+			return nil
+		}
+
+		//nolint:wrapcheck
+		return err
+	}
+
+	//nolint:wrapcheck
+	return file.Close()
+}
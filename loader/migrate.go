@@ -0,0 +1,143 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+// versionKey is the setting holding the version of a configuration file, managed by the loader.
+const versionKey = "version"
+
+// Migration upgrades the settings of a configuration file from the previous version, in place. Settings are a generic
+// JSON document (maps, slices and scalars, with numbers as either int64 or float64), without the version.
+type Migration func(settings map[string]any) error
+
+//nolint:gochecknoglobals
+var (
+	migrationsMu sync.RWMutex
+	migrations   = map[reflect.Type]map[int]Migration{}
+)
+
+// RegisterMigration registers migrate to upgrade configuration files of type T to version, from the previous one.
+// The version of a configuration type is the highest version registered for it (0 if none), and is saved along with
+// its settings (as "version"). Files without a version are version 0.
+// On Load, migrations for versions above the one of the file run in order, then the file is backed up (see Load), and
+// saved back at the current version. Files with a version above the current one are rejected, as are files missing a
+// migration between their version and the current one.
+// Versions start at 1: others are rejected (with ErrConfigVersion).
+func RegisterMigration[T IConfiguration](version int, migrate Migration) error {
+	if version < 1 {
+		return fmt.Errorf("%w: cannot migrate to version %d", ErrConfigVersion, version)
+	}
+
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	typ := reflect.TypeFor[T]()
+	if migrations[typ] == nil {
+		migrations[typ] = map[int]Migration{}
+	}
+
+	migrations[typ][version] = migrate
+
+	return nil
+}
+
+// currentVersion returns the version of the configuration type of obj.
+func currentVersion(obj IConfiguration) int {
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+
+	current := 0
+
+	for version := range migrations[reflect.TypeOf(obj)] {
+		current = max(current, version)
+	}
+
+	return current
+}
+
+// migrate upgrades doc to the current version of obj, and removes its version. It returns the version doc was at.
+func migrate(obj IConfiguration, doc map[string]any) (int, error) {
+	from := 0
+
+	switch version := doc[versionKey].(type) {
+	case nil:
+	case int64:
+		from = int(version)
+	case float64:
+		from = int(version)
+		if float64(from) != version {
+			return 0, fmt.Errorf("%w: %v", ErrConfigVersion, version)
+		}
+	default:
+		return 0, fmt.Errorf("%w: %v", ErrConfigVersion, version)
+	}
+
+	if from < 0 {
+		return 0, fmt.Errorf("%w: %d", ErrConfigVersion, from)
+	}
+
+	delete(doc, versionKey)
+
+	migrationsMu.RLock()
+	registered := migrations[reflect.TypeOf(obj)]
+	migrationsMu.RUnlock()
+
+	versions := []int{}
+
+	current := 0
+
+	for version := range registered {
+		current = max(current, version)
+
+		if version > from {
+			versions = append(versions, version)
+		}
+	}
+
+	if from > current {
+		return from, fmt.Errorf("%w: version %d is newer than %d", ErrConfigVersion, from, current)
+	}
+
+	slices.Sort(versions)
+
+	// Every step must be there, or the settings would be skipped over some changes.
+	for index, version := range versions {
+		if version != from+index+1 {
+			return from, errors.Join(ErrConfigMigrateFail, fmt.Errorf("no migration to version %d", from+index+1))
+		}
+	}
+
+	for _, version := range versions {
+		if err := registered[version](doc); err != nil {
+			return from, errors.Join(ErrConfigMigrateFail, fmt.Errorf("to version %d: %w", version, err))
+		}
+	}
+
+	return from, nil
+}
+
+// backupPath returns where a configuration file at loc is backed up before being upgraded from version from.
+func backupPath(loc string, from int) string {
+	return fmt.Sprintf("%s.v%d.bak", loc, from)
+}
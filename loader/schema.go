@@ -0,0 +1,157 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loader
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// field is a setting of a configuration object, as found by walking its type.
+type field struct {
+	// path is the JSON name of the field, and of every struct containing it.
+	path []string
+	typ  reflect.Type
+}
+
+// name returns the dotted JSON path of the field (e.g. "client.rootCa").
+func (fld *field) name() string {
+	return strings.Join(fld.path, ".")
+}
+
+// key returns the name of the field in upper snake case (e.g. "CLIENT_ROOT_CA"), as used for environment variables
+// and, once normalized, flags.
+func (fld *field) key() string {
+	words := make([]string, len(fld.path))
+	for index, name := range fld.path {
+		words[index] = snake(name)
+	}
+
+	return strings.Join(words, "_")
+}
+
+// fieldsOf returns every setting of obj: the fields of structs are walked recursively, down to fields of any other
+// type (or with their own JSON decoding).
+func fieldsOf(obj any) []*field {
+	return walkFields(reflect.TypeOf(obj), nil, map[reflect.Type]bool{})
+}
+
+func walkFields(typ reflect.Type, path []string, seen map[reflect.Type]bool) []*field {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct || decodesItself(typ) {
+		return []*field{{path: path, typ: typ}}
+	}
+
+	// Recursive types stop here.
+	if seen[typ] {
+		return nil
+	}
+
+	seen[typ] = true
+	defer delete(seen, typ)
+
+	fields := []*field{}
+
+	for _, child := range jsonFields(typ) {
+		fields = append(fields, walkFields(child.typ, append(append([]string{}, path...), child.name), seen)...)
+	}
+
+	return fields
+}
+
+// jsonField is a field of a struct, as seen by encoding/json.
+type jsonField struct {
+	name string
+	typ  reflect.Type
+}
+
+// jsonFields returns the fields of the struct typ, by JSON name. Embedded structs without a name are flattened, as
+// encoding/json does.
+func jsonFields(typ reflect.Type) []*jsonField {
+	fields := []*jsonField{}
+
+	for index := range typ.NumField() {
+		structField := typ.Field(index)
+
+		name, _, _ := strings.Cut(structField.Tag.Get("json"), ",")
+		if name == "-" || (!structField.IsExported() && !structField.Anonymous) {
+			continue
+		}
+
+		if structField.Anonymous && name == "" {
+			embedded := structField.Type
+			for embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+
+			if embedded.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(embedded)...)
+
+				continue
+			}
+		}
+
+		if !structField.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = structField.Name
+		}
+
+		fields = append(fields, &jsonField{name: name, typ: structField.Type})
+	}
+
+	return fields
+}
+
+// decodesItself tells whether typ has its own JSON (or text) decoding, in which case it is a setting of its own.
+func decodesItself(typ reflect.Type) bool {
+	pointer := reflect.PointerTo(typ)
+
+	return pointer.Implements(reflect.TypeFor[json.Unmarshaler]()) ||
+		pointer.Implements(reflect.TypeFor[encoding.TextUnmarshaler]())
+}
+
+// snake turns a camel case name into upper snake case (e.g. "tlsHandshakeTimeout" into "TLS_HANDSHAKE_TIMEOUT").
+func snake(name string) string {
+	builder := strings.Builder{}
+
+	var previous rune
+
+	for index, char := range name {
+		if index > 0 && unicode.IsUpper(char) && (unicode.IsLower(previous) || unicode.IsDigit(previous)) {
+			builder.WriteRune('_')
+		}
+
+		if char == '-' || char == '.' {
+			char = '_'
+		}
+
+		builder.WriteRune(unicode.ToUpper(char))
+
+		previous = char
+	}
+
+	return builder.String()
+}
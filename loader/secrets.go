@@ -0,0 +1,362 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings may reference secrets instead of holding them, as "<scheme>:<reference>" (e.g. "env:SENTRY_DSN"), for any
+// scheme with a registered Resolver. References are resolved when loading, and put back in place of the secrets when
+// saving, so that secrets never end up in configuration files.
+// References set by the project file or the environment (see LayerProject and LayerEnv) are never resolved: whoever
+// controls the current directory or the environment should not get to read files or run commands.
+
+const (
+	// secretMask replaces secrets in Dump.
+	secretMask = "******"
+	// execTimeout is how long the command of an exec: reference may run.
+	execTimeout = 30 * time.Second
+)
+
+// Resolver returns the secret a reference points to (the part after the scheme, e.g. "SENTRY_DSN" for
+// "env:SENTRY_DSN").
+type Resolver func(reference string) (string, error)
+
+//nolint:gochecknoglobals
+var (
+	resolversMu sync.RWMutex
+	resolvers   = map[string]Resolver{
+		"env": resolveEnv,
+	}
+)
+
+// RegisterResolver registers resolver for references with the given scheme (without the colon). The only built-in
+// scheme is env, the value of an environment variable (e.g. "env:SENTRY_DSN"). Others are opt-in, e.g.:
+//
+//	loader.RegisterResolver("file", loader.FileResolver)
+//	loader.RegisterResolver("exec", loader.ExecResolver)
+//
+// Built-in schemes can be overridden, or disabled with a nil resolver.
+func RegisterResolver(scheme string, resolver Resolver) {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+
+	if resolver == nil {
+		delete(resolvers, scheme)
+
+		return
+	}
+
+	resolvers[scheme] = resolver
+}
+
+// Secrets keeps track of the secrets of a configuration. Embed it in configuration objects (as config.Core does) for
+// their settings to be resolved by the loader: references in objects without Secrets are kept as is.
+// Resolved settings hold the secrets themselves: only Dump and Save mask them, so configuration objects must not be
+// logged or marshalled otherwise (e.g. with json.Marshal, or fmt's %+v).
+type Secrets struct {
+	mu      sync.Mutex
+	secrets []*secret
+}
+
+// secret is a setting resolved from a reference.
+type secret struct {
+	// path of the setting in the generic document, as map keys (string) and list indexes (int).
+	path      []any
+	reference string
+	value     string
+}
+
+func (sec *Secrets) loaderSecrets() *Secrets {
+	return sec
+}
+
+// secretHolder is implemented by configurations embedding Secrets.
+type secretHolder interface {
+	loaderSecrets() *Secrets
+}
+
+// resolveSecrets resolves the references in doc in place, and adds them to the Secrets of obj. It does nothing if obj
+// has no Secrets. If origins is not nil, references set by untrusted layers are left as is.
+func resolveSecrets(obj IConfiguration, doc any, origins *Origins) error {
+	holder, ok := obj.(secretHolder)
+	if !ok {
+		return nil
+	}
+
+	secrets := []*secret{}
+
+	err := walkStrings(doc, nil, func(path []any, value string) (string, error) {
+		scheme, reference, ok := strings.Cut(value, ":")
+		if !ok || (origins != nil && untrusted(origins.Of(settingOf(path)))) {
+			return value, nil
+		}
+
+		resolversMu.RLock()
+		resolver := resolvers[scheme]
+		resolversMu.RUnlock()
+
+		if resolver == nil {
+			return value, nil
+		}
+
+		resolved, err := resolver(reference)
+		if err != nil {
+			return "", errors.Join(ErrSecretResolveFail, &FieldError{Path: pathString(path), Err: err})
+		}
+
+		secrets = append(secrets, &secret{path: path, reference: value, value: resolved})
+
+		return resolved, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sec := holder.loaderSecrets()
+	sec.mu.Lock()
+	sec.secrets = mergeSecrets(sec.secrets, secrets)
+	sec.mu.Unlock()
+
+	return nil
+}
+
+// mergeSecrets returns the secrets of previous, along with those of resolved, which take precedence for the same
+// settings. Secrets resolved by an earlier load (e.g. by Load, before ApplyEnv) have to be kept: their settings still
+// hold the secret values, which must not be saved.
+func mergeSecrets(previous, resolved []*secret) []*secret {
+	byPath := map[string]bool{}
+	for _, scr := range resolved {
+		byPath[pathString(scr.path)] = true
+	}
+
+	merged := []*secret{}
+
+	for _, scr := range previous {
+		if !byPath[pathString(scr.path)] {
+			merged = append(merged, scr)
+		}
+	}
+
+	return append(merged, resolved...)
+}
+
+// restoreSecrets replaces in doc every secret of obj by its reference, or by mask if not empty. Settings that have been
+// changed since they were resolved are left as is, unless masked.
+func restoreSecrets(obj IConfiguration, doc any, mask string) {
+	holder, ok := obj.(secretHolder)
+	if !ok {
+		return
+	}
+
+	sec := holder.loaderSecrets()
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+
+	byPath := map[string]*secret{}
+	for _, scr := range sec.secrets {
+		byPath[pathString(scr.path)] = scr
+	}
+
+	_ = walkStrings(doc, nil, func(path []any, value string) (string, error) {
+		scr, ok := byPath[pathString(path)]
+
+		switch {
+		case !ok:
+			return value, nil
+		case mask != "":
+			return mask, nil
+		case value == scr.value:
+			return scr.reference, nil
+		default:
+			return value, nil
+		}
+	})
+}
+
+// hasSecrets tells whether obj has resolved secrets.
+func hasSecrets(obj IConfiguration) bool {
+	holder, ok := obj.(secretHolder)
+	if !ok {
+		return false
+	}
+
+	sec := holder.loaderSecrets()
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+
+	return len(sec.secrets) > 0
+}
+
+// Dump returns obj as indented JSON, for logs and support, with its secrets masked. It is the only safe way to print a
+// configuration holding secrets (see Secrets).
+func Dump(obj IConfiguration) ([]byte, error) {
+	generic, err := toGeneric(obj, false)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreSecrets(obj, generic, secretMask)
+
+	return JSONCodec{}.Marshal(generic)
+}
+
+// walkStrings calls replace for every string in doc, replacing it in place with its result.
+func walkStrings(doc any, path []any, replace func(path []any, value string) (string, error)) error {
+	switch typed := doc.(type) {
+	case map[string]any:
+		for key, value := range typed {
+			child := append(append([]any{}, path...), key)
+
+			if str, ok := value.(string); ok {
+				replaced, err := replace(child, str)
+				if err != nil {
+					return err
+				}
+
+				typed[key] = replaced
+
+				continue
+			}
+
+			if err := walkStrings(value, child, replace); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for index, value := range typed {
+			child := append(append([]any{}, path...), index)
+
+			if str, ok := value.(string); ok {
+				replaced, err := replace(child, str)
+				if err != nil {
+					return err
+				}
+
+				typed[index] = replaced
+
+				continue
+			}
+
+			if err := walkStrings(value, child, replace); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// pathString formats path as per FieldError (e.g. "client.rootCa[0]").
+func pathString(path []any) string {
+	builder := strings.Builder{}
+
+	for _, item := range path {
+		switch typed := item.(type) {
+		case int:
+			builder.WriteString("[" + strconv.Itoa(typed) + "]")
+		case string:
+			if builder.Len() > 0 {
+				builder.WriteString(".")
+			}
+
+			builder.WriteString(typed)
+		}
+	}
+
+	return builder.String()
+}
+
+// settingOf returns the dotted JSON path of the setting at path, as per Origins (e.g. "client.rootCa").
+func settingOf(path []any) string {
+	keys := []string{}
+
+	for _, item := range path {
+		if key, ok := item.(string); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return strings.Join(keys, ".")
+}
+
+// untrusted tells whether references set by layer must be left as is.
+func untrusted(layer string) bool {
+	return layer == LayerProject || layer == LayerEnv
+}
+
+func resolveEnv(reference string) (string, error) {
+	value, ok := os.LookupEnv(reference)
+	if !ok {
+		return "", fmt.Errorf("%w: environment variable %s", ErrSecretNotFound, reference)
+	}
+
+	return value, nil
+}
+
+// FileResolver resolves references to the content of a file, without its trailing newline (e.g.
+// "file:/run/secrets/dsn").
+func FileResolver(reference string) (string, error) {
+	//nolint:gosec
+	data, err := os.ReadFile(reference)
+	if err != nil {
+		//nolint:wrapcheck
+		return "", err
+	}
+
+	return trimNewline(string(data)), nil
+}
+
+// ExecResolver resolves references to the output of a command, without its trailing newline (e.g. "exec:pass show
+// foo"). The command is split on spaces, without any shell involved.
+func ExecResolver(reference string) (string, error) {
+	args := strings.Fields(reference)
+	if len(args) == 0 {
+		return "", fmt.Errorf("%w: empty command", ErrSecretNotFound)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	stderr := &bytes.Buffer{}
+
+	command := exec.CommandContext(ctx, args[0], args[1:]...) //nolint:gosec
+	command.Stderr = stderr
+
+	output, err := command.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return trimNewline(string(output)), nil
+}
+
+func trimNewline(value string) string {
+	value = strings.TrimSuffix(value, "\n")
+
+	return strings.TrimSuffix(value, "\r")
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package setting
+
+import "errors"
+
+// Error is an error about a specific setting.
+type Error struct {
+	// Path is the dotted JSON path of the setting (e.g. "client.tlsMin"), with list items as "rootCa[0]".
+	Path string
+	Err  error
+}
+
+func (fe *Error) Error() string {
+	return fe.Path + ": " + fe.Err.Error()
+}
+
+func (fe *Error) Unwrap() error {
+	return fe.Err
+}
+
+// WithPath puts errors about a section of a configuration in context, prefixing the path of Errors with the JSON
+// name of the section (e.g. "client"). Joined errors are prefixed one by one, and other errors become Errors
+// about the section itself.
+func WithPath(section string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if fieldError, ok := err.(*Error); ok { //nolint:errorlint
+		return &Error{Path: Join(section, fieldError.Path), Err: fieldError.Err}
+	}
+
+	if joined, ok := err.(interface{ Unwrap() []error }); ok { //nolint:errorlint
+		errs := []error{}
+		for _, inner := range joined.Unwrap() {
+			errs = append(errs, WithPath(section, inner))
+		}
+
+		return errors.Join(errs...)
+	}
+
+	return &Error{Path: section, Err: err}
+}
+
+// Join returns the path of the setting key in the section at path (e.g. "client.tlsMin").
+func Join(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loader
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.farcloser.world/core/loader/setting"
+)
+
+// IValidator may be implemented by configurations to check their settings. Validate is called by Load (and
+// LoadLayers) after OnIO, and its error returned along with ErrConfigInvalid.
+type IValidator interface {
+	// Validate returns an error if the configuration is invalid, preferably FieldErrors (see WithPath), joined.
+	Validate() error
+}
+
+// FieldError is an error about a specific setting (see setting.Error, for configuration types that do not otherwise
+// depend on the loader).
+type FieldError = setting.Error
+
+// WithPath puts errors about a section of a configuration in context, as per setting.WithPath.
+func WithPath(section string, err error) error {
+	return setting.WithPath(section, err)
+}
+
+func validate(obj IConfiguration) error {
+	validator, ok := obj.(IValidator)
+	if !ok {
+		return nil
+	}
+
+	if err := validator.Validate(); err != nil {
+		return errors.Join(ErrConfigInvalid, err)
+	}
+
+	return nil
+}
+
+// unknownFields returns a FieldError for every key of the generic document doc that does not match a field of typ,
+// and would be silently ignored by encoding/json. Keys are matched case-insensitively, as encoding/json does.
+func unknownFields(doc any, typ reflect.Type, path string) []error {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	if decodesItself(typ) {
+		return nil
+	}
+
+	errs := []error{}
+
+	//nolint:exhaustive
+	switch typ.Kind() {
+	case reflect.Struct:
+		object, ok := doc.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		fields := map[string]reflect.Type{}
+		for _, fld := range jsonFields(typ) {
+			fields[strings.ToLower(fld.name)] = fld.typ
+		}
+
+		for key, value := range object {
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				errs = append(errs, &FieldError{Path: setting.Join(path, key), Err: ErrUnknownField})
+
+				continue
+			}
+
+			errs = append(errs, unknownFields(value, fieldType, setting.Join(path, key))...)
+		}
+	case reflect.Map:
+		object, ok := doc.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		for key, value := range object {
+			errs = append(errs, unknownFields(value, typ.Elem(), setting.Join(path, key))...)
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := doc.([]any)
+		if !ok {
+			return nil
+		}
+
+		for index, value := range list {
+			errs = append(errs, unknownFields(value, typ.Elem(), path+"["+strconv.Itoa(index)+"]")...)
+		}
+	}
+
+	return errs
+}
+
+// strict fails if the generic document doc has settings that obj does not have.
+func strict(doc any, obj IConfiguration) error {
+	return errors.Join(unknownFields(doc, reflect.TypeOf(obj), "")...)
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loader
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"go.farcloser.world/core/filesystem"
+)
+
+// watchSettle is how long Watch waits for a burst of changes to a file to be over before reloading it.
+const watchSettle = 100 * time.Millisecond
+
+// Watch reloads the configuration every time its file changes, until ctx is done.
+// Every reload starts from a new object returned by obj (typically the constructor also used for the initial Load), so
+// that objects handed out before are never modified, and settings removed from the file fall back to their defaults.
+// The new object is loaded as per Load (OnIO included), then passed to onChange. If it fails (the file is invalid, or
+// has been removed), onChange gets the error instead, along with the last good object, which remains current.
+// The initial object is loaded the same way, and passed to onChange before Watch returns. If it cannot be loaded,
+// Watch fails with the error of Load, and nothing is watched.
+// The directory containing the file must exist.
+func Watch[T IConfiguration](
+	ctx context.Context,
+	obj func() T,
+	onChange func(current T, err error),
+) error {
+	current := obj()
+	if err := Load(current); err != nil {
+		return err
+	}
+
+	loc := filepath.Clean(absolute(current.GetLocation()...))
+
+	events, err := filesystem.Watch(ctx, filepath.Dir(loc), &filesystem.WatchOptions{
+		// Only the directory of the file matters.
+		SkipDir: func(string) bool { return true },
+	})
+	if err != nil {
+		return errors.Join(ErrConfigWatchFail, err)
+	}
+
+	onChange(current, nil)
+
+	go func() {
+		for {
+			if !nextChange(ctx, events, loc) {
+				return
+			}
+
+			next := obj()
+			if err := Load(next); err != nil {
+				onChange(current, err)
+
+				continue
+			}
+
+			current = next
+			onChange(current, nil)
+		}
+	}()
+
+	return nil
+}
+
+// nextChange waits for loc to change, then for the changes to settle. It returns false once events is closed.
+func nextChange(ctx context.Context, events <-chan *filesystem.WatchEvent, loc string) bool {
+	for event := range events {
+		if event.Path != loc {
+			continue
+		}
+
+		timer := time.NewTimer(watchSettle)
+
+		for settled := false; !settled; {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					timer.Stop()
+
+					return false
+				}
+			case <-timer.C:
+				settled = true
+			case <-ctx.Done():
+				timer.Stop()
+
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
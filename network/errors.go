@@ -23,4 +23,10 @@ var (
 	ErrRoundTrip = errors.New("round trip error")
 	// ErrInterfacesRetrievalFailed is returned when retrieving network interfaces fails.
 	ErrInterfacesRetrievalFailed = errors.New("retrieving interfaces failed")
+	// ErrUnsupportedTLSVersion is returned by Config.Validate when the minimum TLS version is not supported.
+	ErrUnsupportedTLSVersion = errors.New("unsupported TLS version")
+	// ErrNegativeDuration is returned by Config.Validate when a timeout is negative.
+	ErrNegativeDuration = errors.New("duration must not be negative")
+	// ErrNotAFile is returned by Config.Validate when a certificate, key or CA path is not a file.
+	ErrNotAFile = errors.New("not a file")
 )
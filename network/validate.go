@@ -0,0 +1,124 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.farcloser.world/core/loader/setting"
+)
+
+const pemPrefix = "-----BEGIN"
+
+// Validate checks the settings of the configuration, returning a setting.Error for every invalid one:
+//   - the minimum TLS version, if set, must be TLS 1.2 or 1.3 (older versions are not supported)
+//   - the certificate and key, if set, must be readable files
+//   - so must the CAs, unless they hold PEM content rather than a path
+//   - timeouts must not be negative.
+func (config *Config) Validate() error {
+	errs := []error{}
+
+	if config.TLSMin != 0 && config.TLSMin != tls.VersionTLS12 && config.TLSMin != tls.VersionTLS13 {
+		errs = append(errs, &setting.Error{
+			Path: "tlsMin",
+			Err:  fmt.Errorf("%w: %s", ErrUnsupportedTLSVersion, tls.VersionName(config.TLSMin)),
+		})
+	}
+
+	if err := config.readable(config.CertPath); err != nil {
+		errs = append(errs, &setting.Error{Path: "certPath", Err: err})
+	}
+
+	if err := config.readable(config.KeyPath); err != nil {
+		errs = append(errs, &setting.Error{Path: "keyPath", Err: err})
+	}
+
+	for index, ca := range config.RootCAs {
+		if err := config.readableCA(ca); err != nil {
+			errs = append(errs, &setting.Error{Path: fmt.Sprintf("rootCa[%d]", index), Err: err})
+		}
+	}
+
+	if err := config.readableCA(config.ClientCA); err != nil {
+		errs = append(errs, &setting.Error{Path: "clientCa", Err: err})
+	}
+
+	if err := positive(config.TLSHandshakeTimeout); err != nil {
+		errs = append(errs, &setting.Error{Path: "tlsHandshakeTimeout", Err: err})
+	}
+
+	if err := positive(config.DialerTimeout); err != nil {
+		errs = append(errs, &setting.Error{Path: "dialerTimeout", Err: err})
+	}
+
+	// Note that a negative keep-alive is valid, and disables keep-alives.
+
+	return errors.Join(errs...)
+}
+
+func positive(duration time.Duration) error {
+	if duration < 0 {
+		return fmt.Errorf("%w: %s", ErrNegativeDuration, duration)
+	}
+
+	return nil
+}
+
+// readableCA checks a CA as per readable, unless it is PEM content.
+func (config *Config) readableCA(ca string) error {
+	if strings.HasPrefix(strings.TrimSpace(ca), pemPrefix) {
+		return nil
+	}
+
+	return config.readable(ca)
+}
+
+func (config *Config) readable(loc string) error {
+	if loc == "" {
+		return nil
+	}
+
+	if config.Resolve != nil {
+		loc = config.Resolve(loc)
+	}
+
+	//nolint:gosec
+	file, err := os.Open(loc)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%w: %s", ErrNotAFile, loc)
+	}
+
+	return nil
+}
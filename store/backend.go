@@ -0,0 +1,238 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"go.farcloser.world/core/filesystem"
+)
+
+// A Store keeps everything in its backend as opaque values under string keys:
+//
+//   - entries, under their key (a hex digest)
+//   - blobs, under ".blobs/" followed by their digest
+//   - values staged by transactions, under ".tmp/" followed by a random name
+//   - the transaction journal, under ".journal"
+//   - the disk usage of entries and blobs, under ".usage"
+//
+// Backends only have to support Backend. Optional interfaces let them do better than the generic fallbacks: streaming
+// values instead of holding them in memory, moving values without copying them, tracking their use for eviction, and
+// reporting changes as they happen instead of being polled.
+
+// Backend is where a Store keeps its data.
+// The store holds the lock provided by the backend for every other call, so backends do not have to guard against
+// concurrent changes across processes themselves.
+type Backend interface {
+	// Read returns the value stored under key, or an error matching os.ErrNotExist.
+	Read(key string) ([]byte, error)
+	// Write stores value under key, replacing any previous value atomically: readers see either the previous value or
+	// the new one, even if the process crashes mid-write.
+	Write(key string, value []byte) error
+	// Has tells whether a value is stored under key.
+	Has(key string) (bool, error)
+	// Delete removes the value stored under key, or fails with an error matching os.ErrNotExist.
+	Delete(key string) error
+	// Keys calls function for every key starting with prefix, in no particular order, stopping at the first error.
+	Keys(prefix string, function func(key string) error) error
+	// Lock locks the backend, for writing if exclusive is set, and returns the function releasing the lock.
+	// It gives up once ctx is done, with an error matching filesystem.ErrLockTimeout. If ctx is done already, it only
+	// succeeds if the lock is available right away.
+	Lock(ctx context.Context, exclusive bool) (unlock func() error, err error)
+}
+
+// Streamer is implemented by backends able to stream values, instead of holding them in memory.
+type Streamer interface {
+	// Open opens the value stored under key for reading.
+	Open(key string) (io.ReadCloser, error)
+	// Create starts writing a new value, that is not visible until committed.
+	Create() (PendingValue, error)
+}
+
+// PendingValue is a value being written to a Streamer.
+type PendingValue interface {
+	io.Writer
+	// Commit stores the value under key, as Backend.Write would. The value is discarded if that fails.
+	Commit(key string) error
+	// Discard drops the value.
+	Discard() error
+}
+
+// Mover is implemented by backends able to move values without copying them.
+type Mover interface {
+	// Move atomically moves the value stored under from to key to, replacing any value stored there.
+	Move(from, to string) error
+}
+
+// Stater is implemented by backends able to describe values without reading them, and to track their use.
+// Without it, sizes are measured by reading values, and eviction does not know which entries were used last.
+type Stater interface {
+	// Stat describes the value stored under key.
+	Stat(key string) (*ValueInfo, error)
+	// Touch records that the value stored under key has just been used.
+	Touch(key string) error
+}
+
+// ValueInfo describes a value stored in a backend.
+type ValueInfo struct {
+	// Size of the value, in bytes.
+	Size int64
+	// Modified is when the value was last written.
+	Modified time.Time
+	// Accessed is when the value was last used (see Stater.Touch).
+	Accessed time.Time
+}
+
+// Watcher is implemented by backends able to report changes as they happen. Others are polled by Store.Watch.
+type Watcher interface {
+	// Watch reports changes to values until ctx is done, at which point the returned channel is closed.
+	// Values that are not entries may or may not be reported.
+	Watch(ctx context.Context) (<-chan *Change, error)
+}
+
+// Change describes a change to a value stored in a backend.
+type Change struct {
+	Key     string
+	Deleted bool
+}
+
+// openValue opens the value stored under key in backend for reading.
+func openValue(backend Backend, key string) (io.ReadCloser, error) {
+	if streamer, ok := backend.(Streamer); ok {
+		return streamer.Open(key)
+	}
+
+	data, err := backend.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// createValue starts writing a new value to backend.
+func createValue(backend Backend) (PendingValue, error) {
+	if streamer, ok := backend.(Streamer); ok {
+		return streamer.Create()
+	}
+
+	return &bufferedValue{backend: backend}, nil
+}
+
+// moveValue moves the value stored under from to key to.
+// Without Mover, the value is copied then deleted, which is not atomic: callers must be able to replay the move.
+func moveValue(backend Backend, from, to string) error {
+	if mover, ok := backend.(Mover); ok {
+		return mover.Move(from, to)
+	}
+
+	data, err := backend.Read(from)
+	if err != nil {
+		return err
+	}
+
+	if err = backend.Write(to, data); err != nil {
+		return err
+	}
+
+	return backend.Delete(from)
+}
+
+// statValue describes the value stored under key. Without Stater, only the size is known.
+func statValue(backend Backend, key string) (*ValueInfo, error) {
+	if stater, ok := backend.(Stater); ok {
+		return stater.Stat(key)
+	}
+
+	data, err := backend.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ValueInfo{Size: int64(len(data))}, nil
+}
+
+// lockPath places an advisory lock on path, as per Backend.Lock.
+func lockPath(ctx context.Context, path string, exclusive bool) (func() error, error) {
+	var (
+		lock *os.File
+		err  error
+	)
+
+	switch {
+	case ctx.Err() != nil && exclusive:
+		lock, err = filesystem.TryLock(path)
+	case ctx.Err() != nil:
+		lock, err = filesystem.TryReadOnlyLock(path)
+	case exclusive:
+		lock, err = filesystem.LockContext(ctx, path)
+	default:
+		lock, err = filesystem.ReadOnlyLockContext(ctx, path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return filesystem.Unlock(lock)
+	}, nil
+}
+
+// bufferedValue is a PendingValue held in memory, for backends that are not a Streamer.
+type bufferedValue struct {
+	bytes.Buffer
+
+	backend Backend
+}
+
+func (value *bufferedValue) Commit(key string) error {
+	return value.backend.Write(key, value.Bytes())
+}
+
+func (value *bufferedValue) Discard() error {
+	value.Reset()
+
+	return nil
+}
+
+// isEntryKey tells whether a backend key is an entry key, as opposed to a blob, a staged value or the journal.
+func isEntryKey(key string) bool {
+	return key != "" && key[0] != '.'
+}
+
+func blobKey(digest string) string {
+	return blobsDirName + "/" + digest
+}
+
+func stagedKey(name string) string {
+	return tempDirName + "/" + name
+}
+
+// ignoreNotExist drops errors matching os.ErrNotExist.
+func ignoreNotExist(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
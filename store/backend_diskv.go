@@ -0,0 +1,622 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/diskv/v3"
+
+	"go.farcloser.world/core/filesystem"
+)
+
+const transformBlockSize = 64 // grouping of chars per directory depth
+
+func transform(key string) []string {
+	var (
+		sliceSize = len(key) / transformBlockSize
+		pathSlice = make([]string, sliceSize)
+	)
+
+	for i := range sliceSize {
+		from, to := i*transformBlockSize, (i+1)*transformBlockSize
+		pathSlice[i] = key[from:to]
+	}
+
+	return pathSlice
+}
+
+// inverseTransform only recognizes files laid out by transform, so that anything else living under the base path
+// (staging directory, etc) is never mistaken for a key.
+func inverseTransform(pathKey *diskv.PathKey) string {
+	if len(pathKey.Path) != 1 || pathKey.Path[0] != pathKey.FileName {
+		return ""
+	}
+
+	return pathKey.FileName
+}
+
+// DiskvBackend keeps every value in its own file, under a directory.
+// Entries are stored as <path>/<key>/<key>, blobs in the same layout under <path>/.blobs, and staged values under
+// <path>/.tmp, which is also where values are written before being renamed into place - so that the final rename never
+// crosses a filesystem boundary.
+// Locking is done with an advisory lock on the directory, which makes the backend safe to share between processes.
+type DiskvBackend struct {
+	entries *diskv.Diskv
+	blobs   *diskv.Diskv
+}
+
+// NewDiskvBackend returns a backend storing values under path, caching up to cacheSize bytes of them in memory.
+func NewDiskvBackend(path string, cacheSize uint64) *DiskvBackend {
+	return &DiskvBackend{
+		entries: diskv.New(diskv.Options{
+			BasePath:         path,
+			Transform:        transform,
+			InverseTransform: inverseTransform,
+			CacheSizeMax:     cacheSize,
+			PathPerm:         filesystem.DirPermissionsPrivate,
+			FilePerm:         filesystem.FilePermissionsPrivate,
+			TempDir:          filepath.Join(path, tempDirName),
+		}),
+		// Blobs use the same layout, in a directory that is skipped when walking entries.
+		blobs: diskv.New(diskv.Options{
+			BasePath:         filepath.Join(path, blobsDirName),
+			Transform:        transform,
+			InverseTransform: inverseTransform,
+			CacheSizeMax:     cacheSize,
+			PathPerm:         filesystem.DirPermissionsPrivate,
+			FilePerm:         filesystem.FilePermissionsPrivate,
+			TempDir:          filepath.Join(path, tempDirName),
+		}),
+	}
+}
+
+// Read returns the value stored under key.
+func (backend *DiskvBackend) Read(key string) ([]byte, error) {
+	dv, dvKey, path, err := backend.locate(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if dv != nil {
+		return dv.Read(dvKey)
+	}
+
+	//nolint:gosec
+	return os.ReadFile(path)
+}
+
+// Write stores value under key, by writing and syncing it to a temporary file, then renaming it into place.
+func (backend *DiskvBackend) Write(key string, value []byte) error {
+	pending, err := backend.Create()
+	if err != nil {
+		return err
+	}
+
+	if _, err = pending.Write(value); err != nil {
+		return errors.Join(err, pending.Discard())
+	}
+
+	return pending.Commit(key)
+}
+
+// Has tells whether a value is stored under key.
+func (backend *DiskvBackend) Has(key string) (bool, error) {
+	_, err := backend.Stat(key)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Delete removes the value stored under key.
+func (backend *DiskvBackend) Delete(key string) error {
+	dv, dvKey, path, err := backend.locate(key)
+	if err != nil {
+		return err
+	}
+
+	if dv != nil {
+		return dv.Erase(dvKey)
+	}
+
+	return os.Remove(path)
+}
+
+// Keys calls function for every key starting with prefix.
+func (backend *DiskvBackend) Keys(prefix string, function func(key string) error) error {
+	filter := func(key string) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		return function(key)
+	}
+
+	// Only walk what prefix may match.
+	matches := func(namespace string) bool {
+		return strings.HasPrefix(namespace, prefix) || strings.HasPrefix(prefix, namespace)
+	}
+
+	if !strings.HasPrefix(prefix, ".") {
+		if err := walkKeys(backend.entries, filter); err != nil {
+			return err
+		}
+	}
+
+	if matches(blobsDirName + "/") {
+		if err := walkKeys(backend.blobs, func(digest string) error {
+			return filter(blobKey(digest))
+		}); err != nil {
+			return err
+		}
+	}
+
+	if matches(tempDirName + "/") {
+		staged, err := os.ReadDir(backend.entries.TempDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		for _, file := range staged {
+			if err = filter(stagedKey(file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range []string{journalFileName, usageFileName} {
+		if !matches(name) {
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(backend.entries.BasePath, name)); err == nil {
+			if err = filter(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Lock places an advisory lock on the directory.
+func (backend *DiskvBackend) Lock(ctx context.Context, exclusive bool) (func() error, error) {
+	base := backend.entries.BasePath
+
+	if err := os.MkdirAll(base, filesystem.DirPermissionsPrivate); err != nil {
+		return nil, err
+	}
+
+	return lockPath(ctx, base, exclusive)
+}
+
+// Open opens the value stored under key for reading. On Linux, this does not update its access time: uses are only
+// recorded by Touch.
+func (backend *DiskvBackend) Open(key string) (io.ReadCloser, error) {
+	_, _, path, err := backend.locate(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return openValueFile(path)
+}
+
+// Create starts writing a new value to a temporary file.
+func (backend *DiskvBackend) Create() (PendingValue, error) {
+	err := os.MkdirAll(backend.entries.TempDir, filesystem.DirPermissionsPrivate)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(backend.entries.TempDir, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskvPendingValue{backend: backend, file: file}, nil
+}
+
+// Move renames the value stored under from to key to.
+func (backend *DiskvBackend) Move(from, to string) error {
+	dv, dvKey, path, err := backend.locate(from)
+	if err != nil {
+		return err
+	}
+
+	if err = backend.importFile(path, to); err != nil || dv == nil {
+		return err
+	}
+
+	// diskv leaves the source cached, and its directory behind. Erasing the (now missing) key busts the cache.
+	if err = ignoreNotExist(dv.Erase(dvKey)); err != nil {
+		return err
+	}
+
+	// The directory may not be empty, if another value has been moved there since.
+	_ = os.Remove(filepath.Dir(path))
+
+	return nil
+}
+
+// Stat describes the value stored under key. Its access time is the one of its file.
+func (backend *DiskvBackend) Stat(key string) (*ValueInfo, error) {
+	_, _, path, err := backend.locate(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ValueInfo{
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+		Accessed: accessTime(info),
+	}, nil
+}
+
+// Touch sets the access time of the file holding the value stored under key.
+// This is done explicitly, as filesystems are commonly mounted with noatime or relatime. It costs a single syscall, and
+// is naturally shared by every process using the directory.
+func (backend *DiskvBackend) Touch(key string) error {
+	_, _, path, err := backend.locate(key)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, time.Now(), time.Time{})
+}
+
+// Watch reports changes to entries through filesystem.Watch.
+func (backend *DiskvBackend) Watch(ctx context.Context) (<-chan *Change, error) {
+	base := backend.entries.BasePath
+
+	if err := os.MkdirAll(base, filesystem.DirPermissionsPrivate); err != nil {
+		return nil, err
+	}
+
+	events, err := filesystem.Watch(ctx, base, &filesystem.WatchOptions{SkipDir: isInternal})
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan *Change)
+
+	go func() {
+		defer close(changes)
+
+		for event := range events {
+			key := keyFromPath(base, event.Path)
+			if key == "" {
+				continue
+			}
+
+			select {
+			case changes <- &Change{Key: key, Deleted: event.Op == filesystem.WatchRemove}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changes, nil
+}
+
+// Verify checks that everything under the directory follows the layout: <key>/<key> files for entries and blobs, and
+// files in the staging directory. Anything else is stray, including empty directories left behind by interrupted
+// removals.
+func (backend *DiskvBackend) Verify(repair bool) ([]*Problem, error) {
+	base := backend.entries.BasePath
+	problems := []*Problem{}
+
+	stray := func(path string) error {
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+
+		problem := &Problem{Kind: ProblemStray, Key: filepath.ToSlash(rel)}
+		problems = append(problems, problem)
+
+		if repair {
+			if err = os.RemoveAll(path); err != nil {
+				return err
+			}
+
+			problem.Repaired = true
+		}
+
+		return nil
+	}
+
+	children, err := os.ReadDir(base)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return problems, nil
+		}
+
+		return nil, err
+	}
+
+	for _, child := range children {
+		path := filepath.Join(base, child.Name())
+
+		switch child.Name() {
+		case journalFileName, usageFileName:
+			if child.IsDir() {
+				err = stray(path)
+			}
+		case tempDirName:
+			err = verifyStaging(path, child, stray)
+		case blobsDirName:
+			err = verifyLayout(path, child, stray)
+		default:
+			if isInternal(path) {
+				err = stray(path)
+			} else {
+				err = verifyKey(path, child, stray)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return problems, nil
+}
+
+// locate returns where the value stored under key lives: in a diskv (along with its key there), or in a file of its own.
+// The path is set in both cases.
+func (backend *DiskvBackend) locate(key string) (dv *diskv.Diskv, dvKey string, path string, err error) {
+	switch {
+	case key == journalFileName, key == usageFileName:
+		return nil, "", filepath.Join(backend.entries.BasePath, key), nil
+	case strings.HasPrefix(key, tempDirName+"/"):
+		name := strings.TrimPrefix(key, tempDirName+"/")
+		if !validName(name) {
+			return nil, "", "", errInvalidBackendKey
+		}
+
+		return nil, "", filepath.Join(backend.entries.TempDir, name), nil
+	case strings.HasPrefix(key, blobsDirName+"/"):
+		digest := strings.TrimPrefix(key, blobsDirName+"/")
+		if !validName(digest) {
+			return nil, "", "", errInvalidBackendKey
+		}
+
+		return backend.blobs, digest, entryPath(backend.blobs, digest), nil
+	case !validName(key):
+		return nil, "", "", errInvalidBackendKey
+	default:
+		return backend.entries, key, entryPath(backend.entries, key), nil
+	}
+}
+
+// importFile moves the file at path into place, as the value of key.
+func (backend *DiskvBackend) importFile(path, key string) error {
+	dv, dvKey, target, err := backend.locate(key)
+	if err != nil {
+		return err
+	}
+
+	if dv != nil {
+		return dv.Import(path, dvKey, true)
+	}
+
+	return os.Rename(path, target)
+}
+
+// verifyStaging reports anything in the staging directory that is not a file. Files are staged values, which the store
+// deals with.
+func verifyStaging(path string, dirEntry fs.DirEntry, stray func(path string) error) error {
+	if !dirEntry.IsDir() {
+		return stray(path)
+	}
+
+	children, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if !child.Type().IsRegular() {
+			if err = stray(filepath.Join(path, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// verifyLayout reports anything in the diskv directory at path that is not laid out by transform.
+func verifyLayout(path string, dirEntry fs.DirEntry, stray func(path string) error) error {
+	if !dirEntry.IsDir() {
+		return stray(path)
+	}
+
+	children, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err = verifyKey(filepath.Join(path, child.Name()), child, stray); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyKey reports anything wrong with the directory at path, which must hold a single file, named like it and
+// transformBlockSize characters long.
+func verifyKey(path string, dirEntry fs.DirEntry, stray func(path string) error) error {
+	key := dirEntry.Name()
+	if !dirEntry.IsDir() || len(key) != transformBlockSize || !validName(key) {
+		return stray(path)
+	}
+
+	children, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	// A directory without its file is stray as a whole.
+	if !slices.ContainsFunc(children, func(child fs.DirEntry) bool {
+		return child.Name() == key && child.Type().IsRegular()
+	}) {
+		return stray(path)
+	}
+
+	for _, child := range children {
+		if child.Name() == key {
+			continue
+		}
+
+		if err = stray(filepath.Join(path, child.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validName tells whether name can be used as a file name, without escaping its directory or clashing with an internal
+// one.
+func validName(name string) bool {
+	return name != "" && name[0] != '.' && !strings.ContainsAny(name, `/\`)
+}
+
+type diskvPendingValue struct {
+	backend *DiskvBackend
+	file    *os.File
+}
+
+func (value *diskvPendingValue) Write(data []byte) (int, error) {
+	return value.file.Write(data)
+}
+
+// commitHook, if set, is called by diskvPendingValue.Commit before syncing ("sync") and before renaming ("rename"), so
+// that tests can crash the process at these points.
+//
+//nolint:gochecknoglobals
+var commitHook func(point string)
+
+// Commit syncs and closes the temporary file, then renames it into place. The file is removed on failure.
+func (value *diskvPendingValue) Commit(key string) error {
+	name := value.file.Name()
+
+	if commitHook != nil {
+		commitHook("sync")
+	}
+
+	if err := value.file.Sync(); err != nil {
+		return errors.Join(err, value.file.Close(), os.Remove(name))
+	}
+
+	if err := value.file.Close(); err != nil {
+		return errors.Join(err, os.Remove(name))
+	}
+
+	if commitHook != nil {
+		commitHook("rename")
+	}
+
+	if err := value.backend.importFile(name, key); err != nil {
+		return errors.Join(err, os.Remove(name))
+	}
+
+	return nil
+}
+
+func (value *diskvPendingValue) Discard() error {
+	return errors.Join(value.file.Close(), os.Remove(value.file.Name()))
+}
+
+// walkKeys calls function for every key in dv, stopping at the first error.
+// Internal directories (staging, blobs, etc) are skipped.
+func walkKeys(dv *diskv.Diskv, function func(key string) error) error {
+	base := dv.BasePath
+
+	return filepath.WalkDir(base, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			// Nothing has ever been written.
+			if path == base && errors.Is(err, os.ErrNotExist) {
+				return filepath.SkipAll
+			}
+
+			return err
+		}
+
+		if dirEntry.IsDir() {
+			if path != base && isInternal(path) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if key := keyFromPath(base, path); key != "" {
+			return function(key)
+		}
+
+		return nil
+	})
+}
+
+// keyFromPath returns the key stored at path, in the diskv at base, or an empty string if path is not an entry.
+func keyFromPath(base, path string) string {
+	rel, err := filepath.Rel(base, filepath.Dir(path))
+	if err != nil {
+		return ""
+	}
+
+	pathKey := &diskv.PathKey{FileName: filepath.Base(path)}
+	if rel != "." {
+		pathKey.Path = strings.Split(rel, string(filepath.Separator))
+	}
+
+	return inverseTransform(pathKey)
+}
+
+// isInternal tells whether path is an internal directory (staging, blobs, etc).
+func isInternal(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// entryPath returns the location of the file backing the value stored under key in dv.
+func entryPath(dv *diskv.Diskv, key string) string {
+	return filepath.Join(append(append([]string{dv.BasePath}, transform(key)...), key)...)
+}
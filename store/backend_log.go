@@ -0,0 +1,587 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.farcloser.world/core/filesystem"
+)
+
+// Log files are made of a header (magic and version), followed by records:
+//
+//	kind (1 byte) | modified (8 bytes) | key length (2 bytes) | value length (8 bytes) | key | value | checksum (4 bytes)
+//
+// Integers are big endian, modified is in nanoseconds since the epoch, and the checksum is the CRC-32C of everything
+// before it in the record. Deletions are recorded as tombstones, without a value.
+// Records are appended and synced one at a time, so a crash can only leave an incomplete record at the end, which is
+// ignored, and overwritten by the next write. Reading stops at the first invalid record.
+// Once superseded records take more room than live ones (and more than logCompactMin), the file is compacted: live
+// records are copied to a new file, which replaces the log.
+
+const (
+	logMagic      = "\x00gcl"
+	logVersion    = 1
+	logHeaderSize = len(logMagic) + 1
+	// logRecordPrefixSize is the size of a record before its key.
+	logRecordPrefixSize = 1 + 8 + 2 + 8
+	logChecksumSize     = 4
+	logCompactMin       = 4 * 1024 * 1024
+	logLockSuffix       = ".lock"
+
+	logRecordPut    byte = 1
+	logRecordDelete byte = 2
+)
+
+//nolint:gochecknoglobals
+var logChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// LogBackend keeps every value in a single, append-only file, and an index of where they are in memory.
+// Locking is done with an advisory lock on a file next to the log (with a .lock suffix), which makes the backend safe to
+// share between processes: the index is brought up to date every time the lock is acquired.
+// Access times (see Stater) are only tracked in memory.
+type LogBackend struct {
+	path    string
+	mu      sync.Mutex
+	file    *os.File
+	records map[string]*logRecord
+	// end is where the next record goes.
+	end int64
+	// live and garbage count the bytes of current and superseded records.
+	live    int64
+	garbage int64
+}
+
+type logRecord struct {
+	offset   int64
+	size     int64
+	key      string
+	value    int64
+	modified time.Time
+	accessed time.Time
+}
+
+// valueOffset is where the value of the record starts.
+func (record *logRecord) valueOffset() int64 {
+	return record.offset + int64(logRecordPrefixSize+len(record.key))
+}
+
+// OpenLogBackend opens the log file at path, creating it if needed. It must be closed once done with.
+func OpenLogBackend(path string) (*LogBackend, error) {
+	err := os.MkdirAll(filepath.Dir(path), filesystem.DirPermissionsPrivate)
+	if err != nil {
+		return nil, err
+	}
+
+	// The lock file is never removed, so that every process locks the same one.
+	//nolint:gosec
+	lock, err := os.OpenFile(path+logLockSuffix, os.O_RDONLY|os.O_CREATE, filesystem.FilePermissionsPrivate)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = lock.Close(); err != nil {
+		return nil, err
+	}
+
+	backend := &LogBackend{path: path}
+
+	if err = backend.open(); err != nil {
+		return nil, err
+	}
+
+	return backend, nil
+}
+
+// Close closes the log file.
+func (backend *LogBackend) Close() error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	return backend.file.Close()
+}
+
+// Read returns the value stored under key.
+func (backend *LogBackend) Read(key string) ([]byte, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	record, ok := backend.records[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	data := make([]byte, record.size)
+	if _, err := backend.file.ReadAt(data, record.offset); err != nil {
+		return nil, errors.Join(errCorruptLog, err)
+	}
+
+	if !validRecord(data) {
+		return nil, errCorruptLog
+	}
+
+	start := logRecordPrefixSize + len(key)
+
+	return data[start : start+int(record.value)], nil
+}
+
+// Write appends a record storing value under key.
+func (backend *LogBackend) Write(key string, value []byte) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	return backend.append(logRecordPut, key, value)
+}
+
+// Has tells whether a value is stored under key.
+func (backend *LogBackend) Has(key string) (bool, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	_, ok := backend.records[key]
+
+	return ok, nil
+}
+
+// Delete appends a tombstone for key.
+func (backend *LogBackend) Delete(key string) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if _, ok := backend.records[key]; !ok {
+		return os.ErrNotExist
+	}
+
+	return backend.append(logRecordDelete, key, nil)
+}
+
+// Keys calls function for every key starting with prefix. Keys are collected first, so function may modify the backend.
+func (backend *LogBackend) Keys(prefix string, function func(key string) error) error {
+	backend.mu.Lock()
+
+	keys := []string{}
+
+	for key := range backend.records {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	backend.mu.Unlock()
+
+	for _, key := range keys {
+		if err := function(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Lock places an advisory lock on the lock file, then catches up with changes made by other processes.
+func (backend *LogBackend) Lock(ctx context.Context, exclusive bool) (func() error, error) {
+	unlock, err := lockPath(ctx, backend.path+logLockSuffix, exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if err = backend.refresh(); err != nil {
+		return nil, errors.Join(err, unlock())
+	}
+
+	return unlock, nil
+}
+
+// Stat describes the value stored under key.
+func (backend *LogBackend) Stat(key string) (*ValueInfo, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	record, ok := backend.records[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return &ValueInfo{
+		Size:     record.value,
+		Modified: record.modified,
+		Accessed: record.accessed,
+	}, nil
+}
+
+// Touch records that the value stored under key has just been used, in memory.
+func (backend *LogBackend) Touch(key string) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	record, ok := backend.records[key]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	record.accessed = time.Now()
+
+	return nil
+}
+
+// Compact rewrites the log with live records only. It is done automatically as needed, but can be forced, for example
+// after deleting most values.
+// Compact takes the lock itself, and must not be called while the backend is locked.
+func (backend *LogBackend) Compact() error {
+	unlock, err := backend.Lock(context.Background(), true)
+	if err != nil {
+		return err
+	}
+
+	backend.mu.Lock()
+	err = backend.compact()
+	backend.mu.Unlock()
+
+	return errors.Join(err, unlock())
+}
+
+// Verify reports incomplete or corrupt records at the end of the log, and truncates them if repair is set. Records
+// before them are checked as values are read.
+func (backend *LogBackend) Verify(repair bool) ([]*Problem, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	info, err := backend.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() <= backend.end {
+		return []*Problem{}, nil
+	}
+
+	problem := &Problem{
+		Kind:   ProblemCorrupt,
+		Key:    backend.path,
+		Detail: strconv.FormatInt(info.Size()-backend.end, 10) + " bytes of invalid records at the end of the log",
+	}
+
+	if repair {
+		if err = backend.file.Truncate(backend.end); err != nil {
+			return nil, err
+		}
+
+		if err = backend.file.Sync(); err != nil {
+			return nil, err
+		}
+
+		problem.Repaired = true
+	}
+
+	return []*Problem{problem}, nil
+}
+
+// open (re)opens the log file, and reads it from the start.
+func (backend *LogBackend) open() error {
+	//nolint:gosec
+	file, err := os.OpenFile(backend.path, os.O_RDWR|os.O_CREATE, filesystem.FilePermissionsPrivate)
+	if err != nil {
+		return err
+	}
+
+	if backend.file != nil {
+		_ = backend.file.Close()
+	}
+
+	backend.file = file
+	backend.records = map[string]*logRecord{}
+	backend.end = 0
+	backend.live = 0
+	backend.garbage = 0
+
+	return backend.refresh()
+}
+
+// refresh reads records appended since the last time, reopening the log if it has been replaced by a compaction.
+func (backend *LogBackend) refresh() error {
+	current, err := backend.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	latest, err := os.Stat(backend.path)
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(current, latest) {
+		return backend.open()
+	}
+
+	size := latest.Size()
+
+	if backend.end == 0 {
+		// Created, but not written to yet.
+		if size < int64(logHeaderSize) {
+			return nil
+		}
+
+		header := make([]byte, logHeaderSize)
+		if _, err = backend.file.ReadAt(header, 0); err != nil {
+			return err
+		}
+
+		if string(header[:len(logMagic)]) != logMagic || header[len(logMagic)] != logVersion {
+			return errCorruptLog
+		}
+
+		backend.end = int64(logHeaderSize)
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(backend.file, backend.end, size-backend.end))
+
+	for {
+		record, kind, err := readLogRecord(reader, backend.end, size)
+		if err != nil {
+			return err
+		}
+
+		if record == nil {
+			return nil
+		}
+
+		backend.apply(record, kind)
+	}
+}
+
+// readLogRecord reads the record at offset from reader, or returns nil if there is no valid record there.
+func readLogRecord(reader io.Reader, offset, size int64) (*logRecord, byte, error) {
+	prefix := make([]byte, logRecordPrefixSize)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return nil, 0, ignoreEOF(err)
+	}
+
+	keySize := int64(binary.BigEndian.Uint16(prefix[9:]))
+	valueSize := binary.BigEndian.Uint64(prefix[11:])
+
+	// Anything running past the end of the file is incomplete (or corrupt), and must not be allocated.
+	rest := uint64(size - offset - int64(logRecordPrefixSize) - keySize - logChecksumSize)
+	if offset+int64(logRecordPrefixSize)+keySize+logChecksumSize > size || valueSize > rest {
+		return nil, 0, nil
+	}
+
+	//nolint:gosec
+	data := make([]byte, int64(logRecordPrefixSize)+keySize+int64(valueSize)+logChecksumSize)
+	copy(data, prefix)
+
+	if _, err := io.ReadFull(reader, data[logRecordPrefixSize:]); err != nil {
+		return nil, 0, ignoreEOF(err)
+	}
+
+	if !validRecord(data) {
+		return nil, 0, nil
+	}
+
+	//nolint:gosec
+	return &logRecord{
+		offset:   offset,
+		size:     int64(len(data)),
+		key:      string(data[logRecordPrefixSize : int64(logRecordPrefixSize)+keySize]),
+		value:    int64(valueSize),
+		modified: time.Unix(0, int64(binary.BigEndian.Uint64(prefix[1:]))),
+	}, prefix[0], nil
+}
+
+// apply updates the index with a record read or written at the end of the log.
+func (backend *LogBackend) apply(record *logRecord, kind byte) {
+	backend.end += record.size
+
+	if previous, ok := backend.records[record.key]; ok {
+		backend.live -= previous.size
+		backend.garbage += previous.size
+	}
+
+	if kind == logRecordDelete {
+		delete(backend.records, record.key)
+		backend.garbage += record.size
+
+		return
+	}
+
+	record.accessed = record.modified
+	backend.records[record.key] = record
+	backend.live += record.size
+}
+
+// append writes and syncs a record at the end of the log, then compacts it if worth it.
+func (backend *LogBackend) append(kind byte, key string, value []byte) error {
+	if len(key) > 0xffff {
+		return errInvalidBackendKey
+	}
+
+	// Get rid of whatever an interrupted write may have left behind.
+	if err := backend.file.Truncate(backend.end); err != nil {
+		return err
+	}
+
+	if backend.end == 0 {
+		if _, err := backend.file.WriteAt(append([]byte(logMagic), logVersion), 0); err != nil {
+			return err
+		}
+
+		backend.end = int64(logHeaderSize)
+	}
+
+	now := time.Now()
+	data := encodeLogRecord(kind, key, value, now)
+
+	if _, err := backend.file.WriteAt(data, backend.end); err != nil {
+		return err
+	}
+
+	if err := backend.file.Sync(); err != nil {
+		return err
+	}
+
+	backend.apply(&logRecord{
+		offset:   backend.end,
+		size:     int64(len(data)),
+		key:      key,
+		value:    int64(len(value)),
+		modified: now,
+	}, kind)
+
+	if backend.garbage > logCompactMin && backend.garbage > backend.live {
+		return backend.compact()
+	}
+
+	return nil
+}
+
+// compact copies live records to a new file, and replaces the log with it.
+func (backend *LogBackend) compact() error {
+	file, err := os.CreateTemp(filepath.Dir(backend.path), filepath.Base(backend.path)+".compact-")
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(backend.records))
+	for key := range backend.records {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	records := make(map[string]*logRecord, len(keys))
+	writer := bufio.NewWriter(file)
+	offset := int64(logHeaderSize)
+
+	_, err = writer.Write(append([]byte(logMagic), logVersion))
+
+	for _, key := range keys {
+		if err != nil {
+			break
+		}
+
+		record := *backend.records[key]
+
+		_, err = io.Copy(writer, io.NewSectionReader(backend.file, record.offset, record.size))
+		record.offset = offset
+		records[key] = &record
+		offset += record.size
+	}
+
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err != nil {
+		return errors.Join(err, file.Close(), os.Remove(file.Name()))
+	}
+
+	if err = file.Close(); err != nil {
+		return errors.Join(err, os.Remove(file.Name()))
+	}
+
+	if err = os.Rename(file.Name(), backend.path); err != nil {
+		return errors.Join(err, os.Remove(file.Name()))
+	}
+
+	//nolint:gosec
+	replacement, err := os.OpenFile(backend.path, os.O_RDWR, filesystem.FilePermissionsPrivate)
+	if err != nil {
+		return err
+	}
+
+	_ = backend.file.Close()
+
+	backend.file = replacement
+	backend.records = records
+	backend.end = offset
+	backend.live = offset - int64(logHeaderSize)
+	backend.garbage = 0
+
+	return nil
+}
+
+func encodeLogRecord(kind byte, key string, value []byte, modified time.Time) []byte {
+	data := make([]byte, logRecordPrefixSize, logRecordPrefixSize+len(key)+len(value)+logChecksumSize)
+	data[0] = kind
+	//nolint:gosec
+	binary.BigEndian.PutUint64(data[1:], uint64(modified.UnixNano()))
+	//nolint:gosec
+	binary.BigEndian.PutUint16(data[9:], uint16(len(key)))
+	binary.BigEndian.PutUint64(data[11:], uint64(len(value)))
+
+	data = append(data, key...)
+	data = append(data, value...)
+
+	return binary.BigEndian.AppendUint32(data, crc32.Checksum(data, logChecksumTable))
+}
+
+// validRecord verifies the checksum of a whole record.
+func validRecord(data []byte) bool {
+	if len(data) < logRecordPrefixSize+logChecksumSize {
+		return false
+	}
+
+	sum := binary.BigEndian.Uint32(data[len(data)-logChecksumSize:])
+
+	return crc32.Checksum(data[:len(data)-logChecksumSize], logChecksumTable) == sum
+}
+
+func ignoreEOF(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+
+	return err
+}
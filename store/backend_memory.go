@@ -0,0 +1,250 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.farcloser.world/core/filesystem"
+)
+
+// MemoryBackend keeps values in memory, for tests and short-lived caches. Nothing survives the process.
+// Its lock is only shared by the stores using the same MemoryBackend.
+type MemoryBackend struct {
+	mu     sync.RWMutex
+	values map[string]*memoryValue
+	lock   *contextLock
+}
+
+type memoryValue struct {
+	data     []byte
+	modified time.Time
+	accessed time.Time
+}
+
+// NewMemoryBackend returns an empty in-memory backend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		values: map[string]*memoryValue{},
+		lock:   newContextLock(),
+	}
+}
+
+// Read returns a copy of the value stored under key.
+func (backend *MemoryBackend) Read(key string) ([]byte, error) {
+	backend.mu.RLock()
+	defer backend.mu.RUnlock()
+
+	value, ok := backend.values[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return slices.Clone(value.data), nil
+}
+
+// Write stores a copy of value under key.
+func (backend *MemoryBackend) Write(key string, value []byte) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	now := time.Now()
+	backend.values[key] = &memoryValue{data: slices.Clone(value), modified: now, accessed: now}
+
+	return nil
+}
+
+// Has tells whether a value is stored under key.
+func (backend *MemoryBackend) Has(key string) (bool, error) {
+	backend.mu.RLock()
+	defer backend.mu.RUnlock()
+
+	_, ok := backend.values[key]
+
+	return ok, nil
+}
+
+// Delete removes the value stored under key.
+func (backend *MemoryBackend) Delete(key string) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if _, ok := backend.values[key]; !ok {
+		return os.ErrNotExist
+	}
+
+	delete(backend.values, key)
+
+	return nil
+}
+
+// Keys calls function for every key starting with prefix. Keys are collected first, so function may modify the backend.
+func (backend *MemoryBackend) Keys(prefix string, function func(key string) error) error {
+	backend.mu.RLock()
+
+	keys := []string{}
+
+	for key := range backend.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	backend.mu.RUnlock()
+
+	for _, key := range keys {
+		if err := function(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Lock locks the backend.
+func (backend *MemoryBackend) Lock(ctx context.Context, exclusive bool) (func() error, error) {
+	return backend.lock.acquire(ctx, exclusive)
+}
+
+// Move moves the value stored under from to key to.
+func (backend *MemoryBackend) Move(from, to string) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	value, ok := backend.values[from]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	backend.values[to] = value
+	delete(backend.values, from)
+
+	return nil
+}
+
+// Stat describes the value stored under key.
+func (backend *MemoryBackend) Stat(key string) (*ValueInfo, error) {
+	backend.mu.RLock()
+	defer backend.mu.RUnlock()
+
+	value, ok := backend.values[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return &ValueInfo{
+		Size:     int64(len(value.data)),
+		Modified: value.modified,
+		Accessed: value.accessed,
+	}, nil
+}
+
+// Touch records that the value stored under key has just been used.
+func (backend *MemoryBackend) Touch(key string) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	value, ok := backend.values[key]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	value.accessed = time.Now()
+
+	return nil
+}
+
+// memoryLockPath stands for the path of the lock in errors.
+const memoryLockPath = "(memory)"
+
+// contextLock is a read/write lock that can be given up on.
+type contextLock struct {
+	mu      sync.Mutex
+	readers int
+	writer  bool
+	// released is closed (and replaced) every time the lock is released.
+	released chan struct{}
+}
+
+func newContextLock() *contextLock {
+	return &contextLock{released: make(chan struct{})}
+}
+
+// acquire takes the lock, for writing if exclusive is set, giving up once ctx is done, or right away if it is done
+// already.
+func (lock *contextLock) acquire(ctx context.Context, exclusive bool) (func() error, error) {
+	try := ctx.Err() != nil
+
+	for {
+		lock.mu.Lock()
+
+		if !lock.writer && (!exclusive || lock.readers == 0) {
+			if exclusive {
+				lock.writer = true
+			} else {
+				lock.readers++
+			}
+
+			lock.mu.Unlock()
+
+			return lock.releaser(exclusive), nil
+		}
+
+		released := lock.released
+		lock.mu.Unlock()
+
+		if try {
+			return nil, &filesystem.LockTimeoutError{Path: memoryLockPath}
+		}
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, &filesystem.LockTimeoutError{Path: memoryLockPath, Cause: ctx.Err()}
+		}
+	}
+}
+
+func (lock *contextLock) releaser(exclusive bool) func() error {
+	var once sync.Once
+
+	return func() error {
+		err := filesystem.ErrUnlockFail
+
+		once.Do(func() {
+			lock.mu.Lock()
+			defer lock.mu.Unlock()
+
+			if exclusive {
+				lock.writer = false
+			} else {
+				lock.readers--
+			}
+
+			close(lock.released)
+			lock.released = make(chan struct{})
+			err = nil
+		})
+
+		return err
+	}
+}
@@ -0,0 +1,380 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/store"
+)
+
+// backends returns a constructor for every backend shipped with the package.
+func backends() map[string]func(t *testing.T) store.Backend {
+	return map[string]func(t *testing.T) store.Backend{
+		"diskv": func(t *testing.T) store.Backend {
+			t.Helper()
+
+			return store.NewDiskvBackend(t.TempDir(), 0)
+		},
+		"memory": func(t *testing.T) store.Backend {
+			t.Helper()
+
+			return store.NewMemoryBackend()
+		},
+		"log": func(t *testing.T) store.Backend {
+			t.Helper()
+
+			backend, err := store.OpenLogBackend(filepath.Join(t.TempDir(), "store.log"))
+			assert.NilError(t, err)
+
+			t.Cleanup(func() {
+				assert.NilError(t, backend.Close())
+			})
+
+			return backend
+		},
+	}
+}
+
+func TestBackendsStore(t *testing.T) {
+	t.Parallel()
+
+	for name, newBackend := range backends() {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			st := store.New(&store.Options{Backend: newBackend(t)})
+
+			assert.NilError(t, st.Write("one", []byte("1")))
+			assert.NilError(t, st.Write("two", []byte("2")))
+			assert.NilError(t, st.Rename("two", "deux"))
+
+			content, err := st.Read("deux")
+			assert.NilError(t, err)
+			assert.Equal(t, string(content), "2")
+
+			// Failed transactions leave nothing behind.
+			assert.ErrorIs(t, st.Update(func(tx *store.Tx) error {
+				if err := tx.Write("three", []byte("3")); err != nil {
+					return err
+				}
+
+				return io.ErrUnexpectedEOF
+			}), io.ErrUnexpectedEOF)
+
+			assert.NilError(t, st.Update(func(tx *store.Tx) error {
+				if err := tx.Write("four", []byte("4")); err != nil {
+					return err
+				}
+
+				return tx.Delete("one")
+			}))
+
+			entries, err := st.List("")
+			assert.NilError(t, err)
+			assert.Equal(t, len(entries), 2)
+			assert.Equal(t, entries[0].Name, "deux")
+			assert.Equal(t, entries[1].Name, "four")
+			assert.Equal(t, entries[1].Size, int64(1))
+
+			writer, err := st.Writer("stream")
+			assert.NilError(t, err)
+			_, err = writer.Write(bytes.Repeat([]byte("s"), 100000))
+			assert.NilError(t, err)
+			assert.NilError(t, writer.Close())
+
+			reader, err := st.Reader("stream")
+			assert.NilError(t, err)
+			content, err = io.ReadAll(reader)
+			assert.NilError(t, err)
+			assert.NilError(t, reader.Close())
+			assert.Equal(t, len(content), 100000)
+
+			assert.NilError(t, st.WriteWithMetadata("expiring", []byte("e"), &store.Metadata{Expires: time.Now()}))
+
+			count, err := st.Prune()
+			assert.NilError(t, err)
+			assert.Equal(t, count, 1)
+
+			assert.NilError(t, st.Delete("stream"))
+			assert.Assert(t, st.Delete("stream") != nil)
+		})
+	}
+}
+
+func TestBackendsContentAddressable(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte("k"), store.KeySize)
+
+	for name, newBackend := range backends() {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			backend := newBackend(t)
+			st := store.New(&store.Options{Backend: backend, ContentAddressable: true, Compress: true})
+
+			assert.NilError(t, st.Write("one", []byte("shared")))
+			assert.NilError(t, st.Write("two", []byte("shared")))
+
+			writer, err := st.Writer("three")
+			assert.NilError(t, err)
+			_, err = writer.Write([]byte("other"))
+			assert.NilError(t, err)
+			assert.NilError(t, writer.Close())
+
+			count, err := st.RotateKey(store.StaticKey(key))
+			assert.NilError(t, err)
+			// Three entries, and two blobs.
+			assert.Equal(t, count, 5)
+
+			st = store.New(&store.Options{Backend: backend, ContentAddressable: true, EncryptionKey: key})
+
+			assert.NilError(t, st.Delete("three"))
+
+			count, err = st.GC()
+			assert.NilError(t, err)
+			assert.Equal(t, count, 1)
+
+			content, err := st.Read("two")
+			assert.NilError(t, err)
+			assert.Equal(t, string(content), "shared")
+		})
+	}
+}
+
+func TestBackendsEviction(t *testing.T) {
+	t.Parallel()
+
+	value := []byte(strings.Repeat("v", 1000))
+
+	for name, newBackend := range backends() {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			st := store.New(&store.Options{Backend: newBackend(t), MaxDiskSize: 3500})
+
+			for _, name := range []string{"a", "b", "c"} {
+				assert.NilError(t, st.Write(name, value))
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			_, err := st.Read("a")
+			assert.NilError(t, err)
+			time.Sleep(10 * time.Millisecond)
+
+			assert.NilError(t, st.Write("d", value))
+
+			for name, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+				has, err := st.Has(name)
+				assert.NilError(t, err)
+				assert.Equal(t, has, expected, name)
+			}
+		})
+	}
+}
+
+func TestBackendsLock(t *testing.T) {
+	t.Parallel()
+
+	for name, newBackend := range backends() {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			backend := newBackend(t)
+			st := store.New(&store.Options{Backend: backend})
+			other := store.New(&store.Options{Backend: backend})
+
+			assert.NilError(t, st.ReadOnlyLock())
+			assert.NilError(t, other.TryReadOnlyLock())
+			assert.NilError(t, other.Unlock())
+
+			assert.ErrorIs(t, other.TryLock(), filesystem.ErrLockTimeout)
+
+			ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+			defer cancel()
+
+			assert.ErrorIs(t, other.LockContext(ctx), filesystem.ErrLockTimeout)
+
+			assert.NilError(t, st.Unlock())
+			assert.NilError(t, other.TryLock())
+			assert.NilError(t, other.Unlock())
+		})
+	}
+}
+
+func TestMemoryBackendWatch(t *testing.T) {
+	t.Parallel()
+
+	backend := store.NewMemoryBackend()
+	st := store.New(&store.Options{Backend: backend})
+
+	assert.NilError(t, st.Write("existing", []byte("value")))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	events, err := st.Watch(ctx, "")
+	assert.NilError(t, err)
+
+	assert.NilError(t, store.New(&store.Options{Backend: backend}).Write("new", []byte("value")))
+
+	event := nextEvent(t, events)
+	assert.Equal(t, event.Type, store.EventPut)
+	assert.Equal(t, event.Name, "new")
+
+	assert.NilError(t, st.Delete("existing"))
+
+	event = nextEvent(t, events)
+	assert.Equal(t, event.Type, store.EventDelete)
+	assert.Equal(t, event.Name, "existing")
+}
+
+func TestLogBackendShared(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "store.log")
+
+	backend, err := store.OpenLogBackend(path)
+	assert.NilError(t, err)
+
+	defer func() {
+		assert.NilError(t, backend.Close())
+	}()
+
+	// Another backend on the same file, as another process would.
+	other, err := store.OpenLogBackend(path)
+	assert.NilError(t, err)
+
+	defer func() {
+		assert.NilError(t, other.Close())
+	}()
+
+	st := store.New(&store.Options{Backend: backend})
+	otherStore := store.New(&store.Options{Backend: other})
+
+	assert.NilError(t, st.Write("one", []byte("1")))
+
+	content, err := otherStore.Read("one")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "1")
+
+	assert.NilError(t, otherStore.Write("one", []byte("one")))
+	assert.NilError(t, other.Compact())
+
+	// The log has been replaced from under the first backend.
+	content, err = st.Read("one")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "one")
+
+	assert.NilError(t, st.Write("two", []byte("2")))
+
+	content, err = otherStore.Read("two")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "2")
+}
+
+func TestLogBackendRecovery(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "store.log")
+
+	backend, err := store.OpenLogBackend(path)
+	assert.NilError(t, err)
+
+	st := store.New(&store.Options{Backend: backend})
+	assert.NilError(t, st.Write("one", []byte("1")))
+	assert.NilError(t, st.Write("two", []byte("2")))
+	assert.NilError(t, backend.Close())
+
+	info, err := os.Stat(path)
+	assert.NilError(t, err)
+
+	// Interrupt the last write: the incomplete record is ignored.
+	assert.NilError(t, os.Truncate(path, info.Size()-3))
+
+	backend, err = store.OpenLogBackend(path)
+	assert.NilError(t, err)
+
+	defer func() {
+		assert.NilError(t, backend.Close())
+	}()
+
+	st = store.New(&store.Options{Backend: backend})
+
+	content, err := st.Read("one")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "1")
+
+	_, err = st.Read("two")
+	assert.Assert(t, errors.Is(err, os.ErrNotExist))
+
+	// Writing again overwrites what was left of it.
+	assert.NilError(t, st.Write("three", []byte("3")))
+
+	entries, err := st.List("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 2)
+}
+
+func TestLogBackendCompaction(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "store.log")
+
+	backend, err := store.OpenLogBackend(path)
+	assert.NilError(t, err)
+
+	defer func() {
+		assert.NilError(t, backend.Close())
+	}()
+
+	st := store.New(&store.Options{Backend: backend})
+	value := bytes.Repeat([]byte("v"), 1024*1024)
+
+	// Overwriting the same value over and over compacts the log along the way.
+	for range 20 {
+		assert.NilError(t, st.Write("value", value))
+	}
+
+	info, err := os.Stat(path)
+	assert.NilError(t, err)
+	assert.Assert(t, info.Size() < 10*1024*1024, info.Size())
+
+	assert.NilError(t, st.Delete("value"))
+	assert.NilError(t, backend.Compact())
+
+	info, err = os.Stat(path)
+	assert.NilError(t, err)
+	assert.Assert(t, info.Size() < 1024, info.Size())
+
+	has, err := st.Has("value")
+	assert.NilError(t, err)
+	assert.Assert(t, !has)
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	gohash "hash"
+	"io"
+	"time"
+)
+
+// In content-addressable mode, values are stored as blobs under the digest of their content, in a separate namespace of
+// the backend, while entries only hold metadata with the digest of the blob they refer to.
+// Blobs are never modified once written. Deleting or overwriting an entry leaves its blob behind, until GC removes it.
+
+// GC removes all blobs that are not referred to by any (non-expired) entry, in a single locked pass, and returns how
+// many were removed.
+func (st *Store) GC() (count int, err error) {
+	if st.lock == nil {
+		err = st.WriteLock()
+		if err != nil {
+			return 0, err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	referenced := map[string]bool{}
+	now := time.Now()
+
+	err = st.walkEntries(func(key string) error {
+		entry, err := st.statEntry(key, false)
+		if err != nil {
+			return err
+		}
+
+		if entry.Metadata.Digest != "" && !entry.Metadata.Expired(now) {
+			referenced[entry.Metadata.Digest] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	unreferenced := []string{}
+
+	err = st.walkBlobs(func(digest string) error {
+		if !referenced[digest] {
+			unreferenced = append(unreferenced, digest)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, digest := range unreferenced {
+		if err = st.deleteValue(blobKey(digest)); err != nil {
+			return count, errors.Join(ErrFileStoreFail, err)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// readBlob reads the blob with the given digest, and verifies its integrity.
+func (st *Store) readBlob(digest string) ([]byte, error) {
+	data, err := st.backend.Read(blobKey(digest))
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	_, payload, err := st.codec.decode(data)
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	if digestOf(payload) != digest {
+		return nil, errors.Join(ErrFileStoreFail, ErrIntegrityCheckFail)
+	}
+
+	return payload, nil
+}
+
+// openBlob opens the blob with the given digest for streaming. Its integrity is verified once it has been fully read.
+func (st *Store) openBlob(digest string) (io.ReadCloser, io.ReadCloser, error) {
+	file, err := openValue(st.backend, blobKey(digest))
+	if err != nil {
+		return nil, nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	_, payload, err := st.codec.newReader(file)
+	if err != nil {
+		return nil, nil, errors.Join(ErrFileStoreFail, err, file.Close())
+	}
+
+	return file, &verifyingReader{reader: payload, hasher: sha256.New(), digest: digest}, nil
+}
+
+// hasBlob tells whether the blob with the given digest is already stored.
+func (st *Store) hasBlob(digest string) bool {
+	has, err := st.backend.Has(blobKey(digest))
+
+	return err == nil && has
+}
+
+// commitBlob stores a pending blob, unless it is already stored, in which case the pending value is discarded.
+func (st *Store) commitBlob(pending PendingValue, digest string) error {
+	if st.hasBlob(digest) {
+		return pending.Discard()
+	}
+
+	return st.tracked(blobKey(digest), func() error {
+		return pending.Commit(blobKey(digest))
+	})
+}
+
+func newBlobMetadata(now time.Time) *Metadata {
+	return &Metadata{Created: now, Modified: now}
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+
+	return hex.EncodeToString(sum[:])
+}
+
+type verifyingReader struct {
+	reader io.ReadCloser
+	hasher gohash.Hash
+	digest string
+}
+
+func (reader *verifyingReader) Read(data []byte) (int, error) {
+	n, err := reader.reader.Read(data)
+	reader.hasher.Write(data[:n])
+
+	if errors.Is(err, io.EOF) && hex.EncodeToString(reader.hasher.Sum(nil)) != reader.digest {
+		return n, errors.Join(ErrFileStoreFail, ErrIntegrityCheckFail)
+	}
+
+	return n, err
+}
+
+func (reader *verifyingReader) Close() error {
+	return reader.reader.Close()
+}
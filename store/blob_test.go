@@ -0,0 +1,152 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+)
+
+func blobPath(base string, content string) string {
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+
+	return filepath.Join(base, ".blobs", digest, digest)
+}
+
+func TestStoreContentAddressable(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	st := store.New(&store.Options{Path: base, ContentAddressable: true})
+
+	assert.NilError(t, st.Write("one", []byte("shared")))
+	assert.NilError(t, st.Update(func(tx *store.Tx) error {
+		if err := tx.Write("two", []byte("shared")); err != nil {
+			return err
+		}
+
+		content, err := tx.Read("two")
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), "shared")
+
+		return tx.Write("three", []byte("other"))
+	}))
+
+	blobs, err := os.ReadDir(filepath.Join(base, ".blobs"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(blobs), 2, "identical content must be stored once")
+
+	for _, name := range []string{"one", "two"} {
+		content, err := st.Read(name)
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), "shared")
+	}
+
+	reader, err := st.Reader("three")
+	assert.NilError(t, err)
+
+	content, err := io.ReadAll(reader)
+	assert.NilError(t, err)
+	assert.NilError(t, reader.Close())
+	assert.Equal(t, string(content), "other")
+
+	entries, err := st.List("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 3)
+	assert.Equal(t, entries[0].Size, int64(len("shared")))
+
+	// Blobs outlive their entries until collected.
+	assert.NilError(t, st.Delete("one"))
+	assert.NilError(t, st.Write("three", []byte("replaced")))
+
+	count, err := st.GC()
+	assert.NilError(t, err)
+	assert.Equal(t, count, 1)
+
+	_, err = os.Stat(blobPath(base, "other"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	content, err = st.Read("two")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "shared")
+
+	assert.NilError(t, st.Delete("two"))
+
+	count, err = st.GC()
+	assert.NilError(t, err)
+	assert.Equal(t, count, 1)
+}
+
+func TestStoreContentAddressableIntegrity(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	st := store.New(&store.Options{Path: base, ContentAddressable: true})
+
+	assert.NilError(t, st.Write("key", []byte("value")))
+
+	path := blobPath(base, "value")
+	data, err := os.ReadFile(path)
+	assert.NilError(t, err)
+
+	data[len(data)-1] ^= 0xff
+	assert.NilError(t, os.WriteFile(path, data, 0o600))
+
+	_, err = st.Read("key")
+	assert.ErrorIs(t, err, store.ErrIntegrityCheckFail)
+
+	reader, err := st.Reader("key")
+	assert.NilError(t, err)
+
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, store.ErrIntegrityCheckFail)
+	assert.NilError(t, reader.Close())
+}
+
+func TestStoreContentAddressableMixed(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	plain := store.New(&store.Options{Path: base})
+	addressed := store.New(&store.Options{Path: base, ContentAddressable: true})
+
+	assert.NilError(t, plain.Write("plain", []byte("plain")))
+	assert.NilError(t, addressed.Write("addressed", []byte("addressed")))
+
+	for _, st := range []*store.Store{plain, addressed} {
+		for _, name := range []string{"plain", "addressed"} {
+			content, err := st.Read(name)
+			assert.NilError(t, err)
+			assert.Equal(t, string(content), name)
+		}
+	}
+
+	// Inline entries hold no blob, and are left alone.
+	count, err := addressed.GC()
+	assert.NilError(t, err)
+	assert.Equal(t, count, 0)
+}
@@ -0,0 +1,279 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encrypted payloads are stored as:
+//
+//	key id length (1 byte) | key id | salt (32 bytes) | chunks
+//
+// Every entry is encrypted with its own AES-256-GCM key, derived with HKDF-SHA256 from the master key, the salt and the
+// key id. The payload is split in chunks of cipherChunkSize bytes (the last one possibly shorter or empty), each sealed
+// with the entry header as additional data, and a nonce made of the chunk index and a flag set on the last chunk only.
+// This binds the payload to the metadata, and detects reordered, truncated or extended chunks.
+
+const (
+	cipherSaltSize  = 32
+	cipherChunkSize = 64 * 1024
+	cipherInfo      = "go.farcloser.world/core/store"
+	// gcmOverhead is the size of the GCM tag appended to every chunk.
+	gcmOverhead = 16
+)
+
+func newEntryCipher(key []byte, salt []byte, id string) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, errInvalidKey
+	}
+
+	derived, err := hkdf.Key(sha256.New, key, salt, cipherInfo+" "+id, KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, index uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], index)
+
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// decryptedSize computes the size of an encrypted payload of the given size, once decrypted, from its prologue.
+func decryptedSize(reader io.Reader, size int64) (int64, error) {
+	idSize := make([]byte, 1)
+	if _, err := io.ReadFull(reader, idSize); err != nil {
+		return 0, errors.Join(errCorruptEntry, err)
+	}
+
+	sealed := size - 1 - int64(idSize[0]) - cipherSaltSize
+	if sealed < gcmOverhead {
+		return 0, errCorruptEntry
+	}
+
+	// Every chunk is full but the last one, which may be empty.
+	chunks := sealed/(cipherChunkSize+gcmOverhead) + 1
+	if sealed%(cipherChunkSize+gcmOverhead) == 0 {
+		chunks--
+	}
+
+	return sealed - chunks*gcmOverhead, nil
+}
+
+type encryptingWriter struct {
+	writer io.Writer
+	aead   cipher.AEAD
+	aad    []byte
+	buf    []byte
+	index  uint64
+}
+
+// newEncryptingWriter writes the encryption prologue to writer, and returns a writer encrypting to it.
+// Closing the returned writer seals the last chunk, but does not close the underlying writer.
+func newEncryptingWriter(writer io.Writer, keys KeyProvider, aad []byte) (io.WriteCloser, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(id) > 255 {
+		return nil, errInvalidKey
+	}
+
+	prologue := make([]byte, 1+len(id)+cipherSaltSize)
+	prologue[0] = byte(len(id))
+	copy(prologue[1:], id)
+
+	salt := prologue[1+len(id):]
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := newEntryCipher(key, salt, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = writer.Write(prologue); err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		writer: writer,
+		aead:   aead,
+		aad:    aad,
+		buf:    make([]byte, 0, cipherChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (writer *encryptingWriter) Write(data []byte) (int, error) {
+	written := 0
+
+	for len(data) > 0 {
+		// The last chunk is only known on close, so a full chunk is only sealed once more data comes in.
+		if len(writer.buf) == cipherChunkSize {
+			if err := writer.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := min(len(data), cipherChunkSize-len(writer.buf))
+		writer.buf = append(writer.buf, data[:n]...)
+		data = data[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (writer *encryptingWriter) Close() error {
+	return writer.seal(true)
+}
+
+func (writer *encryptingWriter) seal(last bool) error {
+	sealed := writer.aead.Seal(writer.buf[:0], chunkNonce(writer.aead, writer.index, last), writer.buf, writer.aad)
+	writer.buf = writer.buf[:0]
+	writer.index++
+
+	_, err := writer.writer.Write(sealed)
+
+	return err
+}
+
+type decryptingReader struct {
+	reader *bufio.Reader
+	aead   cipher.AEAD
+	aad    []byte
+	chunk  []byte
+	plain  []byte
+	index  uint64
+	done   bool
+}
+
+// newDecryptingReader reads the encryption prologue from reader, and returns a reader decrypting from it.
+func newDecryptingReader(reader io.Reader, keys KeyProvider, aad []byte) (io.ReadCloser, error) {
+	if keys == nil {
+		return nil, errors.Join(ErrTampered, errNoKey)
+	}
+
+	buffered, ok := reader.(*bufio.Reader)
+	if !ok {
+		buffered = bufio.NewReader(reader)
+	}
+
+	size, err := buffered.ReadByte()
+	if err != nil {
+		return nil, errors.Join(ErrTampered, err)
+	}
+
+	prologue := make([]byte, int(size)+cipherSaltSize)
+	if _, err = io.ReadFull(buffered, prologue); err != nil {
+		return nil, errors.Join(ErrTampered, err)
+	}
+
+	id := string(prologue[:size])
+
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newEntryCipher(key, prologue[size:], id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		reader: buffered,
+		aead:   aead,
+		aad:    aad,
+		chunk:  make([]byte, cipherChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (reader *decryptingReader) Read(data []byte) (int, error) {
+	for len(reader.plain) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+
+		if err := reader.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(data, reader.plain)
+	reader.plain = reader.plain[n:]
+
+	return n, nil
+}
+
+func (reader *decryptingReader) open() error {
+	n, err := io.ReadFull(reader.reader, reader.chunk)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	// A short chunk, or a full one with nothing after, is the last one.
+	last := n < len(reader.chunk)
+	if !last {
+		if _, err = reader.reader.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		}
+	}
+
+	plain, err := reader.aead.Open(
+		reader.chunk[:0],
+		chunkNonce(reader.aead, reader.index, last),
+		reader.chunk[:n],
+		reader.aad,
+	)
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, ErrTampered)
+	}
+
+	reader.plain = plain
+	reader.index++
+	reader.done = last
+
+	return nil
+}
+
+func (*decryptingReader) Close() error {
+	return nil
+}
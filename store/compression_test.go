@@ -0,0 +1,161 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+)
+
+func entryFile(base, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	key := hex.EncodeToString(sum[:])
+
+	return filepath.Join(base, key, key)
+}
+
+func TestStoreCompression(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	value := strings.Repeat(`{"key": "value"}`, 4096)
+
+	plain := store.New(&store.Options{Path: base})
+	compressed := store.New(&store.Options{Path: base, Compress: true})
+
+	assert.NilError(t, plain.Write("plain", []byte(value)))
+	assert.NilError(t, compressed.Write("compressed", []byte(value)))
+	assert.NilError(t, compressed.Update(func(tx *store.Tx) error {
+		return tx.Write("transaction", []byte(value))
+	}))
+
+	for _, name := range []string{"compressed", "transaction"} {
+		info, err := os.Stat(entryFile(base, name))
+		assert.NilError(t, err)
+		assert.Assert(t, info.Size() < int64(len(value))/10, "%s must be compressed", name)
+	}
+
+	// Both stores read everything, regardless of how it was written.
+	for _, st := range []*store.Store{plain, compressed} {
+		for _, name := range []string{"plain", "compressed", "transaction"} {
+			content, err := st.Read(name)
+			assert.NilError(t, err)
+			assert.Equal(t, string(content), value)
+		}
+	}
+
+	writer, err := compressed.Writer("stream")
+	assert.NilError(t, err)
+
+	for range 4 {
+		_, err = writer.Write([]byte(value))
+		assert.NilError(t, err)
+	}
+
+	assert.NilError(t, writer.Close())
+
+	reader, err := plain.Reader("stream")
+	assert.NilError(t, err)
+
+	content, err := io.ReadAll(reader)
+	assert.NilError(t, err)
+	assert.NilError(t, reader.Close())
+	assert.Equal(t, string(content), strings.Repeat(value, 4))
+
+	// Sizes are those of the values, not of their compressed form.
+	entries, err := plain.List("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 4)
+
+	for _, entry := range entries {
+		if entry.Name == "stream" {
+			assert.Equal(t, entry.Size, int64(len(value)*4))
+		} else {
+			assert.Equal(t, entry.Size, int64(len(value)), entry.Name)
+		}
+	}
+}
+
+func TestStoreCompressionContentAddressable(t *testing.T) {
+	t.Parallel()
+
+	st := store.New(&store.Options{Path: t.TempDir(), Compress: true, ContentAddressable: true})
+	value := strings.Repeat("value", 1024)
+
+	assert.NilError(t, st.Write("one", []byte(value)))
+	assert.NilError(t, st.Update(func(tx *store.Tx) error {
+		return tx.Write("two", []byte(value))
+	}))
+
+	for _, name := range []string{"one", "two"} {
+		content, err := st.Read(name)
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), value)
+	}
+
+	reader, err := st.Reader("two")
+	assert.NilError(t, err)
+
+	content, err := io.ReadAll(reader)
+	assert.NilError(t, err)
+	assert.NilError(t, reader.Close())
+	assert.Equal(t, string(content), value)
+}
+
+func TestStoreCompressionDeclaredSize(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	st := store.New(&store.Options{Path: base, Compress: true})
+	value := strings.Repeat("value", 4096)
+
+	writer, err := st.WriterWithMetadata("stream", &store.Metadata{Size: int64(len(value))})
+	assert.NilError(t, err)
+	_, err = writer.Write([]byte(value))
+	assert.NilError(t, err)
+	assert.NilError(t, writer.Close())
+
+	// The declared size is recorded: listing does not decode the (here corrupted) value to measure it.
+	info, err := os.Stat(entryFile(base, "stream"))
+	assert.NilError(t, err)
+	assert.NilError(t, os.Truncate(entryFile(base, "stream"), info.Size()-8))
+
+	entries, err := st.List("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Size, int64(len(value)))
+
+	// Streams that do not match their declared size are discarded.
+	writer, err = st.WriterWithMetadata("mismatch", &store.Metadata{Size: 1})
+	assert.NilError(t, err)
+	_, err = writer.Write([]byte(value))
+	assert.NilError(t, err)
+	assert.ErrorIs(t, writer.Close(), store.ErrFileStoreFail)
+
+	_, err = st.Read("mismatch")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
@@ -19,4 +19,11 @@ package store
 const (
 	defaultStoreDir  = "go-core"
 	defaultCacheSize = 1024 * 1024
+
+	tempDirName     = ".tmp"
+	blobsDirName    = ".blobs"
+	journalFileName = ".journal"
+	usageFileName   = ".usage"
+	// stagedNameSize is the number of random bytes staged values are named after.
+	stagedNameSize = 16
 )
@@ -14,5 +14,5 @@
    limitations under the License.
 */
 
-// Package store provides a safe filesystem based simple storage solution.
+// Package store provides a safe and simple storage solution, filesystem based by default (see Backend).
 package store
@@ -0,0 +1,189 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+// KeySize is the size of encryption keys, in bytes.
+const KeySize = 32
+
+// KeyProvider supplies the keys values are encrypted with.
+// Keys are identified so that entries encrypted with older keys remain readable, until they are re-encrypted by
+// RotateKey.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new values with, and its identifier (up to 255 bytes).
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given identifier.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKey returns a KeyProvider for a single key, identified by a digest of the key itself.
+func StaticKey(key []byte) KeyProvider {
+	sum := sha256.Sum256(key)
+
+	return &staticKey{id: hex.EncodeToString(sum[:8]), key: key}
+}
+
+type staticKey struct {
+	id  string
+	key []byte
+}
+
+func (provider *staticKey) CurrentKey() (string, []byte, error) {
+	return provider.id, provider.key, nil
+}
+
+func (provider *staticKey) Key(id string) ([]byte, error) {
+	if id != provider.id {
+		return nil, errUnknownKey
+	}
+
+	return provider.key, nil
+}
+
+// RotateKey re-encrypts every entry (expired ones included) with the current key of provider, then uses provider for
+// all subsequent operations. It returns how many entries (and blobs) were rewritten.
+// Entries must be readable with the keys in use before the call. Unencrypted entries are encrypted as well, so this is
+// also how encryption is enabled on an existing store - and a nil provider decrypts the store instead.
+// All entries are rewritten atomically, while holding the write lock.
+func (st *Store) RotateKey(provider KeyProvider) (count int, err error) {
+	if st.lock == nil {
+		err = st.WriteLock()
+		if err != nil {
+			return 0, err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	previous := &entryCodec{compress: st.codec.compress, keys: st.codec.keys, permissive: true}
+	next := &entryCodec{compress: st.codec.compress, keys: provider}
+
+	trx := &Tx{
+		store: st,
+		byKey: map[string]*txOp{},
+	}
+
+	keys := []string{}
+
+	err = st.walkEntries(func(key string) error {
+		keys = append(keys, key)
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err = st.walkBlobs(func(digest string) error {
+		keys = append(keys, blobKey(digest))
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		staged, err := st.reencode(key, previous, next)
+		if err != nil {
+			return 0, errors.Join(ErrFileStoreFail, err, trx.rollback())
+		}
+
+		op := &txOp{Key: key, Staged: staged}
+		if digest, ok := strings.CutPrefix(key, blobKey("")); ok {
+			op = &txOp{Key: digest, Staged: staged, Blob: true}
+		}
+
+		if err = trx.record(op); err != nil {
+			return 0, errors.Join(err, trx.rollback())
+		}
+	}
+
+	if err = trx.commit(); err != nil {
+		return 0, err
+	}
+
+	st.codec = next
+
+	return len(trx.ops), nil
+}
+
+// reencode stages the value stored under key (an entry or a blob), decoded with previous and encoded again with next.
+func (st *Store) reencode(key string, previous, next *entryCodec) (string, error) {
+	file, err := openValue(st.backend, key)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	meta, payload, err := previous.newReader(file)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		_ = payload.Close()
+	}()
+
+	if meta == nil {
+		info, err := statValue(st.backend, key)
+		if err != nil {
+			return "", err
+		}
+
+		meta = &Metadata{Modified: info.Modified}
+	}
+
+	pending, err := createValue(st.backend)
+	if err != nil {
+		return "", err
+	}
+
+	// Entries referring to a blob have no payload.
+	writer, err := next.newWriter(pending, meta, next.flags(meta.Digest != ""))
+	if err == nil {
+		_, err = io.Copy(writer, payload)
+	}
+
+	if err == nil {
+		err = writer.Close()
+	}
+
+	if err != nil {
+		return "", errors.Join(err, pending.Discard())
+	}
+
+	staged, err := newStagedName()
+	if err != nil {
+		return "", errors.Join(err, pending.Discard())
+	}
+
+	return staged, pending.Commit(stagedKey(staged))
+}
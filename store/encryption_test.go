@@ -0,0 +1,189 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+)
+
+func TestStoreEncryption(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	key := bytes.Repeat([]byte{1}, store.KeySize)
+	st := store.New(&store.Options{Path: base, EncryptionKey: key})
+
+	// Sizes around the chunk size, to exercise empty and exactly full last chunks.
+	values := map[string]string{
+		"empty":  "",
+		"small":  "secret token",
+		"chunk":  strings.Repeat("s", 64*1024),
+		"chunks": strings.Repeat("secret", 64*1024),
+	}
+
+	for name, value := range values {
+		assert.NilError(t, st.Write(name, []byte(value)))
+
+		data, err := os.ReadFile(entryFile(base, name))
+		assert.NilError(t, err)
+		assert.Assert(t, value == "" || !bytes.Contains(data, []byte(value[:6])), "%s must be encrypted", name)
+	}
+
+	assert.NilError(t, st.Update(func(tx *store.Tx) error {
+		return tx.Write("transaction", []byte("secret"))
+	}))
+
+	values["transaction"] = "secret"
+
+	for name, value := range values {
+		content, err := st.Read(name)
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), value, name)
+
+		reader, err := st.Reader(name)
+		assert.NilError(t, err)
+
+		content, err = io.ReadAll(reader)
+		assert.NilError(t, err)
+		assert.NilError(t, reader.Close())
+		assert.Equal(t, string(content), value, name)
+	}
+
+	entries, err := st.List("")
+	assert.NilError(t, err)
+
+	for _, entry := range entries {
+		assert.Equal(t, entry.Size, int64(len(values[entry.Name])), entry.Name)
+	}
+
+	// A different key cannot read anything.
+	other := store.New(&store.Options{Path: base, EncryptionKey: bytes.Repeat([]byte{2}, store.KeySize)})
+	_, err = other.Read("small")
+	assert.Assert(t, err != nil)
+
+	// Neither can a store without encryption.
+	plain := store.New(&store.Options{Path: base})
+	_, err = plain.Read("small")
+	assert.Assert(t, err != nil)
+}
+
+func TestStoreEncryptionTampering(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	key := bytes.Repeat([]byte{1}, store.KeySize)
+	st := store.New(&store.Options{Path: base, EncryptionKey: key})
+	value := strings.Repeat("secret", 64*1024)
+
+	tamper := map[string]func(data []byte) []byte{
+		"payload": func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+
+			return data
+		},
+		"metadata": func(data []byte) []byte {
+			return bytes.Replace(data, []byte(`"name":"metadata"`), []byte(`"name":"metadatb"`), 1)
+		},
+		"truncated": func(data []byte) []byte {
+			return data[:len(data)-1024]
+		},
+		"plaintext": func([]byte) []byte {
+			return []byte(value)
+		},
+	}
+
+	for name, function := range tamper {
+		assert.NilError(t, st.Write(name, []byte(value)))
+
+		path := entryFile(base, name)
+		data, err := os.ReadFile(path)
+		assert.NilError(t, err)
+		assert.NilError(t, os.WriteFile(path, function(data), 0o600))
+
+		_, err = st.Read(name)
+		assert.ErrorIs(t, err, store.ErrTampered, name)
+
+		reader, err := st.Reader(name)
+		if err == nil {
+			_, err = io.ReadAll(reader)
+			assert.NilError(t, reader.Close())
+		}
+
+		assert.ErrorIs(t, err, store.ErrTampered, name)
+	}
+}
+
+func TestStoreRotateKey(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	first := bytes.Repeat([]byte{1}, store.KeySize)
+	second := bytes.Repeat([]byte{2}, store.KeySize)
+
+	plain := store.New(&store.Options{Path: base, ContentAddressable: true, Compress: true})
+	assert.NilError(t, plain.Write("one", []byte("one")))
+	assert.NilError(t, plain.Write("two", []byte("two")))
+
+	// Enable encryption.
+	count, err := plain.RotateKey(store.StaticKey(first))
+	assert.NilError(t, err)
+	assert.Equal(t, count, 4, "two entries and two blobs")
+
+	_, err = store.New(&store.Options{Path: base}).Read("one")
+	assert.ErrorIs(t, err, store.ErrTampered)
+
+	encrypted := store.New(&store.Options{Path: base, EncryptionKey: first})
+	content, err := encrypted.Read("one")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "one")
+
+	// The rotating store keeps working with the new key.
+	assert.NilError(t, plain.Write("three", []byte("three")))
+
+	content, err = encrypted.Read("three")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "three")
+
+	_, err = encrypted.RotateKey(store.StaticKey(second))
+	assert.NilError(t, err)
+
+	_, err = store.New(&store.Options{Path: base, EncryptionKey: first}).Read("two")
+	assert.Assert(t, err != nil)
+
+	for _, name := range []string{"one", "two", "three"} {
+		content, err = store.New(&store.Options{Path: base, EncryptionKey: second}).Read(name)
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), name)
+	}
+
+	// Decrypt.
+	_, err = encrypted.RotateKey(nil)
+	assert.NilError(t, err)
+
+	content, err = store.New(&store.Options{Path: base}).Read("two")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "two")
+}
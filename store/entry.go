@@ -0,0 +1,326 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"go.farcloser.world/core/compression/zstd"
+)
+
+// Entries are stored on disk as:
+//
+//	magic (4 bytes) | version (1 byte) | flags (1 byte) | header length (4 bytes, big endian) | header | payload
+//
+// The header is the JSON encoded Metadata, and flags describe how the payload is encoded (compressed, encrypted).
+// Payloads are compressed first, then encrypted.
+// Files that do not start with the magic are entries written by older versions, and are read as a raw payload without
+// metadata.
+
+const (
+	entryMagic      = "\x00gcs"
+	entryVersion    = 1
+	entryPrefixSize = len(entryMagic) + 1 + 1 + 4
+	// Headers are small - anything above this is corruption.
+	entryHeaderMaxSize = 1024 * 1024
+
+	// entryFlagZstd marks a zstd compressed payload.
+	entryFlagZstd byte = 1 << 0
+	// entryFlagEncrypted marks an encrypted payload (see cipher.go).
+	entryFlagEncrypted byte = 1 << 1
+	// entryFlagsKnown lists every flag this version understands. Entries with any other flag are rejected.
+	entryFlagsKnown = entryFlagZstd | entryFlagEncrypted
+)
+
+// Metadata is stored alongside each entry.
+type Metadata struct {
+	// Name is the name the entry was written under.
+	Name string `json:"name,omitempty"`
+	// Size is the size of the value, in bytes, recorded by the store so that entries can be listed without decoding
+	// their value. It is zero when unknown (for entries written by older versions, or streamed without declaring it, see
+	// WriterWithMetadata).
+	Size int64 `json:"size,omitempty"`
+	// Created is set when the entry is first written, and preserved when it is overwritten.
+	Created time.Time `json:"created"`
+	// Modified is set every time the entry is written.
+	Modified time.Time `json:"modified"`
+	// Expires, if set, is when the entry stops being readable. Expired entries are reclaimed by Prune.
+	Expires time.Time `json:"expires,omitzero"`
+	// ContentType is an optional, free-form description of the value format.
+	ContentType string `json:"contentType,omitempty"`
+	// Labels are optional, user-defined key-value pairs.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Digest is set by the store for entries that refer to a content-addressed blob.
+	Digest string `json:"digest,omitempty"`
+}
+
+// Expired tells whether the entry is expired at the given time.
+func (meta *Metadata) Expired(now time.Time) bool {
+	return !meta.Expires.IsZero() && !now.Before(meta.Expires)
+}
+
+// entryHeader is what precedes the payload of an entry.
+type entryHeader struct {
+	meta  *Metadata
+	flags byte
+	// raw is the header as stored, which encrypted payloads are bound to.
+	raw []byte
+}
+
+// entryCodec encodes and decodes entries, as per the store options.
+type entryCodec struct {
+	compress bool
+	// keys is nil unless encryption is enabled.
+	keys KeyProvider
+	// permissive allows reading unencrypted entries while encryption is enabled, so that they can be encrypted.
+	permissive bool
+}
+
+// flags returns the flags an entry is written with. Empty payloads are never compressed.
+func (cdc *entryCodec) flags(empty bool) byte {
+	var flags byte
+
+	if cdc.compress && !empty {
+		flags |= entryFlagZstd
+	}
+
+	if cdc.keys != nil {
+		flags |= entryFlagEncrypted
+	}
+
+	return flags
+}
+
+// newWriter writes the entry header to writer, and returns a writer for the payload, encoded as per flags.
+// Closing the returned writer flushes the payload, but does not close the underlying writer.
+func (cdc *entryCodec) newWriter(writer io.Writer, meta *Metadata, flags byte) (io.WriteCloser, error) {
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, entryPrefixSize, entryPrefixSize+len(header))
+	copy(prefix, entryMagic)
+	prefix[len(entryMagic)] = entryVersion
+	prefix[len(entryMagic)+1] = flags
+	//nolint:gosec
+	binary.BigEndian.PutUint32(prefix[len(entryMagic)+2:], uint32(len(header)))
+
+	raw := append(prefix, header...)
+	if _, err = writer.Write(raw); err != nil {
+		return nil, err
+	}
+
+	payload := io.WriteCloser(nopWriteCloser{writer})
+
+	if flags&entryFlagEncrypted != 0 {
+		if payload, err = newEncryptingWriter(writer, cdc.keys, raw); err != nil {
+			return nil, err
+		}
+	}
+
+	if flags&entryFlagZstd != 0 {
+		encoder, err := zstd.NewWriter(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		payload = &stackedWriteCloser{WriteCloser: encoder, next: payload}
+	}
+
+	return payload, nil
+}
+
+// newReader reads the entry header from reader, and returns a reader for the decoded payload, which must be closed
+// once done with. Closing it does not close the underlying reader.
+// Metadata is nil for entries written by older versions, in which case the payload is the whole content.
+func (cdc *entryCodec) newReader(reader io.Reader) (*Metadata, io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+
+	prefix, err := buffered.Peek(len(entryMagic))
+	if err != nil || string(prefix) != entryMagic {
+		if cdc.keys != nil && !cdc.permissive {
+			return nil, nil, errors.Join(ErrTampered, errNotEncrypted)
+		}
+
+		//nolint:nilerr
+		return nil, io.NopCloser(buffered), nil
+	}
+
+	header, found, err := readEntryHeader(buffered)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The magic is there, but not the rest of the header: the entry was cut short.
+	if !found {
+		return nil, nil, errCorruptEntry
+	}
+
+	payload, err := cdc.newPayloadReader(buffered, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header.meta, payload, nil
+}
+
+// newPayloadReader returns a reader decoding a payload encoded as per the header flags.
+func (cdc *entryCodec) newPayloadReader(reader io.Reader, header *entryHeader) (io.ReadCloser, error) {
+	payload := io.NopCloser(reader)
+
+	switch {
+	case header.flags&entryFlagEncrypted != 0:
+		decrypting, err := newDecryptingReader(reader, cdc.keys, header.raw)
+		if err != nil {
+			return nil, err
+		}
+
+		payload = decrypting
+	case cdc.keys != nil && !cdc.permissive:
+		return nil, errors.Join(ErrTampered, errNotEncrypted)
+	}
+
+	if header.flags&entryFlagZstd != 0 {
+		decoder, err := zstd.NewReader(payload, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Join(errCorruptEntry, err)
+		}
+
+		payload = decoder.IOReadCloser()
+	}
+
+	return payload, nil
+}
+
+// encode encodes an entry in memory.
+func (cdc *entryCodec) encode(meta *Metadata, payload []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	writer, err := cdc.newWriter(buf, meta, cdc.flags(len(payload) == 0))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = writer.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decode splits raw entry data into its metadata and its decoded payload.
+// Metadata is nil for entries written by older versions.
+func (cdc *entryCodec) decode(data []byte) (*Metadata, []byte, error) {
+	meta, reader, err := cdc.newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if meta == nil {
+		return nil, data, nil
+	}
+
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		if !errors.Is(err, ErrTampered) {
+			err = errors.Join(errCorruptEntry, err)
+		}
+
+		return nil, nil, errors.Join(err, reader.Close())
+	}
+
+	if err = reader.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	return meta, payload, nil
+}
+
+// readEntryHeader reads the header from the beginning of an entry, leaving reader at the start of the payload.
+// found is false for entries written by older versions, in which case the reader position is undefined.
+func readEntryHeader(reader io.Reader) (header *entryHeader, found bool, err error) {
+	prefix := make([]byte, entryPrefixSize)
+
+	_, err = io.ReadFull(reader, prefix)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	if string(prefix[:len(entryMagic)]) != entryMagic {
+		return nil, false, nil
+	}
+
+	version, flags := prefix[len(entryMagic)], prefix[len(entryMagic)+1]
+	if version != entryVersion || flags&^entryFlagsKnown != 0 {
+		return nil, false, errUnsupportedEntry
+	}
+
+	size := binary.BigEndian.Uint32(prefix[len(entryMagic)+2:])
+	if size > entryHeaderMaxSize {
+		return nil, false, errCorruptEntry
+	}
+
+	data := make([]byte, size)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return nil, false, errors.Join(errCorruptEntry, err)
+	}
+
+	header = &entryHeader{meta: &Metadata{}, flags: flags, raw: append(prefix, data...)}
+	if err = json.Unmarshal(data, header.meta); err != nil {
+		return nil, false, errors.Join(errCorruptEntry, err)
+	}
+
+	return header, true, nil
+}
+
+// stackedWriteCloser closes the next writer in the stack after itself.
+type stackedWriteCloser struct {
+	io.WriteCloser
+
+	next io.Closer
+}
+
+func (writer *stackedWriteCloser) Close() error {
+	if err := writer.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	return writer.next.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
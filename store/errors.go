@@ -16,7 +16,44 @@
 
 package store
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"os"
+)
 
-// ErrFileStoreFail indicates that a file store operation has failed.
-var ErrFileStoreFail = errors.New("file store operation failed")
+var (
+	// ErrFileStoreFail indicates that a file store operation has failed.
+	ErrFileStoreFail = errors.New("file store operation failed")
+	// ErrIntegrityCheckFail indicates that a value does not match the digest it is stored under.
+	ErrIntegrityCheckFail = errors.New("integrity check failed")
+	// ErrTampered indicates that an encrypted value failed authentication: it has been modified, or it is not
+	// encrypted while encryption is enabled.
+	ErrTampered = errors.New("value failed authentication")
+	// ErrNotFound indicates that there is no entry with the given name (or key), or that it has expired.
+	// It matches os.ErrNotExist as well.
+	ErrNotFound = fmt.Errorf("entry not found: %w", os.ErrNotExist)
+
+	errTxClosed          = errors.New("transaction is closed")
+	errCorruptJournal    = errors.New("transaction journal is corrupt")
+	errCorruptEntry      = errors.New("entry is corrupt")
+	errUnsupportedEntry  = errors.New("entry format is not supported")
+	errEntryExpired      = errors.New("entry has expired")
+	errNotEncrypted      = errors.New("entry is not encrypted")
+	errNoKey             = errors.New("entry is encrypted, but no key was provided")
+	errUnknownKey        = errors.New("unknown encryption key")
+	errInvalidKey        = errors.New("invalid encryption key")
+	errInvalidBackendKey = errors.New("key is not supported by the backend")
+	errCorruptLog        = errors.New("log is corrupt")
+	errInvalidArchive    = errors.New("archive is not a valid store export")
+	errSizeMismatch      = errors.New("value does not have the declared size")
+)
+
+// notFound adds ErrNotFound to err, if it tells that an entry does not exist.
+func notFound(err error) error {
+	if errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrNotFound) {
+		return errors.Join(ErrNotFound, err)
+	}
+
+	return err
+}
@@ -0,0 +1,302 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The last use of an entry is recorded by the backend (see Stater) - with the default backend, as the access time of its
+// file.
+// Once a write brings the store over MaxDiskSize, entries are evicted least recently used first - expired ones before
+// anything else - until it fits again. Eviction happens while still holding the write lock taken for the write.
+// The disk usage of the store is measured by the first write, then kept in the store itself as a running total (under
+// ".usage"), which every process holding the write lock reads once locked, updates as it writes and deletes, and saves
+// before unlocking. Processes that cannot keep it up to date remove it, for the next write to measure the store again.
+
+// diskUsage is the running total of the size of entries and blobs. It is guarded by the write lock.
+type diskUsage struct {
+	known   bool
+	changed bool
+	total   int64
+}
+
+// loadUsage reads the disk usage saved in the store. It must be called once the write lock is taken.
+func (st *Store) loadUsage() {
+	st.usage = diskUsage{}
+
+	data, err := st.backend.Read(usageFileName)
+	if err != nil {
+		return
+	}
+
+	total, err := strconv.ParseInt(string(data), 10, 64)
+	if err == nil && total >= 0 {
+		st.usage = diskUsage{known: true, total: total}
+	}
+}
+
+// saveUsage saves the disk usage in the store, if it has changed, or removes it if it is not known anymore. It must be
+// called before releasing the write lock.
+func (st *Store) saveUsage() error {
+	if !st.usage.changed {
+		return nil
+	}
+
+	st.usage.changed = false
+
+	if st.usage.known {
+		err := st.backend.Write(usageFileName, []byte(strconv.FormatInt(st.usage.total, 10)))
+		if err == nil {
+			return nil
+		}
+
+		// A stale total is worse than none.
+		return errors.Join(ErrFileStoreFail, err, ignoreNotExist(st.backend.Delete(usageFileName)))
+	}
+
+	if err := ignoreNotExist(st.backend.Delete(usageFileName)); err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	return nil
+}
+
+// touch records that the entry stored under key has just been used.
+func (st *Store) touch(key string) {
+	if stater, ok := st.backend.(Stater); ok {
+		// Best effort: failing to record a use only makes the entry more likely to be evicted.
+		_ = stater.Touch(key)
+	}
+}
+
+// tracked calls change, which writes or deletes the value stored under key, and updates the disk usage accordingly.
+// It must be called while holding the write lock.
+func (st *Store) tracked(key string, change func() error) error {
+	if !isEntryKey(key) && !strings.HasPrefix(key, blobKey("")) {
+		return change()
+	}
+
+	st.usage.changed = true
+
+	if !st.usage.known {
+		return change()
+	}
+
+	before, measured := st.sizeOf(key)
+	err := change()
+	after, remeasured := st.sizeOf(key)
+
+	// The total is measured again by the next write if anything went wrong.
+	st.usage.total += after - before
+	st.usage.known = measured && remeasured
+
+	return err
+}
+
+// deleteValue deletes the value stored under key, as per tracked.
+func (st *Store) deleteValue(key string) error {
+	return st.tracked(key, func() error {
+		return st.backend.Delete(key)
+	})
+}
+
+// sizeOf returns the size of the value stored under key, zero if there is none, and whether it could be measured.
+func (st *Store) sizeOf(key string) (int64, bool) {
+	info, err := statValue(st.backend, key)
+	if err != nil {
+		return 0, errors.Is(err, os.ErrNotExist)
+	}
+
+	return info.Size, true
+}
+
+type evictable struct {
+	key    string
+	size   int64
+	used   time.Time
+	digest string
+}
+
+// evict removes least recently used entries until the store fits in MaxDiskSize, sparing the protected keys.
+// Blobs are removed once no entry refers to them anymore.
+// It must be called while holding the write lock.
+func (st *Store) evict(protected ...string) error {
+	if st.maxDiskSize <= 0 || (st.usage.known && st.usage.total <= st.maxDiskSize) {
+		return nil
+	}
+
+	// Until measured again in full, the total is unknown.
+	st.usage = diskUsage{changed: true}
+
+	var total int64
+
+	now := time.Now()
+	entries := []*evictable{}
+	references := map[string]int{}
+
+	err := st.walkEntries(func(key string) error {
+		entry, err := st.statEvictable(key, now)
+		if err != nil {
+			return err
+		}
+
+		total += entry.size
+		if entry.digest != "" {
+			references[entry.digest]++
+		}
+
+		if !slices.Contains(protected, key) {
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	blobs := map[string]int64{}
+	unreferenced := []string{}
+
+	err = st.walkBlobs(func(digest string) error {
+		info, err := statValue(st.backend, blobKey(digest))
+		if err != nil {
+			return errors.Join(ErrFileStoreFail, err)
+		}
+
+		total += info.Size
+		blobs[digest] = info.Size
+
+		if references[digest] == 0 {
+			unreferenced = append(unreferenced, digest)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	total, err = st.evictFrom(total, entries, references, blobs, unreferenced)
+	if err != nil {
+		return err
+	}
+
+	st.usage = diskUsage{known: true, changed: true, total: total}
+
+	return nil
+}
+
+// evictFrom removes unreferenced blobs, then entries least recently used first, until total fits in MaxDiskSize. It
+// returns what is left of total.
+func (st *Store) evictFrom(
+	total int64,
+	entries []*evictable,
+	references map[string]int,
+	blobs map[string]int64,
+	unreferenced []string,
+) (int64, error) {
+	// Blobs nothing refers to are garbage: they go first.
+	for _, digest := range unreferenced {
+		if total <= st.maxDiskSize {
+			return total, nil
+		}
+
+		if err := st.backend.Delete(blobKey(digest)); err != nil {
+			return total, errors.Join(ErrFileStoreFail, err)
+		}
+
+		total -= blobs[digest]
+	}
+
+	slices.SortFunc(entries, func(a, b *evictable) int {
+		return a.used.Compare(b.used)
+	})
+
+	for _, entry := range entries {
+		if total <= st.maxDiskSize {
+			return total, nil
+		}
+
+		if err := st.backend.Delete(entry.key); err != nil {
+			return total, errors.Join(ErrFileStoreFail, err)
+		}
+
+		total -= entry.size
+
+		if entry.digest == "" {
+			continue
+		}
+
+		if references[entry.digest]--; references[entry.digest] > 0 {
+			continue
+		}
+
+		if err := st.backend.Delete(blobKey(entry.digest)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return total, errors.Join(ErrFileStoreFail, err)
+		}
+
+		total -= blobs[entry.digest]
+	}
+
+	return total, nil
+}
+
+// statEvictable describes the entry stored under key for eviction purposes, statting its value once, and only reading
+// its header. Expired entries are reported as never used.
+func (st *Store) statEvictable(key string, now time.Time) (*evictable, error) {
+	info, err := statValue(st.backend, key)
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	file, err := openValue(st.backend, key)
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	header, found, err := readEntryHeader(file)
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	evict := &evictable{
+		key:  key,
+		size: info.Size,
+		used: info.Accessed,
+	}
+
+	if found {
+		evict.digest = header.meta.Digest
+
+		if header.meta.Expired(now) {
+			evict.used = time.Time{}
+		}
+	}
+
+	return evict, nil
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+	"go.farcloser.world/core/units"
+)
+
+func TestStoreEviction(t *testing.T) {
+	t.Parallel()
+
+	// Room for three entries, headers included.
+	value := []byte(strings.Repeat("v", 1000))
+	st := store.New(&store.Options{Path: t.TempDir(), MaxDiskSize: 3500})
+
+	for _, name := range []string{"a", "b", "c"} {
+		assert.NilError(t, st.Write(name, value))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Reading "a" makes "b" the least recently used.
+	_, err := st.Read("a")
+	assert.NilError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	assert.NilError(t, st.Write("d", value))
+
+	for name, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		has, err := st.Has(name)
+		assert.NilError(t, err)
+		assert.Equal(t, has, expected, name)
+	}
+
+	// Expired entries go first.
+	assert.NilError(t, st.WriteWithMetadata("e", value, &store.Metadata{Expires: time.Now().Add(50 * time.Millisecond)}))
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NilError(t, st.Update(func(tx *store.Tx) error {
+		return tx.Write("f", value)
+	}))
+
+	for name, expected := range map[string]bool{"a": true, "c": false, "d": true, "f": true} {
+		has, err := st.Has(name)
+		assert.NilError(t, err)
+		assert.Equal(t, has, expected, name)
+	}
+
+	// A single entry larger than the limit is kept, as it has just been written.
+	assert.NilError(t, st.Write("big", []byte(strings.Repeat("v", 5000))))
+
+	entries, err := st.List("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Name, "big")
+}
+
+func TestStoreEvictionContentAddressable(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	st := store.New(&store.Options{Path: base, MaxDiskSize: 3000, ContentAddressable: true})
+
+	assert.NilError(t, st.Write("one", []byte(strings.Repeat("1", 1000))))
+	assert.NilError(t, st.Write("also-one", []byte(strings.Repeat("1", 1000))))
+	time.Sleep(10 * time.Millisecond)
+	assert.NilError(t, st.Write("two", []byte(strings.Repeat("2", 1000))))
+	time.Sleep(10 * time.Millisecond)
+	assert.NilError(t, st.Write("three", []byte(strings.Repeat("3", 1000))))
+
+	// Both references to the oldest blob are gone, along with the blob.
+	entries, err := st.List("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 2)
+
+	blobs, err := os.ReadDir(base + "/.blobs")
+	assert.NilError(t, err)
+	assert.Equal(t, len(blobs), 2)
+}
+
+// countingBackend counts the walks over its keys.
+type countingBackend struct {
+	*store.MemoryBackend
+
+	walks int
+}
+
+func (backend *countingBackend) Keys(prefix string, function func(key string) error) error {
+	backend.walks++
+
+	return backend.MemoryBackend.Keys(prefix, function)
+}
+
+func TestStoreEvictionRunningTotal(t *testing.T) {
+	t.Parallel()
+
+	backend := &countingBackend{MemoryBackend: store.NewMemoryBackend()}
+	st := store.New(&store.Options{Backend: backend, MaxDiskSize: 3500})
+	value := []byte(strings.Repeat("v", 1000))
+
+	// The store is measured once, by the first write.
+	assert.NilError(t, st.Write("a", value))
+	walks := backend.walks
+
+	assert.NilError(t, st.Write("b", value))
+	assert.NilError(t, st.Write("a", value))
+	assert.NilError(t, st.Delete("b"))
+	assert.NilError(t, st.Write("c", value))
+	assert.NilError(t, st.Write("d", value))
+	assert.Equal(t, backend.walks, walks)
+
+	// Deletions are accounted for: going over the limit only takes one more entry.
+	assert.NilError(t, st.Write("e", value))
+	assert.Equal(t, backend.walks, walks+2)
+
+	has, err := st.Has("a")
+	assert.NilError(t, err)
+	assert.Equal(t, has, false)
+}
+
+func TestStoreEvictionAcrossProcesses(t *testing.T) {
+	t.Parallel()
+
+	// Stores sharing a directory behave as separate processes would.
+	base := t.TempDir()
+	stores := []*store.Store{
+		store.New(&store.Options{Path: base, MaxDiskSize: 3500}),
+		store.New(&store.Options{Path: base, MaxDiskSize: 3500}),
+	}
+	value := []byte(strings.Repeat("v", 1000))
+
+	for index, name := range []string{"a", "b", "c", "d", "e"} {
+		assert.NilError(t, stores[index%2].Write(name, value))
+	}
+
+	entries, err := stores[0].List("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 3)
+}
+
+func TestStoreOptionsJSON(t *testing.T) {
+	t.Parallel()
+
+	options := &store.Options{CacheSize: 42}
+
+	err := json.Unmarshal([]byte(`{"path": "cache", "maxDiskSize": "2g", "ttl": 1000, "compress": true}`), options)
+	assert.NilError(t, err)
+	assert.Equal(t, options.Path, "cache")
+	assert.Equal(t, options.CacheSize, int64(42))
+	assert.Equal(t, options.MaxDiskSize, int64(2*1024*1024*1024))
+	assert.Equal(t, options.TTL, time.Microsecond)
+	assert.Assert(t, options.Compress)
+
+	assert.NilError(t, json.Unmarshal([]byte(`{"cacheSize": 1024, "maxDiskSize": "64MiB"}`), options))
+	assert.Equal(t, options.CacheSize, int64(1024))
+	assert.Equal(t, options.MaxDiskSize, int64(64*1024*1024))
+
+	err = json.Unmarshal([]byte(`{"maxDiskSize": "lots"}`), options)
+	assert.ErrorIs(t, err, units.ErrInvalidSize)
+}
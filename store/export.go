@@ -0,0 +1,320 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"go.farcloser.world/core/compression/zstd"
+	"go.farcloser.world/core/filesystem"
+)
+
+// Exports are tar archives (PAX format), holding one regular file per entry, named after the entry, with its decoded
+// value as content. The metadata of the entry is recorded as JSON in a PAX record, so that it can be restored as is.
+// Entries without a name (written by older versions) are named after their key instead.
+// Archives are independent of the store options: values are exported decompressed and decrypted, and imported as per
+// the options of the importing store.
+// Files without the metadata record are imported as new entries, so that any tar archive of plain files can be
+// imported as well.
+
+// ImportMode tells how Import deals with the entries already in the store.
+type ImportMode int
+
+const (
+	// ImportMerge adds the entries of the archive to the store, replacing those with the same name, and keeping the
+	// others.
+	ImportMerge ImportMode = iota
+	// ImportOverwrite replaces the content of the store with the entries of the archive: entries missing from it are
+	// deleted.
+	ImportOverwrite
+)
+
+// Export writes every (non-expired) entry of the store to writer as a tar archive, while holding a read lock, so that
+// the archive is a consistent snapshot. It returns how many entries were exported.
+// Values are exported as plain text, even if the store is encrypted.
+func (st *Store) Export(writer io.Writer) (count int, err error) {
+	return st.export(writer, false)
+}
+
+// ExportCompressed is Export, with the archive compressed with zstd.
+func (st *Store) ExportCompressed(writer io.Writer) (count int, err error) {
+	return st.export(writer, true)
+}
+
+// Import reads an archive written by Export or ExportCompressed (compression is detected) from reader, and applies it
+// as per mode, atomically, while holding the write lock. It returns how many entries were imported.
+// Entries keep the metadata they had when exported, and are written as per the options of the store (compression,
+// encryption, content addressing). Expired entries are skipped.
+func (st *Store) Import(reader io.Reader, mode ImportMode) (count int, err error) {
+	buffered := bufio.NewReader(reader)
+
+	// Even empty archives have an end marker: no data at all is more likely a mistake, that would empty the store.
+	if _, err = buffered.Peek(1); err != nil {
+		return 0, errors.Join(ErrFileStoreFail, errInvalidArchive, err)
+	}
+
+	if magic, _ := buffered.Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		decoder, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return 0, errors.Join(ErrFileStoreFail, errInvalidArchive, err)
+		}
+
+		defer decoder.Close()
+
+		reader = decoder
+	} else {
+		reader = buffered
+	}
+
+	err = st.Update(func(tx *Tx) error {
+		imported, err := tx.importArchive(tar.NewReader(reader))
+		if err != nil {
+			return err
+		}
+
+		count = len(imported)
+
+		if mode != ImportOverwrite {
+			return nil
+		}
+
+		return tx.store.walkEntries(func(key string) error {
+			if imported[key] {
+				return nil
+			}
+
+			return tx.record(&txOp{Key: key, Delete: true})
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// zstdMagic starts every zstd frame.
+//
+//nolint:gochecknoglobals
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// exportMetadataRecord is the PAX record holding the metadata of an entry.
+const exportMetadataRecord = "FARCLOSER.store.metadata"
+
+func (st *Store) export(writer io.Writer, compress bool) (count int, err error) {
+	if st.lock == nil {
+		err = st.ReadOnlyLock()
+		if err != nil {
+			return 0, err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	if compress {
+		encoder, err := zstd.NewWriter(writer)
+		if err != nil {
+			return 0, errors.Join(ErrFileStoreFail, err)
+		}
+
+		defer func() {
+			err = errors.Join(err, encoder.Close())
+		}()
+
+		writer = encoder
+	}
+
+	archive := tar.NewWriter(writer)
+	now := time.Now()
+
+	err = st.walkEntries(func(key string) error {
+		exported, err := st.exportEntry(archive, key, now)
+		if exported {
+			count++
+		}
+
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err = archive.Close(); err != nil {
+		return 0, errors.Join(ErrFileStoreFail, err)
+	}
+
+	return count, nil
+}
+
+// exportEntry streams the entry stored under key to archive, unless it has expired (or vanished) by now.
+// Entries are not touched, so that exporting does not affect eviction.
+func (st *Store) exportEntry(archive *tar.Writer, key string, now time.Time) (bool, error) {
+	// The size goes in the tar header, before the value.
+	entry, err := st.stat(key)
+	if err != nil {
+		// Removed from under us, by a process that does not honor the lock.
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	meta := entry.Metadata
+	if meta.Expired(now) {
+		return false, nil
+	}
+
+	_, file, payload, err := st.openEntry(key)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	defer func() {
+		_ = payload.Close()
+		_ = file.Close()
+	}()
+
+	// Digests are specific to the store mode.
+	exported := *meta
+	exported.Digest = ""
+
+	record, err := json.Marshal(&exported)
+	if err != nil {
+		return false, errors.Join(ErrFileStoreFail, err)
+	}
+
+	name := meta.Name
+	if name == "" {
+		name = key
+	}
+
+	err = archive.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Size:       entry.Size,
+		Mode:       int64(filesystem.FilePermissionsPrivate),
+		ModTime:    meta.Modified,
+		PAXRecords: map[string]string{exportMetadataRecord: string(record)},
+		Format:     tar.FormatPAX,
+	})
+	if err == nil {
+		var written int64
+		if written, err = io.Copy(archive, payload); err == nil && written != entry.Size {
+			err = errSizeMismatch
+		}
+	}
+
+	if err != nil {
+		return false, errors.Join(ErrFileStoreFail, err)
+	}
+
+	return true, nil
+}
+
+// importArchive stages every entry of archive, and returns the keys they are written under.
+func (tx *Tx) importArchive(archive *tar.Reader) (map[string]bool, error) {
+	imported := map[string]bool{}
+	now := time.Now()
+
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return imported, nil
+		}
+
+		if err != nil {
+			return nil, errors.Join(ErrFileStoreFail, errInvalidArchive, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return nil, errors.Join(ErrFileStoreFail, errInvalidArchive)
+		}
+
+		key, meta, err := importMetadata(header, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.Expired(now) {
+			continue
+		}
+
+		if err = tx.putFrom(key, meta, archiveReader{archive}, header.Size, now); err != nil {
+			return nil, err
+		}
+
+		imported[key] = true
+	}
+}
+
+// importMetadata returns the key and metadata of the archived entry described by header.
+func importMetadata(header *tar.Header, now time.Time) (string, *Metadata, error) {
+	record, ok := header.PAXRecords[exportMetadataRecord]
+	if !ok {
+		return hash(header.Name), &Metadata{Name: header.Name, Created: now, Modified: now}, nil
+	}
+
+	meta := &Metadata{}
+	if err := json.Unmarshal([]byte(record), meta); err != nil {
+		return "", nil, errors.Join(ErrFileStoreFail, errInvalidArchive, err)
+	}
+
+	if meta.Name != "" {
+		return hash(meta.Name), meta, nil
+	}
+
+	// Entries without a name stay under their key.
+	if !isDigest(header.Name) {
+		return "", nil, errors.Join(ErrFileStoreFail, errInvalidArchive)
+	}
+
+	return header.Name, meta, nil
+}
+
+// archiveReader reads the content of an archived entry, reporting read failures as an invalid archive.
+type archiveReader struct {
+	reader io.Reader
+}
+
+func (reader archiveReader) Read(data []byte) (int, error) {
+	n, err := reader.reader.Read(data)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = errors.Join(errInvalidArchive, err)
+	}
+
+	return n, err
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+)
+
+func TestStoreExportImport(t *testing.T) {
+	t.Parallel()
+
+	source := store.New(&store.Options{
+		Path:               t.TempDir(),
+		ContentAddressable: true,
+		Compress:           true,
+		EncryptionKey:      bytes.Repeat([]byte{1}, store.KeySize),
+	})
+
+	assert.NilError(t, source.Write("one", []byte("1")))
+	assert.NilError(t, source.WriteWithMetadata("two", []byte("2"), &store.Metadata{
+		ContentType: "text/plain",
+		Labels:      map[string]string{"label": "value"},
+	}))
+	assert.NilError(t, source.Write("nested/three", bytes.Repeat([]byte("3"), 100000)))
+	assert.NilError(t, source.WriteWithMetadata("expired", []byte("e"), &store.Metadata{Expires: time.Now()}))
+
+	original, err := source.Metadata("two")
+	assert.NilError(t, err)
+
+	for name, export := range map[string]func(st *store.Store, buf *bytes.Buffer) (int, error){
+		"tar": func(st *store.Store, buf *bytes.Buffer) (int, error) {
+			return st.Export(buf)
+		},
+		"zstd": func(st *store.Store, buf *bytes.Buffer) (int, error) {
+			return st.ExportCompressed(buf)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+
+			count, err := export(source, buf)
+			assert.NilError(t, err)
+			assert.Equal(t, count, 3)
+
+			// Archives do not depend on the options of either store.
+			target := store.New(&store.Options{Path: t.TempDir()})
+
+			count, err = target.Import(buf, store.ImportMerge)
+			assert.NilError(t, err)
+			assert.Equal(t, count, 3)
+
+			entries, err := target.List("")
+			assert.NilError(t, err)
+			assert.Equal(t, len(entries), 3)
+			assert.Equal(t, entries[0].Name, "nested/three")
+			assert.Equal(t, entries[0].Size, int64(100000))
+
+			content, err := target.Read("one")
+			assert.NilError(t, err)
+			assert.Equal(t, string(content), "1")
+
+			meta, err := target.Metadata("two")
+			assert.NilError(t, err)
+			assert.Equal(t, meta.ContentType, "text/plain")
+			assert.Equal(t, meta.Labels["label"], "value")
+			assert.Assert(t, meta.Created.Equal(original.Created))
+			assert.Assert(t, meta.Modified.Equal(original.Modified))
+			assert.Equal(t, meta.Digest, "")
+		})
+	}
+}
+
+func TestStoreImportModes(t *testing.T) {
+	t.Parallel()
+
+	source := store.New(&store.Options{Path: t.TempDir()})
+	assert.NilError(t, source.Write("one", []byte("new")))
+	assert.NilError(t, source.Write("two", []byte("new")))
+
+	buf := &bytes.Buffer{}
+	_, err := source.Export(buf)
+	assert.NilError(t, err)
+
+	archive := buf.Bytes()
+
+	for mode, expected := range map[store.ImportMode][]string{
+		store.ImportMerge:     {"one", "three", "two"},
+		store.ImportOverwrite: {"one", "two"},
+	} {
+		target := store.New(&store.Options{Path: t.TempDir()})
+		assert.NilError(t, target.Write("one", []byte("old")))
+		assert.NilError(t, target.Write("three", []byte("old")))
+
+		count, err := target.Import(bytes.NewReader(archive), mode)
+		assert.NilError(t, err)
+		assert.Equal(t, count, 2)
+
+		entries, err := target.List("")
+		assert.NilError(t, err)
+		assert.Equal(t, len(entries), len(expected))
+
+		for index, entry := range entries {
+			assert.Equal(t, entry.Name, expected[index])
+		}
+
+		content, err := target.Read("one")
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), "new")
+	}
+}
+
+func TestStoreImportInvalid(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	archive := tar.NewWriter(buf)
+
+	// Plain files can be imported.
+	assert.NilError(t, archive.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "plain", Size: 5, Mode: 0o600}))
+	_, err := archive.Write([]byte("plain"))
+	assert.NilError(t, err)
+	assert.NilError(t, archive.Close())
+
+	st := store.New(&store.Options{Path: t.TempDir()})
+
+	count, err := st.Import(bytes.NewReader(buf.Bytes()), store.ImportMerge)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 1)
+
+	content, err := st.Read("plain")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "plain")
+
+	// Links cannot, and nothing is imported if anything fails.
+	buf.Reset()
+	archive = tar.NewWriter(buf)
+	assert.NilError(t, archive.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "other", Size: 5, Mode: 0o600}))
+	_, err = archive.Write([]byte("other"))
+	assert.NilError(t, err)
+	assert.NilError(t, archive.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "other"}))
+	assert.NilError(t, archive.Close())
+
+	_, err = st.Import(bytes.NewReader(buf.Bytes()), store.ImportOverwrite)
+	assert.ErrorIs(t, err, store.ErrFileStoreFail)
+
+	_, err = st.Import(bytes.NewReader([]byte("garbage")), store.ImportOverwrite)
+	assert.ErrorIs(t, err, store.ErrFileStoreFail)
+
+	_, err = st.Import(bytes.NewReader(nil), store.ImportOverwrite)
+	assert.ErrorIs(t, err, store.ErrFileStoreFail)
+
+	entries, err := st.List("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Name, "plain")
+}
+
+func TestStoreImportContentAddressable(t *testing.T) {
+	t.Parallel()
+
+	value := bytes.Repeat([]byte("value"), 256*1024)
+
+	source := store.New(&store.Options{Path: t.TempDir()})
+	assert.NilError(t, source.Write("one", value))
+	assert.NilError(t, source.Write("two", value))
+
+	buf := &bytes.Buffer{}
+	_, err := source.Export(buf)
+	assert.NilError(t, err)
+
+	target := store.New(&store.Options{Path: t.TempDir(), ContentAddressable: true, Compress: true})
+
+	// A truncated archive imports nothing.
+	_, err = target.Import(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), store.ImportMerge)
+	assert.ErrorIs(t, err, store.ErrFileStoreFail)
+
+	count, err := target.Import(buf, store.ImportMerge)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 2)
+
+	for _, name := range []string{"one", "two"} {
+		content, err := target.Read(name)
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(content, value), name)
+	}
+
+	// Both entries share the same blob, and nothing else was left behind.
+	one, err := target.Metadata("one")
+	assert.NilError(t, err)
+	two, err := target.Metadata("two")
+	assert.NilError(t, err)
+	assert.Equal(t, one.Digest, two.Digest)
+
+	count, err = target.GC()
+	assert.NilError(t, err)
+	assert.Equal(t, count, 0)
+}
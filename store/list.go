@@ -0,0 +1,249 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Since keys are digests, the original name of every entry is recorded in its metadata, which makes each entry its
+// own reverse index entry: there is no separate index file to keep in sync, and an interrupted write can never leave
+// the name and the data disagreeing.
+
+// Entry describes an entry in the store.
+type Entry struct {
+	// Name is the logical name of the entry. It is empty for entries written by older versions of this package.
+	Name string
+	// Key is the digest the entry is stored under.
+	Key string
+	// Size is the size of the value, in bytes (uncompressed).
+	Size int64
+	// Metadata of the entry.
+	Metadata *Metadata
+}
+
+// List returns all entries whose name starts with prefix, sorted by name.
+// Entries written by older versions of this package have no name, and are only listed for an empty prefix.
+func (st *Store) List(prefix string) (entries []*Entry, err error) {
+	entries = []*Entry{}
+
+	err = st.Walk(func(entry *Entry) error {
+		if strings.HasPrefix(entry.Name, prefix) {
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(entries, func(a, b *Entry) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return entries, nil
+}
+
+// Walk calls function for every (non-expired) entry in the store, in no particular order, while holding a read lock.
+// If function returns an error, the walk stops and that error is returned.
+func (st *Store) Walk(function func(entry *Entry) error) (err error) {
+	if st.lock == nil {
+		err = st.ReadOnlyLock()
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	now := time.Now()
+
+	return st.walkEntries(func(key string) error {
+		entry, err := st.stat(key)
+		if err != nil {
+			// Removed from under us, by a process that does not honor the lock.
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if entry.Metadata.Expired(now) {
+			return nil
+		}
+
+		return function(entry)
+	})
+}
+
+// Name returns the name of the entry stored under key.
+// The name is empty for entries written by older versions of this package.
+func (st *Store) Name(key string) (name string, err error) {
+	if st.lock == nil {
+		err = st.ReadOnlyLock()
+		if err != nil {
+			return "", err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	meta, err := st.readMetadata(key)
+	if err != nil {
+		return "", err
+	}
+
+	if meta.Expired(time.Now()) {
+		return "", errors.Join(ErrFileStoreFail, errEntryExpired, ErrNotFound)
+	}
+
+	return meta.Name, nil
+}
+
+// walkEntries calls function for every entry key, stopping at the first error.
+func (st *Store) walkEntries(function func(key string) error) error {
+	err := st.backend.Keys("", func(key string) error {
+		if !isEntryKey(key) {
+			return nil
+		}
+
+		return function(key)
+	})
+	if err != nil {
+		err = errors.Join(ErrFileStoreFail, err)
+	}
+
+	return err
+}
+
+// walkBlobs calls function for every blob digest, stopping at the first error.
+func (st *Store) walkBlobs(function func(digest string) error) error {
+	err := st.backend.Keys(blobKey(""), func(key string) error {
+		return function(strings.TrimPrefix(key, blobKey("")))
+	})
+	if err != nil {
+		err = errors.Join(ErrFileStoreFail, err)
+	}
+
+	return err
+}
+
+// stat describes the entry stored under key, reading only its metadata, unless its size was not recorded and the value
+// is compressed, in which case it has to be decoded to be measured.
+// Expired entries are returned as well.
+func (st *Store) stat(key string) (*Entry, error) {
+	entry, err := st.statEntry(key, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Metadata.Digest != "" && entry.Metadata.Size == 0 {
+		blob, err := st.statEntry(blobKey(entry.Metadata.Digest), true)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Size = blob.Size
+	}
+
+	return entry, nil
+}
+
+// statEntry describes the value stored under key (an entry or a blob). Sizes recorded in the metadata are used as is.
+// Otherwise, unless measure is set, the size of encoded values is left as stored.
+func (st *Store) statEntry(key string, measure bool) (*Entry, error) {
+	info, err := statValue(st.backend, key)
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	file, err := openValue(st.backend, key)
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	header, found, err := readEntryHeader(file)
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	entry := &Entry{
+		Key:  key,
+		Size: info.Size,
+	}
+
+	if !found {
+		entry.Metadata = &Metadata{Modified: info.Modified}
+
+		return entry, nil
+	}
+
+	entry.Name = header.meta.Name
+	entry.Metadata = header.meta
+	entry.Size -= int64(len(header.raw))
+
+	if header.meta.Size > 0 {
+		entry.Size = header.meta.Size
+
+		return entry, nil
+	}
+
+	if !measure {
+		return entry, nil
+	}
+
+	switch {
+	case header.flags&entryFlagZstd != 0:
+		payload, err := st.codec.newPayloadReader(file, header)
+		if err != nil {
+			return nil, errors.Join(ErrFileStoreFail, err)
+		}
+
+		entry.Size, err = io.Copy(io.Discard, payload)
+		if err != nil {
+			return nil, errors.Join(ErrFileStoreFail, errCorruptEntry, err, payload.Close())
+		}
+
+		return entry, errors.Join(payload.Close())
+	case header.flags&entryFlagEncrypted != 0:
+		entry.Size, err = decryptedSize(file, entry.Size)
+		if err != nil {
+			return nil, errors.Join(ErrFileStoreFail, err)
+		}
+	}
+
+	return entry, nil
+}
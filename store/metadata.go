@@ -0,0 +1,184 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+// WriteWithMetadata writes the content to a file with the given name, along with the provided metadata.
+// Name, Size, Created and Modified are managed by the store and ignored if set. If Expires is not set, it defaults to the store
+// TTL, if any. meta may be nil.
+func (st *Store) WriteWithMetadata(name string, value []byte, meta *Metadata) (err error) {
+	if st.lock == nil {
+		err = st.WriteLock()
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	writer, err := st.stageEntry(name, meta, int64(len(value)))
+	if err != nil {
+		return err
+	}
+
+	if _, err = writer.Write(value); err != nil {
+		return errors.Join(err, writer.pending.Discard())
+	}
+
+	return writer.Close()
+}
+
+// Metadata returns the metadata of the file with the given name.
+// Files written by older versions of this package only carry a modification time.
+func (st *Store) Metadata(name string) (meta *Metadata, err error) {
+	if st.lock == nil {
+		err = st.ReadOnlyLock()
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	meta, err = st.readMetadata(hash(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Expired(time.Now()) {
+		return nil, errors.Join(ErrFileStoreFail, errEntryExpired, ErrNotFound)
+	}
+
+	return meta, nil
+}
+
+// Prune removes all expired entries from the store, in a single locked pass, and returns how many were removed.
+func (st *Store) Prune() (count int, err error) {
+	if st.lock == nil {
+		err = st.WriteLock()
+		if err != nil {
+			return 0, err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	// Collect first, as erasing while walking would interrupt the walk.
+	keys, err := st.keys()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	for _, key := range keys {
+		meta, err := st.readMetadata(key)
+		if err != nil {
+			return count, err
+		}
+
+		if !meta.Expired(now) {
+			continue
+		}
+
+		if err = st.deleteValue(key); err != nil {
+			return count, errors.Join(ErrFileStoreFail, err)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// newMetadata prepares the metadata for an entry about to be written over previous (which may be nil).
+func (st *Store) newMetadata(name string, previous, meta *Metadata, now time.Time) *Metadata {
+	entry := &Metadata{}
+	if meta != nil {
+		*entry = *meta
+	}
+
+	entry.Name = name
+	entry.Size = 0
+
+	entry.Created = now
+	if previous != nil && !previous.Created.IsZero() && !previous.Expired(now) {
+		entry.Created = previous.Created
+	}
+
+	entry.Modified = now
+
+	if entry.Expires.IsZero() && st.ttl > 0 {
+		entry.Expires = now.Add(st.ttl)
+	}
+
+	return entry
+}
+
+// readEntry reads and decodes the entry stored under key, treating expired entries as missing.
+func (st *Store) readEntry(key string) (*Metadata, []byte, error) {
+	data, err := st.backend.Read(key)
+	if err != nil {
+		return nil, nil, errors.Join(ErrFileStoreFail, notFound(err))
+	}
+
+	meta, payload, err := st.codec.decode(data)
+	if err != nil {
+		return nil, nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	if meta != nil && meta.Expired(time.Now()) {
+		return nil, nil, errors.Join(ErrFileStoreFail, errEntryExpired, ErrNotFound)
+	}
+
+	if meta != nil && meta.Digest != "" {
+		payload, err = st.readBlob(meta.Digest)
+	}
+
+	if err == nil {
+		st.touch(key)
+	}
+
+	return meta, payload, err
+}
+
+// readMetadata reads the metadata of the entry stored under key, without reading its payload.
+// Expired entries are returned as well.
+func (st *Store) readMetadata(key string) (*Metadata, error) {
+	entry, err := st.statEntry(key, false)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return entry.Metadata, nil
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/store"
+)
+
+func TestStoreMetadata(t *testing.T) {
+	t.Parallel()
+
+	st := store.New(&store.Options{Path: t.TempDir()})
+
+	assert.NilError(t, st.WriteWithMetadata("key", []byte("value"), &store.Metadata{
+		ContentType: "text/plain",
+		Labels:      map[string]string{"origin": "test"},
+	}))
+
+	first, err := st.Metadata("key")
+	assert.NilError(t, err)
+	assert.Equal(t, first.ContentType, "text/plain")
+	assert.DeepEqual(t, first.Labels, map[string]string{"origin": "test"})
+	assert.Assert(t, !first.Created.IsZero())
+	assert.Assert(t, first.Expires.IsZero())
+
+	content, err := st.Read("key")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "value")
+
+	time.Sleep(10 * time.Millisecond)
+	assert.NilError(t, st.Write("key", []byte("other")))
+
+	second, err := st.Metadata("key")
+	assert.NilError(t, err)
+	assert.Assert(t, second.Created.Equal(first.Created), "creation time must be preserved")
+	assert.Assert(t, second.Modified.After(first.Modified), "modification time must be updated")
+	assert.Equal(t, second.ContentType, "")
+
+	// Metadata follows renames.
+	assert.NilError(t, st.Rename("key", "renamed"))
+
+	third, err := st.Metadata("renamed")
+	assert.NilError(t, err)
+	assert.Assert(t, third.Created.Equal(first.Created))
+}
+
+func TestStoreExpiration(t *testing.T) {
+	t.Parallel()
+
+	st := store.New(&store.Options{Path: t.TempDir(), TTL: time.Hour})
+
+	assert.NilError(t, st.Write("fresh", []byte("fresh")))
+	assert.NilError(t, st.WriteWithMetadata("stale", []byte("stale"), &store.Metadata{
+		Expires: time.Now().Add(-time.Second),
+	}))
+
+	meta, err := st.Metadata("fresh")
+	assert.NilError(t, err)
+	assert.Assert(t, meta.Expires.After(time.Now().Add(59*time.Minute)), "default ttl must apply")
+
+	_, err = st.Read("stale")
+	assert.ErrorIs(t, err, store.ErrFileStoreFail)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = st.Metadata("stale")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	has, err := st.Has("stale")
+	assert.NilError(t, err)
+	assert.Assert(t, !has)
+
+	count, err := st.Prune()
+	assert.NilError(t, err)
+	assert.Equal(t, count, 1)
+
+	keys := []string{}
+	for key := range st.Keys() {
+		keys = append(keys, key)
+	}
+
+	assert.DeepEqual(t, keys, []string{st.Digest("fresh")})
+}
+
+func TestStoreLegacyEntry(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	st := store.New(&store.Options{Path: dir})
+
+	// Entries written before metadata existed are raw values.
+	digest := st.Digest("legacy")
+	assert.NilError(t, os.MkdirAll(filepath.Join(dir, digest), filesystem.DirPermissionsPrivate))
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, digest, digest), []byte("{}"), filesystem.FilePermissionsPrivate))
+
+	content, err := st.Read("legacy")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "{}")
+
+	meta, err := st.Metadata("legacy")
+	assert.NilError(t, err)
+	assert.Assert(t, !meta.Modified.IsZero())
+
+	count, err := st.Prune()
+	assert.NilError(t, err)
+	assert.Equal(t, count, 0)
+}
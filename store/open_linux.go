@@ -0,0 +1,38 @@
+//go:build linux
+
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openValueFile opens the file at path for reading, without updating its access time where allowed (for files owned by
+// the user), so that reading values internally - to evict or export them - does not count as using them.
+func openValueFile(path string) (*os.File, error) {
+	//nolint:gosec
+	file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOATIME, 0)
+	if errors.Is(err, os.ErrPermission) {
+		//nolint:gosec
+		return os.Open(path)
+	}
+
+	return file, err
+}
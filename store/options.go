@@ -0,0 +1,75 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.farcloser.world/core/units"
+)
+
+// UnmarshalJSON decodes options, where CacheSize and MaxDiskSize are either numbers of bytes, or human-readable sizes
+// in binary units (e.g. "64MiB", "2g").
+func (options *Options) UnmarshalJSON(data []byte) error {
+	type plain Options
+
+	sizes := &struct {
+		*plain
+
+		CacheSize   json.RawMessage `json:"cacheSize,omitempty"`
+		MaxDiskSize json.RawMessage `json:"maxDiskSize,omitempty"`
+	}{plain: (*plain)(options)}
+
+	if err := json.Unmarshal(data, sizes); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	var err error
+
+	if options.CacheSize, err = parseSize(sizes.CacheSize, options.CacheSize); err != nil {
+		return fmt.Errorf("invalid cacheSize: %w", err)
+	}
+
+	if options.MaxDiskSize, err = parseSize(sizes.MaxDiskSize, options.MaxDiskSize); err != nil {
+		return fmt.Errorf("invalid maxDiskSize: %w", err)
+	}
+
+	return nil
+}
+
+// parseSize decodes a size, as a number of bytes or a human-readable string. Missing sizes are left to current.
+func parseSize(raw json.RawMessage, current int64) (int64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return current, nil
+	}
+
+	var size int64
+	if json.Unmarshal(raw, &size) == nil {
+		return size, nil
+	}
+
+	var human string
+	if err := json.Unmarshal(raw, &human); err != nil {
+		//nolint:wrapcheck
+		return 0, err
+	}
+
+	//nolint:wrapcheck
+	return units.RAMInBytes(human)
+}
@@ -17,40 +17,46 @@
 package store
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
-
-	"github.com/peterbourgon/diskv/v3"
+	"time"
 
 	"go.farcloser.world/core/filesystem"
 )
 
-const transformBlockSize = 64 // grouping of chars per directory depth
-
-func transform(key string) []string {
-	var (
-		sliceSize = len(key) / transformBlockSize
-		pathSlice = make([]string, sliceSize)
-	)
-
-	for i := range sliceSize {
-		from, to := i*transformBlockSize, (i+1)*transformBlockSize
-		pathSlice[i] = key[from:to]
-	}
-
-	return pathSlice
-}
-
 func hash(s string) string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
 }
 
-// Options for the store.
+// Options for the store. They can be decoded from JSON (see UnmarshalJSON), typically as part of a configuration file.
 type Options struct {
-	Path      string
-	CacheSize int64
+	Path      string `json:"path,omitempty"`
+	CacheSize int64  `json:"cacheSize,omitempty"`
+	// MaxDiskSize bounds the disk usage of the store, in bytes. Writes that exceed it evict the least recently used
+	// entries. Zero means no limit.
+	MaxDiskSize int64 `json:"maxDiskSize,omitempty"`
+	// TTL is the default time-to-live of entries written without an explicit expiration. Zero means no expiration.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// ContentAddressable stores values as blobs keyed by the digest of their content, so that identical values are
+	// only stored once, while names merely refer to blobs. Unreferenced blobs are removed by GC.
+	// Stores can be switched in and out of this mode at any time: it only affects how new values are written.
+	ContentAddressable bool `json:"contentAddressable,omitempty"`
+	// Compress compresses new values with zstd. Compressed and uncompressed values can be read regardless of this
+	// setting, so it can be changed at any time.
+	Compress bool `json:"compress,omitempty"`
+	// EncryptionKey enables authenticated encryption of values, with the given key (KeySize bytes long).
+	// Shorthand for KeyProvider: StaticKey(EncryptionKey).
+	EncryptionKey []byte `json:"-"`
+	// KeyProvider enables authenticated encryption of values, with the keys it provides. It takes precedence over
+	// EncryptionKey.
+	// Once enabled, unencrypted values fail to read with ErrTampered: use RotateKey to encrypt an existing store.
+	KeyProvider KeyProvider `json:"-"`
+	// Backend is where values are kept. It defaults to a DiskvBackend at Path, caching up to CacheSize bytes in
+	// memory - Path and CacheSize are ignored otherwise.
+	Backend Backend `json:"-"`
 }
 
 // New creates a new Store with the given options.
@@ -60,32 +66,47 @@ func New(options *Options) *Store {
 		path = defaultStoreDir
 	}
 
-	var cacheSize uint64
-	//nolint:gocritic
-	if options.CacheSize == 0 {
-		cacheSize = defaultCacheSize
-	} else if options.CacheSize < 0 {
-		cacheSize = 0
-	} else {
-		cacheSize = uint64(options.CacheSize)
+	keys := options.KeyProvider
+	if keys == nil && options.EncryptionKey != nil {
+		keys = StaticKey(options.EncryptionKey)
+	}
+
+	backend := options.Backend
+	if backend == nil {
+		var cacheSize uint64
+		//nolint:gocritic
+		if options.CacheSize == 0 {
+			cacheSize = defaultCacheSize
+		} else if options.CacheSize < 0 {
+			cacheSize = 0
+		} else {
+			cacheSize = uint64(options.CacheSize)
+		}
+
+		backend = NewDiskvBackend(path, cacheSize)
 	}
 
 	return &Store{
-		diskv: diskv.New(diskv.Options{
-			BasePath:     path,
-			Transform:    transform,
-			CacheSizeMax: cacheSize,
-			PathPerm:     filesystem.DirPermissionsPrivate,
-			FilePerm:     filesystem.FilePermissionsPrivate,
-			TempDir:      "", // "FIXME TO GET ATOMIC WRITES",
-		}),
+		backend:            backend,
+		ttl:                options.TTL,
+		contentAddressable: options.ContentAddressable,
+		maxDiskSize:        options.MaxDiskSize,
+		codec: &entryCodec{
+			compress: options.Compress,
+			keys:     keys,
+		},
 	}
 }
 
-// Store is a file-based key-value store using diskv.
+// Store is a key-value store, on disk by default (see Backend).
 type Store struct {
-	diskv *diskv.Diskv
-	lock  *os.File
+	backend            Backend
+	lock               func() error
+	ttl                time.Duration
+	contentAddressable bool
+	maxDiskSize        int64
+	usage              diskUsage
+	codec              *entryCodec
 }
 
 // Read reads the content of a file by its name.
@@ -103,10 +124,7 @@ func (st *Store) Read(name string) (content []byte, err error) {
 		}()
 	}
 
-	content, err = st.diskv.Read(hash(name))
-	if err != nil {
-		err = errors.Join(ErrFileStoreFail, err)
-	}
+	_, content, err = st.readEntry(hash(name))
 
 	return content, err
 }
@@ -126,10 +144,7 @@ func (st *Store) ReadFromKey(key string) (content []byte, err error) {
 		}()
 	}
 
-	content, err = st.diskv.Read(key)
-	if err != nil {
-		err = errors.Join(ErrFileStoreFail, err)
-	}
+	_, content, err = st.readEntry(key)
 
 	return content, err
 }
@@ -149,25 +164,39 @@ func (st *Store) Has(name string) (has bool, err error) {
 		}()
 	}
 
-	return st.diskv.Has(hash(name)), nil
+	meta, err := st.readMetadata(hash(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+
+		return false, err
+	}
+
+	return !meta.Expired(time.Now()), nil
 }
 
 // Keys returns a channel that emits all keys in the store.
+// Keys are collected under a read lock, so the channel yields a consistent snapshot. If the store cannot be read, the
+// channel is empty - use Walk to get errors.
 func (st *Store) Keys() <-chan string {
-	return st.diskv.Keys(nil)
-}
+	snapshot, _ := st.keys()
 
-// Digest returns a hash of the given name, which can be used as a key.
-func (*Store) Digest(name string) string {
-	return hash(name)
+	keys := make(chan string, len(snapshot))
+	for _, key := range snapshot {
+		keys <- key
+	}
+
+	close(keys)
+
+	return keys
 }
 
-// Write writes the content to a file with the given name.
-func (st *Store) Write(name string, value []byte) (err error) {
+func (st *Store) keys() (keys []string, err error) {
 	if st.lock == nil {
-		err = st.WriteLock()
+		err = st.ReadOnlyLock()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		defer func() {
@@ -177,12 +206,26 @@ func (st *Store) Write(name string, value []byte) (err error) {
 		}()
 	}
 
-	err = st.diskv.Write(hash(name), value)
-	if err != nil {
-		err = errors.Join(ErrFileStoreFail, err)
-	}
+	keys = []string{}
+	err = st.walkEntries(func(key string) error {
+		keys = append(keys, key)
 
-	return err
+		return nil
+	})
+
+	return keys, err
+}
+
+// Digest returns a hash of the given name, which can be used as a key.
+func (*Store) Digest(name string) string {
+	return hash(name)
+}
+
+// Write writes the content to a file with the given name.
+// The value is first written and synced to a temporary file, then renamed into place, so that readers will only ever
+// see either the previous value or the new one, even if the process crashes mid-write.
+func (st *Store) Write(name string, value []byte) error {
+	return st.WriteWithMetadata(name, value, nil)
 }
 
 // Delete removes a file with the given name from the store.
@@ -200,78 +243,156 @@ func (st *Store) Delete(name string) (err error) {
 		}()
 	}
 
-	err = st.diskv.Erase(hash(name))
+	err = st.deleteValue(hash(name))
 	if err != nil {
-		err = errors.Join(ErrFileStoreFail, err)
+		err = errors.Join(ErrFileStoreFail, notFound(err))
 	}
 
 	return err
 }
 
 // Rename renames a file from oldName to newName in the store.
-func (st *Store) Rename(oldName, newName string) (err error) {
-	if st.lock == nil {
-		err = st.WriteLock()
-		if err != nil {
-			return err
-		}
+// This is done in a transaction, so that an interrupted rename never leaves both or neither of the files behind.
+func (st *Store) Rename(oldName, newName string) error {
+	return st.Update(func(tx *Tx) error {
+		return tx.Rename(oldName, newName)
+	})
+}
 
-		defer func() {
-			if unlockErr := st.Unlock(); unlockErr != nil {
-				err = errors.Join(err, unlockErr)
-			}
-		}()
+// Lock by default gets an exclusive read/write lock.
+func (st *Store) Lock() (err error) {
+	return st.WriteLock()
+}
+
+// WriteLock acquires an exclusive lock for writing to the store.
+func (st *Store) WriteLock() (err error) {
+	lock, err := st.acquire(true)
+	if err == nil {
+		st.lock = lock
 	}
 
-	var content []byte
+	return err
+}
 
-	content, err = st.Read(oldName)
-	if err != nil {
-		return err
+// ReadOnlyLock acquires a read-only lock for the store.
+func (st *Store) ReadOnlyLock() (err error) {
+	lock, err := st.acquire(false)
+	if err == nil {
+		st.lock = lock
 	}
 
-	err = st.Write(newName, content)
-	if err != nil {
-		return err
+	return err
+}
+
+// LockContext acquires an exclusive lock for writing to the store, like WriteLock, but gives up once ctx is done, with
+// an error matching filesystem.ErrLockTimeout.
+func (st *Store) LockContext(ctx context.Context) (err error) {
+	lock, err := st.acquireWith(ctx, true)
+	if err == nil {
+		st.lock = lock
 	}
 
-	return st.Delete(oldName)
+	return err
 }
 
-// Lock by default gets an exclusive read/write lock.
-func (st *Store) Lock() (err error) {
-	return st.WriteLock()
+// ReadOnlyLockContext acquires a read-only lock for the store, like ReadOnlyLock, but gives up once ctx is done, with
+// an error matching filesystem.ErrLockTimeout.
+func (st *Store) ReadOnlyLockContext(ctx context.Context) (err error) {
+	lock, err := st.acquireWith(ctx, false)
+	if err == nil {
+		st.lock = lock
+	}
+
+	return err
 }
 
-// WriteLock acquires an exclusive lock for writing to the store.
-func (st *Store) WriteLock() (err error) {
-	err = os.MkdirAll(st.diskv.BasePath, filesystem.DirPermissionsPrivate)
-	if err != nil {
-		return errors.Join(ErrFileStoreFail, err)
+// TryLock acquires an exclusive lock for writing to the store if it is available right away, and fails with an error
+// matching filesystem.ErrLockTimeout otherwise.
+func (st *Store) TryLock() (err error) {
+	lock, err := st.acquireWith(doneContext(), true)
+	if err == nil {
+		st.lock = lock
 	}
 
-	lock, err := filesystem.Lock(st.diskv.BasePath)
-	if err != nil {
-		err = errors.Join(ErrFileStoreFail, err)
-	} else {
+	return err
+}
+
+// TryReadOnlyLock acquires a read-only lock for the store if it is available right away, and fails with an error
+// matching filesystem.ErrLockTimeout otherwise.
+func (st *Store) TryReadOnlyLock() (err error) {
+	lock, err := st.acquireWith(doneContext(), false)
+	if err == nil {
 		st.lock = lock
 	}
 
 	return err
 }
 
-// ReadOnlyLock acquires a read-only lock for the store.
-func (st *Store) ReadOnlyLock() (err error) {
-	err = os.MkdirAll(st.diskv.BasePath, filesystem.DirPermissionsPrivate)
+// doneContext returns a context that is done already, which makes Backend.Lock give up right away.
+func doneContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return ctx
+}
+
+// acquire locks the backend, waiting as long as it takes. See acquireWith.
+func (st *Store) acquire(exclusive bool) (func() error, error) {
+	return st.acquireWith(context.Background(), exclusive)
+}
+
+// acquireWith locks the backend, and replays any transaction that was interrupted after being committed.
+func (st *Store) acquireWith(ctx context.Context, exclusive bool) (func() error, error) {
+	if exclusive {
+		unlock, err := st.backend.Lock(ctx, true)
+		if err != nil {
+			return nil, errors.Join(ErrFileStoreFail, err)
+		}
+
+		// The disk usage is read once locked, as other processes may have changed it, and saved before unlocking.
+		st.loadUsage()
+
+		lock := func() error {
+			return errors.Join(st.saveUsage(), unlock())
+		}
+
+		if err = st.recover(); err != nil {
+			return nil, errors.Join(err, release(lock))
+		}
+
+		return lock, nil
+	}
+
+	lock, err := st.backend.Lock(ctx, false)
 	if err != nil {
-		return errors.Join(ErrFileStoreFail, err)
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	hasJournal, err := st.hasJournal()
+	if err != nil || !hasJournal {
+		return lock, err
+	}
+
+	// An interrupted transaction has to be replayed before reading, which requires the write lock.
+	if err = release(lock); err != nil {
+		return nil, err
+	}
+
+	if lock, err = st.acquireWith(ctx, true); err != nil {
+		return nil, err
+	}
+
+	if err = release(lock); err != nil {
+		return nil, err
 	}
 
-	lock, err := filesystem.ReadOnlyLock(st.diskv.BasePath)
+	return st.acquireWith(ctx, false)
+}
+
+func release(lock func() error) error {
+	err := lock()
 	if err != nil {
 		err = errors.Join(ErrFileStoreFail, err)
-	} else {
-		st.lock = lock
 	}
 
 	return err
@@ -285,7 +406,11 @@ func (st *Store) Unlock() (err error) {
 		}
 	}()
 
-	err = filesystem.Unlock(st.lock)
+	if st.lock == nil {
+		return filesystem.ErrLockIsNil
+	}
+
+	err = st.lock()
 	if err != nil {
 		err = errors.Join(ErrFileStoreFail, err)
 	} else {
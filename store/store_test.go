@@ -0,0 +1,256 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/store"
+)
+
+const (
+	crashHelperEnv = "STORE_TEST_CRASH_HELPER"
+	crashPointEnv  = "STORE_TEST_CRASH_POINT"
+	crashKey       = "crash"
+	// crashReady is printed by the child process once it is in the middle of writing.
+	crashReady = "crash helper ready"
+)
+
+func crashValues() (oldValue, newValue []byte) {
+	return bytes.Repeat([]byte("a"), 1024*1024), bytes.Repeat([]byte("b"), 16*1024*1024)
+}
+
+func TestStoreReadWrite(t *testing.T) {
+	t.Parallel()
+
+	st := store.New(&store.Options{Path: t.TempDir()})
+
+	has, err := st.Has("key")
+	assert.NilError(t, err)
+	assert.Assert(t, !has)
+
+	_, err = st.Read("key")
+	assert.ErrorIs(t, err, store.ErrFileStoreFail)
+
+	assert.NilError(t, st.Write("key", []byte("value")))
+
+	content, err := st.Read("key")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "value")
+
+	assert.NilError(t, st.Rename("key", "other"))
+
+	has, err = st.Has("key")
+	assert.NilError(t, err)
+	assert.Assert(t, !has)
+
+	content, err = st.ReadFromKey(st.Digest("other"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "value")
+
+	assert.NilError(t, st.Delete("other"))
+
+	has, err = st.Has("other")
+	assert.NilError(t, err)
+	assert.Assert(t, !has)
+}
+
+// TestStoreWriteCrash kills a process in the middle of Store.Write - once the new value is staged, then once it is
+// synced, but not renamed into place yet - and verifies that a reader sees either the old value or the new one, but
+// never a truncated one.
+func TestStoreWriteCrash(t *testing.T) {
+	t.Parallel()
+
+	oldValue, newValue := crashValues()
+
+	if dir := os.Getenv(crashHelperEnv); dir != "" {
+		// We are the child process: write, and wait to get killed at the requested point.
+		store.SetCommitHook(func(point string) {
+			if point == os.Getenv(crashPointEnv) {
+				waitForCrash()
+			}
+		})
+
+		_ = store.New(&store.Options{Path: dir, CacheSize: -1}).Write(crashKey, newValue)
+
+		os.Exit(1)
+	}
+
+	for _, point := range []string{"sync", "rename"} {
+		dir := t.TempDir()
+		st := store.New(&store.Options{Path: dir, CacheSize: -1})
+		assert.NilError(t, st.Write(crashKey, oldValue))
+
+		crash(t, "TestStoreWriteCrash", dir, point)
+		assertCrashSafe(t, st, oldValue, newValue)
+	}
+}
+
+// TestStoreWriterCrash kills a process in the middle of streaming a value with Store.Writer, and verifies that a
+// reader sees either the old value or the new one.
+func TestStoreWriterCrash(t *testing.T) {
+	t.Parallel()
+
+	oldValue, newValue := crashValues()
+
+	if dir := os.Getenv(crashHelperEnv); dir != "" {
+		// We are the child process: write half of the value, and wait to get killed.
+		writer, err := store.New(&store.Options{Path: dir, CacheSize: -1}).Writer(crashKey)
+		if err == nil {
+			_, err = writer.Write(newValue[:len(newValue)/2])
+		}
+
+		if err != nil {
+			os.Exit(1)
+		}
+
+		waitForCrash()
+	}
+
+	dir := t.TempDir()
+	st := store.New(&store.Options{Path: dir, CacheSize: -1})
+	assert.NilError(t, st.Write(crashKey, oldValue))
+
+	crash(t, "TestStoreWriterCrash", dir, "")
+	assertCrashSafe(t, st, oldValue, newValue)
+}
+
+// waitForCrash tells the parent process that the child is ready to be killed, then waits for it.
+func waitForCrash() {
+	_, _ = fmt.Fprintln(os.Stdout, crashReady)
+
+	time.Sleep(time.Minute)
+	os.Exit(1)
+}
+
+// crash runs test in a child process writing to the store in dir, and kills it once it is ready.
+func crash(t *testing.T, test, dir, point string) {
+	t.Helper()
+
+	//nolint:gosec
+	cmd := exec.Command(os.Args[0], "-test.run=^"+test+"$")
+	cmd.Env = append(os.Environ(), crashHelperEnv+"="+dir, crashPointEnv+"="+point)
+
+	stdout, err := cmd.StdoutPipe()
+	assert.NilError(t, err)
+	assert.NilError(t, cmd.Start())
+
+	ready := make(chan bool, 1)
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if scanner.Text() == crashReady {
+				ready <- true
+
+				return
+			}
+		}
+
+		ready <- false
+	}()
+
+	select {
+	case ok := <-ready:
+		assert.Assert(t, ok, "the child process failed before writing")
+	case <-time.After(30 * time.Second):
+		t.Fatal("the child process never started writing")
+	}
+
+	assert.Assert(t, stagedBytes(filepath.Join(dir, ".tmp")) > 0)
+	assert.NilError(t, cmd.Process.Kill())
+	_ = cmd.Wait()
+}
+
+// assertCrashSafe checks that st holds either oldValue or newValue, and no leftover of the crash.
+func assertCrashSafe(t *testing.T, st *store.Store, oldValue, newValue []byte) {
+	t.Helper()
+
+	content, err := st.Read(crashKey)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(content, oldValue) || bytes.Equal(content, newValue),
+		"read a partial value of %d bytes", len(content))
+
+	// Leftover staging files must not show up as keys.
+	keys := []string{}
+	for key := range st.Keys() {
+		keys = append(keys, key)
+	}
+
+	assert.DeepEqual(t, keys, []string{st.Digest(crashKey)})
+}
+
+func stagedBytes(dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+func TestStoreLockContext(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	holder := store.New(&store.Options{Path: base})
+	waiter := store.New(&store.Options{Path: base})
+
+	assert.NilError(t, holder.ReadOnlyLock())
+
+	assert.NilError(t, waiter.TryReadOnlyLock())
+	assert.NilError(t, waiter.Unlock())
+
+	err := waiter.TryLock()
+	assert.ErrorIs(t, err, filesystem.ErrLockTimeout)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, waiter.LockContext(ctx), filesystem.ErrLockTimeout)
+
+	// Operations of a store that is not locked still wait for as long as it takes.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		assert.Check(t, holder.Unlock())
+	}()
+
+	assert.NilError(t, waiter.Write("key", []byte("value")))
+
+	assert.NilError(t, waiter.ReadOnlyLockContext(t.Context()))
+	assert.NilError(t, waiter.Unlock())
+}
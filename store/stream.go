@@ -0,0 +1,304 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	gohash "hash"
+	"io"
+	"os"
+	"time"
+)
+
+// Reader opens the file with the given name for streaming.
+// Unless the store is already locked, a read lock is held until the returned reader is closed: writing to the store
+// (from this process or any other) will block until then.
+func (st *Store) Reader(name string) (io.ReadCloser, error) {
+	var (
+		lock func() error
+		err  error
+	)
+
+	if st.lock == nil {
+		if lock, err = st.acquire(false); err != nil {
+			return nil, err
+		}
+	}
+
+	meta, file, payload, err := st.openEntry(hash(name))
+	if err != nil {
+		return nil, errors.Join(err, unlockIfOwned(lock))
+	}
+
+	if meta != nil && meta.Expired(time.Now()) {
+		return nil, errors.Join(ErrFileStoreFail, errEntryExpired, ErrNotFound, payload.Close(), file.Close(),
+			unlockIfOwned(lock))
+	}
+
+	st.touch(hash(name))
+
+	return &entryReader{
+		payload: payload,
+		file:    file,
+		lock:    lock,
+	}, nil
+}
+
+// Writer opens the file with the given name for streaming.
+// See WriterWithMetadata.
+func (st *Store) Writer(name string) (io.WriteCloser, error) {
+	return st.WriterWithMetadata(name, nil)
+}
+
+// openEntry opens the value of the entry stored under key for streaming, from its blob if it refers to one.
+// Metadata is nil for entries written by older versions.
+func (st *Store) openEntry(key string) (*Metadata, io.ReadCloser, io.ReadCloser, error) {
+	file, err := openValue(st.backend, key)
+	if err != nil {
+		return nil, nil, nil, errors.Join(ErrFileStoreFail, notFound(err))
+	}
+
+	meta, payload, err := st.codec.newReader(file)
+	if err != nil {
+		return nil, nil, nil, errors.Join(ErrFileStoreFail, err, file.Close())
+	}
+
+	if meta == nil || meta.Digest == "" {
+		return meta, file, payload, nil
+	}
+
+	if err = errors.Join(payload.Close(), file.Close()); err != nil {
+		return nil, nil, nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	file, payload, err = st.openBlob(meta.Digest)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return meta, file, payload, nil
+}
+
+// WriterWithMetadata opens the file with the given name for streaming, along with the provided metadata (see
+// WriteWithMetadata), except that meta.Size, if set, declares the size of the value: it is recorded, so that listing
+// does not have to decode the value to measure it (compressed values notably), and closing fails if the size of the
+// data written differs.
+// Data is staged (to a temporary file, with the default backend), and only replaces the current value when the writer is
+// closed. If any write fails, closing discards everything instead.
+// Unless the store is already locked, the write lock is held until the returned writer is closed: any other access to
+// the store (from this process or any other) will block until then.
+func (st *Store) WriterWithMetadata(name string, meta *Metadata) (io.WriteCloser, error) {
+	var (
+		lock func() error
+		err  error
+	)
+
+	if st.lock == nil {
+		if lock, err = st.acquire(true); err != nil {
+			return nil, err
+		}
+	}
+
+	var size int64
+	if meta != nil {
+		size = meta.Size
+	}
+
+	writer, err := st.stageEntry(name, meta, size)
+	if err != nil {
+		return nil, errors.Join(err, unlockIfOwned(lock))
+	}
+
+	writer.lock = lock
+
+	return writer, nil
+}
+
+// stageEntry starts writing a new entry to the backend, of the given size if known (zero otherwise). The caller must
+// hold the write lock.
+func (st *Store) stageEntry(name string, meta *Metadata, size int64) (*entryWriter, error) {
+	key := hash(name)
+
+	previous, _ := st.readMetadata(key)
+
+	pending, err := createValue(st.backend)
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	now := time.Now()
+	writer := &entryWriter{
+		store:   st,
+		key:     key,
+		pending: pending,
+		meta:    st.newMetadata(name, previous, meta, now),
+	}
+
+	writer.meta.Size = size
+
+	// In content-addressable mode, the pending value is the blob, and the entry referring to it is written on commit,
+	// once the digest is known.
+	if st.contentAddressable {
+		writer.hasher = sha256.New()
+		writer.payload, err = st.codec.newWriter(pending, newBlobMetadata(now), st.codec.flags(false))
+	} else {
+		writer.payload, err = st.codec.newWriter(pending, writer.meta, st.codec.flags(false))
+	}
+
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err, pending.Discard())
+	}
+
+	return writer, nil
+}
+
+type entryReader struct {
+	payload io.ReadCloser
+	file    io.Closer
+	lock    func() error
+	closed  bool
+}
+
+func (reader *entryReader) Read(data []byte) (int, error) {
+	if reader.closed {
+		return 0, errors.Join(ErrFileStoreFail, os.ErrClosed)
+	}
+
+	return reader.payload.Read(data)
+}
+
+func (reader *entryReader) Close() error {
+	if reader.closed {
+		return nil
+	}
+
+	reader.closed = true
+
+	err := errors.Join(reader.payload.Close(), reader.file.Close())
+	if err != nil {
+		err = errors.Join(ErrFileStoreFail, err)
+	}
+
+	return errors.Join(err, unlockIfOwned(reader.lock))
+}
+
+type entryWriter struct {
+	store   *Store
+	key     string
+	pending PendingValue
+	meta    *Metadata
+	payload io.WriteCloser
+	hasher  gohash.Hash
+	written int64
+	lock    func() error
+	failed  error
+	closed  bool
+}
+
+func (writer *entryWriter) Write(data []byte) (int, error) {
+	if writer.closed {
+		return 0, errors.Join(ErrFileStoreFail, os.ErrClosed)
+	}
+
+	if writer.failed != nil {
+		return 0, writer.failed
+	}
+
+	n, err := writer.payload.Write(data)
+	if err != nil {
+		writer.failed = errors.Join(ErrFileStoreFail, err)
+	}
+
+	if writer.hasher != nil {
+		writer.hasher.Write(data[:n])
+	}
+
+	writer.written += int64(n)
+
+	return n, writer.failed
+}
+
+func (writer *entryWriter) Close() error {
+	if writer.closed {
+		return nil
+	}
+
+	writer.closed = true
+
+	err := writer.failed
+	if err != nil {
+		err = errors.Join(err, writer.pending.Discard())
+	} else {
+		err = writer.commit()
+	}
+
+	return errors.Join(err, unlockIfOwned(writer.lock))
+}
+
+func (writer *entryWriter) commit() error {
+	if writer.meta.Size > 0 && writer.written != writer.meta.Size {
+		return errors.Join(ErrFileStoreFail, errSizeMismatch, writer.payload.Close(), writer.pending.Discard())
+	}
+
+	if err := writer.payload.Close(); err != nil {
+		return errors.Join(ErrFileStoreFail, err, writer.pending.Discard())
+	}
+
+	st := writer.store
+
+	if writer.hasher == nil {
+		err := st.tracked(writer.key, func() error {
+			return writer.pending.Commit(writer.key)
+		})
+		if err != nil {
+			return errors.Join(ErrFileStoreFail, err)
+		}
+
+		return st.evict(writer.key)
+	}
+
+	writer.meta.Digest = hex.EncodeToString(writer.hasher.Sum(nil))
+	writer.meta.Size = writer.written
+
+	if err := st.commitBlob(writer.pending, writer.meta.Digest); err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	data, err := st.codec.encode(writer.meta, nil)
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	err = st.tracked(writer.key, func() error {
+		return st.backend.Write(writer.key, data)
+	})
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	return st.evict(writer.key)
+}
+
+func unlockIfOwned(lock func() error) error {
+	if lock == nil {
+		return nil
+	}
+
+	return release(lock)
+}
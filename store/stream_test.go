@@ -0,0 +1,102 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+)
+
+func TestStoreStream(t *testing.T) {
+	t.Parallel()
+
+	st := store.New(&store.Options{Path: t.TempDir()})
+
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+	writer, err := st.WriterWithMetadata("blob", &store.Metadata{ContentType: "application/octet-stream"})
+	assert.NilError(t, err)
+
+	for range 128 {
+		_, err = writer.Write(chunk)
+		assert.NilError(t, err)
+	}
+
+	assert.NilError(t, writer.Close())
+	assert.NilError(t, writer.Close(), "closing twice is a no-op")
+
+	_, err = writer.Write(chunk)
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	reader, err := st.Reader("blob")
+	assert.NilError(t, err)
+
+	received := &bytes.Buffer{}
+	size, err := io.Copy(received, reader)
+	assert.NilError(t, err)
+	assert.NilError(t, reader.Close())
+	assert.Equal(t, size, int64(128*len(chunk)))
+	assert.Assert(t, bytes.Equal(received.Bytes()[:len(chunk)], chunk))
+
+	entries, err := st.List("blob")
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Size, size)
+	assert.Equal(t, entries[0].Metadata.ContentType, "application/octet-stream")
+
+	_, err = st.Reader("missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestStoreStreamHoldsLock(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	st := store.New(&store.Options{Path: dir})
+	assert.NilError(t, st.Write("key", []byte("old")))
+
+	writer, err := st.Writer("key")
+	assert.NilError(t, err)
+
+	_, err = writer.Write([]byte("new"))
+	assert.NilError(t, err)
+
+	// Readers (here from another store instance, as another process would) have to wait for the writer to close.
+	result := make(chan string)
+
+	go func() {
+		content, _ := store.New(&store.Options{Path: dir}).Read("key")
+		result <- string(content)
+	}()
+
+	select {
+	case content := <-result:
+		t.Fatalf("read %q while the writer was still open", content)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	assert.NilError(t, writer.Close())
+	assert.Equal(t, <-result, "new")
+}
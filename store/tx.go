@@ -0,0 +1,541 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// A transaction is committed by atomically writing a journal listing every operation, then applying them, then
+// removing the journal.
+// A crash before the journal is written leaves the store untouched (staged values are simply never applied), while a
+// crash after means the journal is replayed the next time the store is locked.
+// Replaying is idempotent: puts whose staged value is gone have already been moved into place, and deleting a missing
+// key is a no-op.
+
+type txOp struct {
+	Key string `json:"key"`
+	// Staged is the name of the staged value, under the staging namespace (see stagedKey).
+	Staged string `json:"staged,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+	// Blob marks the staged value as a content-addressed blob, with Key being its digest.
+	Blob bool `json:"blob,omitempty"`
+}
+
+// id is the backend key the operation targets, as blob digests and entry keys live in different namespaces.
+func (op *txOp) id() string {
+	if op.Blob {
+		return blobKey(op.Key)
+	}
+
+	return op.Key
+}
+
+type journal struct {
+	Ops []*txOp `json:"ops"`
+}
+
+// Tx stages writes and deletes to be committed all at once by Store.Update.
+type Tx struct {
+	store  *Store
+	ops    []*txOp
+	byKey  map[string]*txOp
+	closed bool
+}
+
+// Update runs function inside a transaction, holding the write lock for its whole duration.
+// If function returns nil, every write and delete staged on the transaction is committed atomically.
+// Otherwise, nothing is applied and the error is returned.
+func (st *Store) Update(function func(tx *Tx) error) (err error) {
+	if st.lock == nil {
+		err = st.WriteLock()
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	trx := &Tx{
+		store: st,
+		byKey: map[string]*txOp{},
+	}
+
+	defer func() {
+		trx.closed = true
+	}()
+
+	if err = function(trx); err != nil {
+		return errors.Join(err, trx.rollback())
+	}
+
+	return trx.commit()
+}
+
+// Read reads the content of a file by its name, as seen by the transaction.
+func (tx *Tx) Read(name string) ([]byte, error) {
+	return tx.ReadFromKey(hash(name))
+}
+
+// ReadFromKey reads the content of a file by its key, as seen by the transaction.
+func (tx *Tx) ReadFromKey(key string) ([]byte, error) {
+	meta, content, err := tx.readEntry(key)
+	if err == nil && meta != nil && meta.Digest != "" {
+		content, err = tx.readBlob(meta.Digest)
+	}
+
+	return content, err
+}
+
+// Has checks if a file with the given name exists, as seen by the transaction.
+func (tx *Tx) Has(name string) (bool, error) {
+	if tx.closed {
+		return false, errors.Join(ErrFileStoreFail, errTxClosed)
+	}
+
+	if _, ok := tx.byKey[hash(name)]; !ok {
+		return tx.store.Has(name)
+	}
+
+	_, _, err := tx.readEntry(hash(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Write stages the content to be written to a file with the given name.
+func (tx *Tx) Write(name string, value []byte) error {
+	return tx.WriteWithMetadata(name, value, nil)
+}
+
+// WriteWithMetadata stages the content to be written to a file with the given name, along with the provided metadata.
+// See Store.WriteWithMetadata.
+func (tx *Tx) WriteWithMetadata(name string, value []byte, meta *Metadata) error {
+	if tx.closed {
+		return errors.Join(ErrFileStoreFail, errTxClosed)
+	}
+
+	key := hash(name)
+
+	var previous *Metadata
+	if _, ok := tx.byKey[key]; ok {
+		previous, _, _ = tx.readEntry(key)
+	} else {
+		previous, _ = tx.store.readMetadata(key)
+	}
+
+	now := time.Now()
+
+	return tx.put(key, tx.store.newMetadata(name, previous, meta, now), value, now)
+}
+
+// put stages value to be written under key, with meta as is, except for the digest, which is set as per the store mode.
+func (tx *Tx) put(key string, meta *Metadata, value []byte, now time.Time) error {
+	meta.Digest = ""
+	meta.Size = int64(len(value))
+
+	if tx.store.contentAddressable {
+		meta.Digest = digestOf(value)
+
+		if err := tx.stageBlob(meta.Digest, value, now); err != nil {
+			return err
+		}
+
+		value = nil
+	}
+
+	data, err := tx.store.codec.encode(meta, value)
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	return tx.stage(key, data)
+}
+
+// putFrom stages the value read from reader, of the given size, as put does, without holding it in memory.
+func (tx *Tx) putFrom(key string, meta *Metadata, reader io.Reader, size int64, now time.Time) error {
+	meta.Digest = ""
+	meta.Size = size
+
+	if !tx.store.contentAddressable {
+		staged, err := tx.store.stageFrom(meta, reader, size)
+		if err != nil {
+			return errors.Join(ErrFileStoreFail, err)
+		}
+
+		return tx.record(&txOp{Key: key, Staged: staged})
+	}
+
+	// The digest is only known once the blob is staged, which is then dropped if it turns out to be stored already.
+	hasher := sha256.New()
+
+	staged, err := tx.store.stageFrom(newBlobMetadata(now), io.TeeReader(reader, hasher), size)
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	meta.Digest = hex.EncodeToString(hasher.Sum(nil))
+
+	blob := &txOp{Key: meta.Digest, Blob: true}
+	if _, ok := tx.byKey[blob.id()]; ok || tx.store.hasBlob(meta.Digest) {
+		err = tx.store.backend.Delete(stagedKey(staged))
+	} else {
+		blob.Staged = staged
+		err = tx.record(blob)
+	}
+
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	data, err := tx.store.codec.encode(meta, nil)
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	return tx.stage(key, data)
+}
+
+// Delete stages the removal of a file with the given name.
+func (tx *Tx) Delete(name string) error {
+	if tx.closed {
+		return errors.Join(ErrFileStoreFail, errTxClosed)
+	}
+
+	return tx.record(&txOp{Key: hash(name), Delete: true})
+}
+
+// Rename stages renaming a file from oldName to newName.
+// The entry keeps its metadata, except for its name.
+func (tx *Tx) Rename(oldName, newName string) error {
+	meta, payload, err := tx.readEntry(hash(oldName))
+	if err != nil {
+		return err
+	}
+
+	if oldName == newName {
+		return nil
+	}
+
+	if meta == nil {
+		meta = tx.store.newMetadata(newName, nil, nil, time.Now())
+		meta.Size = int64(len(payload))
+	}
+
+	meta.Name = newName
+
+	data, err := tx.store.codec.encode(meta, payload)
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	if err = tx.stage(hash(newName), data); err != nil {
+		return err
+	}
+
+	return tx.Delete(oldName)
+}
+
+func (tx *Tx) stage(key string, data []byte) error {
+	staged, err := tx.store.stage(data)
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	return tx.record(&txOp{Key: key, Staged: staged})
+}
+
+// stageBlob stages a blob, unless it is already stored or staged.
+func (tx *Tx) stageBlob(digest string, value []byte, now time.Time) error {
+	blob := &txOp{Key: digest, Blob: true}
+	if _, ok := tx.byKey[blob.id()]; ok || tx.store.hasBlob(digest) {
+		return nil
+	}
+
+	data, err := tx.store.codec.encode(newBlobMetadata(now), value)
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	if blob.Staged, err = tx.store.stage(data); err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	return tx.record(blob)
+}
+
+// readBlob reads the blob with the given digest, as seen by the transaction.
+func (tx *Tx) readBlob(digest string) ([]byte, error) {
+	op, ok := tx.byKey[(&txOp{Key: digest, Blob: true}).id()]
+	if !ok {
+		return tx.store.readBlob(digest)
+	}
+
+	data, err := tx.store.backend.Read(stagedKey(op.Staged))
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	_, payload, err := tx.store.codec.decode(data)
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	return payload, nil
+}
+
+// readRaw reads the undecoded entry stored under key, as seen by the transaction.
+func (tx *Tx) readRaw(key string) ([]byte, error) {
+	op, ok := tx.byKey[key]
+	if !ok {
+		data, err := tx.store.backend.Read(key)
+		if err != nil {
+			err = errors.Join(ErrFileStoreFail, notFound(err))
+		}
+
+		return data, err
+	}
+
+	if op.Delete {
+		return nil, errors.Join(ErrFileStoreFail, ErrNotFound)
+	}
+
+	data, err := tx.store.backend.Read(stagedKey(op.Staged))
+	if err != nil {
+		err = errors.Join(ErrFileStoreFail, err)
+	}
+
+	return data, err
+}
+
+// readEntry reads and decodes the entry stored under key, as seen by the transaction.
+func (tx *Tx) readEntry(key string) (*Metadata, []byte, error) {
+	if tx.closed {
+		return nil, nil, errors.Join(ErrFileStoreFail, errTxClosed)
+	}
+
+	data, err := tx.readRaw(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta, payload, err := tx.store.codec.decode(data)
+	if err != nil {
+		return nil, nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	if meta != nil && meta.Expired(time.Now()) {
+		return nil, nil, errors.Join(ErrFileStoreFail, errEntryExpired, ErrNotFound)
+	}
+
+	return meta, payload, nil
+}
+
+func (tx *Tx) record(op *txOp) error {
+	// Only the last operation on a given key matters.
+	if previous, ok := tx.byKey[op.id()]; ok {
+		if previous.Staged != "" {
+			if err := tx.store.backend.Delete(stagedKey(previous.Staged)); err != nil {
+				return errors.Join(ErrFileStoreFail, err)
+			}
+		}
+
+		*previous = *op
+	} else {
+		tx.byKey[op.id()] = op
+		tx.ops = append(tx.ops, op)
+	}
+
+	return nil
+}
+
+func (tx *Tx) rollback() error {
+	var errs []error
+
+	for _, op := range tx.ops {
+		if op.Staged != "" {
+			if err := tx.store.backend.Delete(stagedKey(op.Staged)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(ErrFileStoreFail, errors.Join(errs...))
+	}
+
+	return nil
+}
+
+func (tx *Tx) commit() error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	if err := tx.store.writeJournal(&journal{Ops: tx.ops}); err != nil {
+		return errors.Join(ErrFileStoreFail, err, tx.rollback())
+	}
+
+	if err := tx.store.recover(); err != nil {
+		return err
+	}
+
+	written := []string{}
+
+	for _, op := range tx.ops {
+		if !op.Blob && !op.Delete {
+			written = append(written, op.Key)
+		}
+	}
+
+	return tx.store.evict(written...)
+}
+
+// stage stores data under a new key in the staging namespace, and returns its name there.
+func (st *Store) stage(data []byte) (string, error) {
+	staged, err := newStagedName()
+	if err != nil {
+		return "", err
+	}
+
+	return staged, st.backend.Write(stagedKey(staged), data)
+}
+
+// stageFrom stages the value read from reader, of the given size, encoded with meta, as stage does.
+func (st *Store) stageFrom(meta *Metadata, reader io.Reader, size int64) (string, error) {
+	staged, err := newStagedName()
+	if err != nil {
+		return "", err
+	}
+
+	pending, err := createValue(st.backend)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := st.codec.newWriter(pending, meta, st.codec.flags(size == 0))
+	if err != nil {
+		return "", errors.Join(err, pending.Discard())
+	}
+
+	written, err := io.Copy(payload, reader)
+	if err == nil && written != size {
+		err = errSizeMismatch
+	}
+
+	if err = errors.Join(err, payload.Close()); err != nil {
+		return "", errors.Join(err, pending.Discard())
+	}
+
+	return staged, pending.Commit(stagedKey(staged))
+}
+
+func newStagedName() (string, error) {
+	name := make([]byte, stagedNameSize)
+	if _, err := rand.Read(name); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(name), nil
+}
+
+func (st *Store) writeJournal(jrnl *journal) error {
+	data, err := json.Marshal(jrnl)
+	if err != nil {
+		return err
+	}
+
+	return st.backend.Write(journalFileName, data)
+}
+
+// recover replays a committed journal, if there is one.
+// It must be called while holding the write lock.
+func (st *Store) recover() error {
+	data, err := st.backend.Read(journalFileName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	jrnl := &journal{}
+	if err = json.Unmarshal(data, jrnl); err != nil {
+		return errors.Join(ErrFileStoreFail, errCorruptJournal, err)
+	}
+
+	for _, op := range jrnl.Ops {
+		if op.Delete {
+			err = st.deleteValue(op.Key)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return errors.Join(ErrFileStoreFail, err)
+			}
+
+			continue
+		}
+
+		staged, err := st.backend.Has(stagedKey(op.Staged))
+		if err != nil {
+			return errors.Join(ErrFileStoreFail, err)
+		}
+
+		if !staged {
+			continue
+		}
+
+		// Blobs are only staged when missing, or when rewritten by RotateKey, so they are always moved into place.
+		err = st.tracked(op.id(), func() error {
+			return moveValue(st.backend, stagedKey(op.Staged), op.id())
+		})
+		if err != nil {
+			return errors.Join(ErrFileStoreFail, err)
+		}
+	}
+
+	if err = st.backend.Delete(journalFileName); err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	return nil
+}
+
+func (st *Store) hasJournal() (bool, error) {
+	has, err := st.backend.Has(journalFileName)
+	if err != nil {
+		err = errors.Join(ErrFileStoreFail, err)
+	}
+
+	return has, err
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// crash stages the given operations and optionally writes the journal, then drops the lock without applying anything,
+// as if the process died.
+func crash(t *testing.T, st *Store, commit bool, puts map[string]string, deletes ...string) {
+	t.Helper()
+
+	assert.NilError(t, st.WriteLock())
+
+	jrnl := &journal{}
+
+	for name, value := range puts {
+		staged, err := st.stage([]byte(value))
+		assert.NilError(t, err)
+
+		jrnl.Ops = append(jrnl.Ops, &txOp{Key: hash(name), Staged: staged})
+	}
+
+	for _, name := range deletes {
+		jrnl.Ops = append(jrnl.Ops, &txOp{Key: hash(name), Delete: true})
+	}
+
+	if commit {
+		assert.NilError(t, st.writeJournal(jrnl))
+	}
+
+	assert.NilError(t, st.Unlock())
+}
+
+func assertContent(t *testing.T, st *Store, name, expected string) {
+	t.Helper()
+
+	if expected == "" {
+		has, err := st.Has(name)
+		assert.NilError(t, err)
+		assert.Assert(t, !has, name)
+
+		return
+	}
+
+	content, err := st.Read(name)
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), expected, name)
+}
+
+func TestRecoverCommitted(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	st := New(&Options{Path: dir})
+	assert.NilError(t, st.Write("one", []byte("1")))
+	assert.NilError(t, st.Write("two", []byte("2")))
+
+	crash(t, st, true, map[string]string{"one": "one", "three": "3"}, "two")
+
+	// Reopening and reading must replay the journal.
+	st = New(&Options{Path: dir})
+	assertContent(t, st, "one", "one")
+	assertContent(t, st, "two", "")
+	assertContent(t, st, "three", "3")
+	hasJournal, err := st.hasJournal()
+	assert.NilError(t, err)
+	assert.Assert(t, !hasJournal)
+}
+
+func TestRecoverUncommitted(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	st := New(&Options{Path: dir})
+	assert.NilError(t, st.Write("one", []byte("1")))
+	assert.NilError(t, st.Write("two", []byte("2")))
+
+	crash(t, st, false, map[string]string{"one": "one", "three": "3"}, "two")
+
+	st = New(&Options{Path: dir})
+	assertContent(t, st, "one", "1")
+	assertContent(t, st, "two", "2")
+	assertContent(t, st, "three", "")
+}
+
+func TestRecoverPartiallyApplied(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	st := New(&Options{Path: dir})
+	assert.NilError(t, st.Write("two", []byte("2")))
+
+	crash(t, st, true, map[string]string{"one": "one"}, "two")
+
+	// Apply only part of the journal by hand, then let recovery finish the job.
+	assert.NilError(t, st.backend.Delete(hash("two")))
+
+	st = New(&Options{Path: dir})
+	assertContent(t, st, "one", "one")
+	assertContent(t, st, "two", "")
+}
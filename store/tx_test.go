@@ -0,0 +1,122 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+)
+
+var errAbort = errors.New("abort")
+
+func TestStoreUpdate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	st := store.New(&store.Options{Path: dir})
+	assert.NilError(t, st.Write("one", []byte("1")))
+	assert.NilError(t, st.Write("two", []byte("2")))
+
+	err := st.Update(func(tx *store.Tx) error {
+		assert.NilError(t, tx.Write("three", []byte("3")))
+		assert.NilError(t, tx.Write("one", []byte("one")))
+		assert.NilError(t, tx.Delete("two"))
+
+		// Reads see staged changes.
+		content, err := tx.Read("one")
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), "one")
+
+		has, err := tx.Has("two")
+		assert.NilError(t, err)
+		assert.Assert(t, !has)
+
+		return nil
+	})
+	assert.NilError(t, err)
+
+	content, err := st.Read("one")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "one")
+
+	content, err = st.Read("three")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "3")
+
+	has, err := st.Has("two")
+	assert.NilError(t, err)
+	assert.Assert(t, !has)
+
+	// Nothing is left in staging or in the journal.
+	entries, err := os.ReadDir(filepath.Join(dir, ".tmp"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+
+	_, err = os.Stat(filepath.Join(dir, ".journal"))
+	assert.Assert(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestStoreUpdateRollback(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	st := store.New(&store.Options{Path: dir})
+	assert.NilError(t, st.Write("one", []byte("1")))
+
+	err := st.Update(func(tx *store.Tx) error {
+		assert.NilError(t, tx.Write("one", []byte("one")))
+		assert.NilError(t, tx.Write("two", []byte("2")))
+
+		return errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+
+	content, err := st.Read("one")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "1")
+
+	has, err := st.Has("two")
+	assert.NilError(t, err)
+	assert.Assert(t, !has)
+
+	entries, err := os.ReadDir(filepath.Join(dir, ".tmp"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestStoreUpdateClosed(t *testing.T) {
+	t.Parallel()
+
+	st := store.New(&store.Options{Path: t.TempDir()})
+
+	var leaked *store.Tx
+
+	assert.NilError(t, st.Update(func(tx *store.Tx) error {
+		leaked = tx
+
+		return nil
+	}))
+
+	assert.ErrorIs(t, leaked.Write("late", []byte("late")), store.ErrFileStoreFail)
+}
@@ -0,0 +1,210 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeGob  = "application/x-gob"
+	contentTypeCBOR = "application/cbor"
+)
+
+// Codec turns values into bytes and back, for Typed.
+type Codec interface {
+	Marshal(value any) ([]byte, error)
+	Unmarshal(data []byte, value any) error
+	// ContentType is recorded in the metadata of the entries written with the codec.
+	ContentType() string
+}
+
+// JSONCodec encodes values as JSON.
+type JSONCodec struct{}
+
+// Marshal encodes value as JSON.
+//
+//nolint:wrapcheck
+func (JSONCodec) Marshal(value any) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+// Unmarshal decodes JSON data into value.
+//
+//nolint:wrapcheck
+func (JSONCodec) Unmarshal(data []byte, value any) error {
+	return json.Unmarshal(data, value)
+}
+
+// ContentType returns the media type of JSON.
+func (JSONCodec) ContentType() string {
+	return contentTypeJSON
+}
+
+// GobCodec encodes values with encoding/gob. Every value is a self-contained gob stream, type information included.
+type GobCodec struct{}
+
+// Marshal encodes value as gob.
+//
+//nolint:wrapcheck
+func (GobCodec) Marshal(value any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(value); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes gob data into value.
+//
+//nolint:wrapcheck
+func (GobCodec) Unmarshal(data []byte, value any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// ContentType returns the media type of gob.
+func (GobCodec) ContentType() string {
+	return contentTypeGob
+}
+
+// CBORCodec encodes values as CBOR (RFC 8949), which is more compact than JSON, and keeps binary data as is.
+type CBORCodec struct{}
+
+// Marshal encodes value as CBOR.
+//
+//nolint:wrapcheck
+func (CBORCodec) Marshal(value any) ([]byte, error) {
+	return cbor.Marshal(value)
+}
+
+// Unmarshal decodes CBOR data into value.
+//
+//nolint:wrapcheck
+func (CBORCodec) Unmarshal(data []byte, value any) error {
+	return cbor.Unmarshal(data, value)
+}
+
+// ContentType returns the media type of CBOR.
+func (CBORCodec) ContentType() string {
+	return contentTypeCBOR
+}
+
+// Typed reads and writes values of type T in a store, encoded with a Codec.
+type Typed[T any] struct {
+	store *Store
+	codec Codec
+}
+
+// NewTyped returns a Typed using st, encoding values with codec (JSONCodec if nil).
+func NewTyped[T any](st *Store, codec Codec) *Typed[T] {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	return &Typed[T]{store: st, codec: codec}
+}
+
+// Get returns the value stored under name, or an error matching ErrNotFound if there is none.
+func (typed *Typed[T]) Get(name string) (T, error) {
+	var value T
+
+	data, err := typed.store.Read(name)
+	if err != nil {
+		return value, err
+	}
+
+	err = typed.decode(data, &value)
+
+	return value, err
+}
+
+// Put stores value under name.
+func (typed *Typed[T]) Put(name string, value T) error {
+	data, err := typed.codec.Marshal(value)
+	if err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	return typed.store.WriteWithMetadata(name, data, &Metadata{ContentType: typed.codec.ContentType()})
+}
+
+// Delete removes the value stored under name, or fails with an error matching ErrNotFound if there is none.
+func (typed *Typed[T]) Delete(name string) error {
+	return typed.store.Delete(name)
+}
+
+// List returns every value whose name starts with prefix, by name, while holding a read lock.
+// Every entry matching prefix must hold a T.
+func (typed *Typed[T]) List(prefix string) (values map[string]T, err error) {
+	st := typed.store
+
+	if st.lock == nil {
+		err = st.ReadOnlyLock()
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	entries, err := st.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	values = map[string]T{}
+
+	for _, entry := range entries {
+		// Entries without a name (written by older versions) cannot be told apart.
+		if entry.Name == "" {
+			continue
+		}
+
+		_, data, err := st.readEntry(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		var value T
+		if err = typed.decode(data, &value); err != nil {
+			return nil, err
+		}
+
+		values[entry.Name] = value
+	}
+
+	return values, nil
+}
+
+func (typed *Typed[T]) decode(data []byte, value *T) error {
+	if err := typed.codec.Unmarshal(data, value); err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	return nil
+}
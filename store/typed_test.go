@@ -0,0 +1,86 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"os"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+)
+
+type record struct {
+	Name  string
+	Count int
+	Data  []byte
+}
+
+func TestTyped(t *testing.T) {
+	t.Parallel()
+
+	for name, codec := range map[string]store.Codec{
+		"default": nil,
+		"json":    store.JSONCodec{},
+		"gob":     store.GobCodec{},
+		"cbor":    store.CBORCodec{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			st := store.New(&store.Options{Path: t.TempDir()})
+			typed := store.NewTyped[*record](st, codec)
+
+			_, err := typed.Get("missing")
+			assert.ErrorIs(t, err, store.ErrNotFound)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+			assert.ErrorIs(t, typed.Delete("missing"), store.ErrNotFound)
+
+			assert.NilError(t, typed.Put("records/one", &record{Name: "one", Count: 1, Data: []byte{0, 1}}))
+			assert.NilError(t, typed.Put("records/two", &record{Name: "two", Count: 2}))
+			assert.NilError(t, st.Write("other", []byte("not a record")))
+
+			value, err := typed.Get("records/one")
+			assert.NilError(t, err)
+			assert.Equal(t, value.Name, "one")
+			assert.Equal(t, value.Count, 1)
+			assert.DeepEqual(t, value.Data, []byte{0, 1})
+
+			meta, err := st.Metadata("records/one")
+			assert.NilError(t, err)
+			assert.Assert(t, meta.ContentType != "")
+
+			values, err := typed.List("records/")
+			assert.NilError(t, err)
+			assert.Equal(t, len(values), 2)
+			assert.Equal(t, values["records/two"].Count, 2)
+
+			_, err = typed.Get("other")
+			assert.ErrorIs(t, err, store.ErrFileStoreFail)
+
+			_, err = typed.List("")
+			assert.ErrorIs(t, err, store.ErrFileStoreFail)
+
+			assert.NilError(t, typed.Delete("records/one"))
+
+			_, err = typed.Get("records/one")
+			assert.ErrorIs(t, err, store.ErrNotFound)
+		})
+	}
+}
@@ -0,0 +1,378 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ProblemKind is the kind of problem found by Verify.
+type ProblemKind string
+
+const (
+	// ProblemStray is a file or directory that is not part of the backend layout. Repair removes it.
+	ProblemStray ProblemKind = "stray"
+	// ProblemStaleStaged is a staged value left behind by an interrupted write. Repair removes it.
+	ProblemStaleStaged ProblemKind = "stale-staged"
+	// ProblemCorrupt is an entry or blob that cannot be decoded. Repair removes it.
+	ProblemCorrupt ProblemKind = "corrupt"
+	// ProblemIntegrity is a blob whose content does not match its digest. Repair removes it.
+	ProblemIntegrity ProblemKind = "integrity"
+	// ProblemMissingBlob is an entry referring to a blob that is missing, or removed as per another problem. Repair
+	// removes it.
+	ProblemMissingBlob ProblemKind = "missing-blob"
+	// ProblemUnreferencedBlob is a blob that no entry refers to. Repair removes it, as GC would.
+	ProblemUnreferencedBlob ProblemKind = "unreferenced-blob"
+	// ProblemKeyMismatch is an entry stored under another key than the digest of its name. Repair moves it under the
+	// right key, unless another entry is stored there already, in which case it is removed.
+	ProblemKeyMismatch ProblemKind = "key-mismatch"
+	// ProblemInvalidKey is an entry without a name, stored under a key that is not a digest. It is only reported.
+	ProblemInvalidKey ProblemKind = "invalid-key"
+	// ProblemUnreadable is an entry or blob that cannot be read for any other reason, typically because it cannot be
+	// decrypted with the keys provided, or was written by a newer version. It is only reported, as it may just need
+	// another key, or another version.
+	ProblemUnreadable ProblemKind = "unreadable"
+)
+
+// Problem is something wrong found by Verify.
+type Problem struct {
+	Kind ProblemKind `json:"kind"`
+	// Key is the backend key concerned - or the path, for problems with the backend storage itself.
+	Key string `json:"key"`
+	// Detail describes the problem further, if there is more to say.
+	Detail string `json:"detail,omitempty"`
+	// Repaired is set once Repair has fixed the problem.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// Report is the outcome of Verify or Repair.
+type Report struct {
+	// Entries and Blobs count what was checked.
+	Entries  int        `json:"entries"`
+	Blobs    int        `json:"blobs"`
+	Problems []*Problem `json:"problems"`
+}
+
+// Healthy tells whether there is nothing left to repair.
+func (report *Report) Healthy() bool {
+	for _, problem := range report.Problems {
+		if !problem.Repaired {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Verifier is implemented by backends able to check their storage, beyond the values they hold.
+type Verifier interface {
+	// Verify reports what does not belong in the backend storage, and removes it if repair is set.
+	// It is called while holding the backend lock - the write lock if repair is set.
+	Verify(repair bool) ([]*Problem, error)
+}
+
+// Verify checks the whole store while holding a read lock, and reports what is wrong with it, without changing anything.
+// Every entry and blob is read and decoded, which authenticates encrypted ones, and blobs are checked against their
+// digest. Expired entries are checked as well.
+func (st *Store) Verify() (report *Report, err error) {
+	if st.lock == nil {
+		err = st.ReadOnlyLock()
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	return st.check(false)
+}
+
+// Repair checks the whole store like Verify, but while holding the write lock, and fixes what it can (see ProblemKind).
+// An interrupted transaction is replayed first, as it is every time the write lock is acquired.
+func (st *Store) Repair() (report *Report, err error) {
+	if st.lock == nil {
+		err = st.WriteLock()
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if unlockErr := st.Unlock(); unlockErr != nil {
+				err = errors.Join(err, unlockErr)
+			}
+		}()
+	}
+
+	return st.check(true)
+}
+
+// check verifies the store, and repairs it if asked to. The caller must hold the lock.
+func (st *Store) check(repair bool) (*Report, error) {
+	report := &Report{Problems: []*Problem{}}
+
+	if verifier, ok := st.backend.(Verifier); ok {
+		problems, err := verifier.Verify(repair)
+		if err != nil {
+			return nil, errors.Join(ErrFileStoreFail, err)
+		}
+
+		report.Problems = append(report.Problems, problems...)
+	}
+
+	// Once the lock is held and the journal replayed, nothing can be pending.
+	staged := []string{}
+
+	err := st.backend.Keys(stagedKey(""), func(key string) error {
+		staged = append(staged, key)
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	for _, key := range staged {
+		if err = st.fix(report, &Problem{Kind: ProblemStaleStaged, Key: key}, repair); err != nil {
+			return nil, err
+		}
+	}
+
+	// Blobs go first, so that entries know which blobs they can rely on.
+	blobs, err := st.checkBlobs(report, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced, err := st.checkEntries(report, blobs, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries that cannot be read may refer to any blob.
+	for _, problem := range report.Problems {
+		if problem.Kind == ProblemUnreadable && isEntryKey(problem.Key) {
+			return report, nil
+		}
+	}
+
+	for _, digest := range slices.Sorted(maps.Keys(blobs)) {
+		if blobs[digest] != nil || referenced[digest] {
+			continue
+		}
+
+		if err = st.fix(report, &Problem{Kind: ProblemUnreferencedBlob, Key: blobKey(digest)}, repair); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// checkBlobs checks every blob, and returns the problem found with each of them (nil for healthy ones).
+func (st *Store) checkBlobs(report *Report, repair bool) (map[string]*Problem, error) {
+	digests := []string{}
+
+	err := st.walkBlobs(func(digest string) error {
+		digests = append(digests, digest)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := map[string]*Problem{}
+
+	for _, digest := range digests {
+		report.Blobs++
+
+		problem := classify(blobKey(digest), st.verifyBlob(digest))
+		blobs[digest] = problem
+
+		if problem == nil {
+			continue
+		}
+
+		if err = st.fix(report, problem, repair); err != nil {
+			return nil, err
+		}
+	}
+
+	return blobs, nil
+}
+
+// checkEntries checks every entry, and tells which blobs they refer to.
+func (st *Store) checkEntries(report *Report, blobs map[string]*Problem, repair bool) (map[string]bool, error) {
+	keys, err := st.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := map[string]bool{}
+
+	for _, key := range keys {
+		report.Entries++
+
+		problem, digest := st.checkEntry(key, blobs)
+		if digest != "" && (problem == nil || problem.Kind != ProblemMissingBlob) {
+			referenced[digest] = true
+		}
+
+		if problem == nil {
+			continue
+		}
+
+		if err = st.fix(report, problem, repair); err != nil {
+			return nil, err
+		}
+	}
+
+	return referenced, nil
+}
+
+// checkEntry checks the entry stored under key, and returns what is wrong with it, if anything, along with the digest of
+// the blob it refers to.
+func (st *Store) checkEntry(key string, blobs map[string]*Problem) (*Problem, string) {
+	meta, err := st.verifyEntry(key)
+	if err != nil {
+		return classify(key, err), ""
+	}
+
+	// Entries written by older versions have no name (nor metadata, unless encrypted since).
+	if meta == nil || meta.Name == "" {
+		if !isDigest(key) {
+			return &Problem{Kind: ProblemInvalidKey, Key: key}, ""
+		}
+
+		return nil, ""
+	}
+
+	if hash(meta.Name) != key {
+		return &Problem{Kind: ProblemKeyMismatch, Key: key, Detail: meta.Name}, meta.Digest
+	}
+
+	// Blobs that cannot be read are reported on their own, and may just need another key.
+	if blob, ok := blobs[meta.Digest]; meta.Digest != "" && (!ok || blob != nil && blob.Kind != ProblemUnreadable) {
+		return &Problem{Kind: ProblemMissingBlob, Key: key, Detail: meta.Digest}, meta.Digest
+	}
+
+	return nil, meta.Digest
+}
+
+// verifyEntry reads the entry stored under key through, and returns its metadata.
+// Values are streamed from the backend, which reads them from storage rather than from any cache.
+func (st *Store) verifyEntry(key string) (*Metadata, error) {
+	file, err := openValue(st.backend, key)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, payload, err := st.codec.newReader(file)
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+
+	_, err = io.Copy(io.Discard, payload)
+
+	return meta, errors.Join(err, payload.Close(), file.Close())
+}
+
+// verifyBlob reads the blob with the given digest through, which checks it against its digest.
+func (st *Store) verifyBlob(digest string) error {
+	file, payload, err := st.openBlob(digest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.Discard, payload)
+
+	return errors.Join(err, payload.Close(), file.Close())
+}
+
+// fix records problem in report, and repairs it if asked to, and if possible.
+func (st *Store) fix(report *Report, problem *Problem, repair bool) error {
+	report.Problems = append(report.Problems, problem)
+
+	if !repair {
+		return nil
+	}
+
+	var err error
+
+	switch problem.Kind {
+	case ProblemStaleStaged, ProblemCorrupt, ProblemIntegrity, ProblemMissingBlob, ProblemUnreferencedBlob:
+		err = st.deleteValue(problem.Key)
+	case ProblemKeyMismatch:
+		target := hash(problem.Detail)
+
+		var taken bool
+		if taken, err = st.backend.Has(target); err == nil {
+			if taken {
+				err = st.deleteValue(problem.Key)
+			} else {
+				err = moveValue(st.backend, problem.Key, target)
+			}
+		}
+	default:
+		return nil
+	}
+
+	if err = ignoreNotExist(err); err != nil {
+		return errors.Join(ErrFileStoreFail, err)
+	}
+
+	problem.Repaired = true
+
+	return nil
+}
+
+// classify turns an error reading the value stored under key into a problem, or nil if there is none.
+func classify(key string, err error) *Problem {
+	// Values removed from under us (by a process that does not honor the lock) are not a problem.
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	problem := &Problem{Kind: ProblemUnreadable, Key: key, Detail: err.Error()}
+
+	switch {
+	case errors.Is(err, ErrIntegrityCheckFail):
+		problem.Kind = ProblemIntegrity
+	case errors.Is(err, errCorruptEntry), errors.Is(err, errCorruptLog):
+		problem.Kind = ProblemCorrupt
+	}
+
+	return problem
+}
+
+// isDigest tells whether key looks like a digest made by the store.
+func isDigest(key string) bool {
+	decoded, err := hex.DecodeString(key)
+
+	return err == nil && len(decoded) == sha256.Size && strings.ToLower(key) == key
+}
@@ -0,0 +1,198 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+)
+
+// problems indexes the kinds of problems in report by key (or path).
+func problems(report *store.Report) map[string]store.ProblemKind {
+	kinds := map[string]store.ProblemKind{}
+	for _, problem := range report.Problems {
+		kinds[problem.Key] = problem.Kind
+	}
+
+	return kinds
+}
+
+func TestStoreVerify(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	st := store.New(&store.Options{Path: base, ContentAddressable: true})
+
+	assert.NilError(t, st.Write("healthy", []byte("healthy")))
+	assert.NilError(t, st.Write("tampered", []byte("tampered")))
+	assert.NilError(t, st.Write("partial", []byte("partial")))
+	assert.NilError(t, st.Write("orphan", []byte("orphan")))
+	assert.NilError(t, st.Write("moved", []byte("moved")))
+
+	report, err := st.Verify()
+	assert.NilError(t, err)
+	assert.Assert(t, report.Healthy())
+	assert.Equal(t, len(report.Problems), 0)
+	assert.Equal(t, report.Entries, 5)
+	assert.Equal(t, report.Blobs, 5)
+
+	// What a crash, a stray process, or an operator could leave behind.
+	tamperedBlob := blobPath(base, "tampered")
+	data, err := os.ReadFile(tamperedBlob)
+	assert.NilError(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.NilError(t, os.WriteFile(tamperedBlob, data, 0o600))
+
+	data, err = os.ReadFile(entryFile(base, "partial"))
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(entryFile(base, "partial"), data[:6], 0o600))
+
+	assert.NilError(t, st.Delete("orphan"))
+
+	movedFile := entryFile(base, "moved")
+	misplaced := entryFile(base, "misplaced")
+	assert.NilError(t, os.MkdirAll(filepath.Dir(misplaced), 0o700))
+	assert.NilError(t, os.Rename(movedFile, misplaced))
+	assert.NilError(t, os.Remove(filepath.Dir(movedFile)))
+
+	assert.NilError(t, os.MkdirAll(filepath.Join(base, ".tmp"), 0o700))
+	assert.NilError(t, os.WriteFile(filepath.Join(base, ".tmp", "stale"), []byte("stale"), 0o600))
+	assert.NilError(t, os.WriteFile(filepath.Join(base, "stray"), []byte("stray"), 0o600))
+	assert.NilError(t, os.Mkdir(filepath.Join(base, "empty"), 0o700))
+
+	report, err = st.Verify()
+	assert.NilError(t, err)
+	assert.Assert(t, !report.Healthy())
+
+	kinds := problems(report)
+	misplacedKey := filepath.Base(misplaced)
+	partialKey := filepath.Base(entryFile(base, "partial"))
+	tamperedKey := filepath.Base(entryFile(base, "tampered"))
+	tamperedBlobKey := ".blobs/" + filepath.Base(tamperedBlob)
+	orphanBlobKey := ".blobs/" + filepath.Base(blobPath(base, "orphan"))
+
+	assert.Equal(t, kinds["stray"], store.ProblemStray)
+	assert.Equal(t, kinds["empty"], store.ProblemStray)
+	assert.Equal(t, kinds[".tmp/stale"], store.ProblemStaleStaged)
+	assert.Equal(t, kinds[tamperedBlobKey], store.ProblemIntegrity)
+	assert.Equal(t, kinds[tamperedKey], store.ProblemMissingBlob)
+	assert.Equal(t, kinds[partialKey], store.ProblemCorrupt)
+	assert.Equal(t, kinds[orphanBlobKey], store.ProblemUnreferencedBlob)
+	assert.Equal(t, kinds[misplacedKey], store.ProblemKeyMismatch)
+	// Along with the blob of the partial entry.
+	assert.Equal(t, kinds[".blobs/"+filepath.Base(blobPath(base, "partial"))], store.ProblemUnreferencedBlob)
+	assert.Equal(t, len(report.Problems), 9)
+
+	// Verify changes nothing.
+	_, err = os.Stat(filepath.Join(base, "stray"))
+	assert.NilError(t, err)
+
+	report, err = st.Repair()
+	assert.NilError(t, err)
+	assert.Assert(t, report.Healthy())
+	assert.Equal(t, len(report.Problems), 9)
+
+	report, err = st.Verify()
+	assert.NilError(t, err)
+	assert.Equal(t, len(report.Problems), 0)
+	assert.Equal(t, report.Entries, 2)
+	assert.Equal(t, report.Blobs, 2)
+
+	// Misplaced entries are moved back where they belong.
+	content, err := st.Read("moved")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "moved")
+
+	content, err = st.Read("healthy")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "healthy")
+}
+
+func TestStoreRepairWrongKey(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	key := bytes.Repeat([]byte{1}, store.KeySize)
+	st := store.New(&store.Options{Path: base, ContentAddressable: true, EncryptionKey: key})
+
+	assert.NilError(t, st.Write("secret", []byte("secret")))
+
+	// A store opened with the wrong key must not destroy what it cannot read.
+	other := store.New(&store.Options{
+		Path:               base,
+		ContentAddressable: true,
+		EncryptionKey:      bytes.Repeat([]byte{2}, store.KeySize),
+	})
+
+	report, err := other.Repair()
+	assert.NilError(t, err)
+	assert.Assert(t, !report.Healthy())
+
+	for _, problem := range report.Problems {
+		assert.Equal(t, problem.Kind, store.ProblemUnreadable)
+		assert.Assert(t, !problem.Repaired)
+	}
+
+	content, err := st.Read("secret")
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "secret")
+}
+
+func TestLogBackendVerify(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "store.log")
+
+	backend, err := store.OpenLogBackend(path)
+	assert.NilError(t, err)
+
+	defer func() {
+		assert.NilError(t, backend.Close())
+	}()
+
+	st := store.New(&store.Options{Backend: backend})
+	assert.NilError(t, st.Write("one", []byte("1")))
+
+	// An interrupted write.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	assert.NilError(t, err)
+	_, err = file.Write([]byte{1, 2, 3})
+	assert.NilError(t, err)
+	assert.NilError(t, file.Close())
+
+	report, err := st.Verify()
+	assert.NilError(t, err)
+	assert.Equal(t, len(report.Problems), 1)
+	assert.Equal(t, report.Problems[0].Kind, store.ProblemCorrupt)
+	assert.Equal(t, report.Problems[0].Key, path)
+
+	report, err = st.Repair()
+	assert.NilError(t, err)
+	assert.Assert(t, report.Healthy())
+
+	report, err = st.Verify()
+	assert.NilError(t, err)
+	assert.Equal(t, len(report.Problems), 0)
+	assert.Equal(t, report.Entries, 1)
+}
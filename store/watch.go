@@ -0,0 +1,238 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchPollInterval is how often backends that are not a Watcher are polled.
+const watchPollInterval = time.Second
+
+// EventType is the kind of change reported by Watch.
+type EventType uint8
+
+const (
+	// EventPut reports that an entry was written.
+	EventPut EventType = iota + 1
+	// EventDelete reports that an entry was removed.
+	EventDelete
+)
+
+// Event describes a change to an entry.
+type Event struct {
+	Type EventType
+	// Name is the logical name of the entry. It is empty for entries written by older versions of this package.
+	Name string
+	// Key is the digest the entry is stored under.
+	Key string
+}
+
+// Watch reports changes to entries whose name starts with prefix, made by this process or any other, until ctx is done,
+// at which point the returned channel is closed. Events must be consumed promptly, as the watch stalls until they are.
+// Backends implementing Watcher report changes as they happen - the default backend does so on Linux, through inotify,
+// and polls the filesystem every second elsewhere. Other backends are polled every second.
+// Deletions are only reported for entries that existed (and had not expired) when Watch was called, or that were written
+// since. Changes made while Watch is starting may or may not be reported.
+func (st *Store) Watch(ctx context.Context, prefix string) (<-chan *Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var (
+		changes <-chan *Change
+		err     error
+	)
+
+	if watcher, ok := st.backend.(Watcher); ok {
+		changes, err = watcher.Watch(ctx)
+	} else {
+		changes, err = st.poll(ctx)
+	}
+
+	if err != nil {
+		cancel()
+
+		return nil, errors.Join(ErrFileStoreFail, err)
+	}
+
+	// Deleted entries cannot be read anymore: remember their names.
+	names := map[string]string{}
+
+	err = st.Walk(func(entry *Entry) error {
+		names[entry.Key] = entry.Name
+
+		return nil
+	})
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	events := make(chan *Event)
+
+	go func() {
+		defer cancel()
+		defer close(events)
+
+		for change := range changes {
+			event := st.toEvent(change, names)
+			if event == nil || !strings.HasPrefix(event.Name, prefix) {
+				continue
+			}
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// toEvent turns a change to a value into an event, or nil if the value is not an entry, or is gone already.
+func (st *Store) toEvent(change *Change, names map[string]string) *Event {
+	if !isEntryKey(change.Key) {
+		return nil
+	}
+
+	key := change.Key
+
+	if change.Deleted {
+		name, ok := names[key]
+		if !ok {
+			return nil
+		}
+
+		delete(names, key)
+
+		return &Event{Type: EventDelete, Name: name, Key: key}
+	}
+
+	// Entries are replaced atomically, so this does not need the lock.
+	entry, err := st.statEntry(key, false)
+	if err != nil || entry.Metadata.Expired(time.Now()) {
+		return nil
+	}
+
+	names[key] = entry.Name
+
+	return &Event{Type: EventPut, Name: entry.Name, Key: key}
+}
+
+// poll reports changes to entries by comparing snapshots of the backend, taken every watchPollInterval under a read
+// lock. The first snapshot is taken before returning.
+func (st *Store) poll(ctx context.Context) (<-chan *Change, error) {
+	previous, err := st.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan *Change)
+
+	go func() {
+		defer close(changes)
+
+		ticker := time.NewTicker(watchPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, err := st.snapshot(ctx)
+			if err != nil {
+				// Try again on the next tick.
+				continue
+			}
+
+			for _, change := range diffSnapshots(previous, current) {
+				select {
+				case changes <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			previous = current
+		}
+	}()
+
+	return changes, nil
+}
+
+// snapshot describes every entry in the backend, as a map from key to a string that changes whenever the entry does.
+func (st *Store) snapshot(ctx context.Context) (map[string]string, error) {
+	unlock, err := st.backend.Lock(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, stater := st.backend.(Stater)
+	snapshot := map[string]string{}
+
+	err = st.backend.Keys("", func(key string) error {
+		if !isEntryKey(key) {
+			return nil
+		}
+
+		// Without Stater, the content itself has to be compared.
+		if !stater {
+			data, err := st.backend.Read(key)
+			if err == nil {
+				snapshot[key] = digestOf(data)
+			}
+
+			return ignoreNotExist(err)
+		}
+
+		info, err := statValue(st.backend, key)
+		if err == nil {
+			snapshot[key] = strconv.FormatInt(info.Size, 10) + "@" + info.Modified.String()
+		}
+
+		return ignoreNotExist(err)
+	})
+
+	return snapshot, errors.Join(err, unlock())
+}
+
+func diffSnapshots(previous, current map[string]string) []*Change {
+	changes := []*Change{}
+
+	for key, state := range current {
+		if previous[key] != state {
+			changes = append(changes, &Change{Key: key})
+		}
+	}
+
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			changes = append(changes, &Change{Key: key, Deleted: true})
+		}
+	}
+
+	return changes
+}
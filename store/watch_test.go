@@ -0,0 +1,93 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"go.farcloser.world/core/store"
+)
+
+func nextEvent(t *testing.T, events <-chan *store.Event) *store.Event {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	return nil
+}
+
+func TestStoreWatch(t *testing.T) {
+	t.Parallel()
+
+	base := t.TempDir()
+	st := store.New(&store.Options{Path: base})
+
+	assert.NilError(t, st.Write("watched/existing", []byte("value")))
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	events, err := st.Watch(ctx, "watched/")
+	assert.NilError(t, err)
+
+	// Another store on the same directory, as another process would.
+	other := store.New(&store.Options{Path: base})
+
+	assert.NilError(t, other.Write("ignored", []byte("value")))
+	assert.NilError(t, other.Write("watched/one", []byte("value")))
+
+	event := nextEvent(t, events)
+	assert.Equal(t, event.Type, store.EventPut)
+	assert.Equal(t, event.Name, "watched/one")
+
+	assert.NilError(t, other.Write("watched/one", []byte("updated")))
+	assert.DeepEqual(t, nextEvent(t, events), &store.Event{Type: store.EventPut, Name: "watched/one", Key: event.Key})
+
+	assert.NilError(t, other.Delete("watched/existing"))
+
+	event = nextEvent(t, events)
+	assert.Equal(t, event.Type, store.EventDelete)
+	assert.Equal(t, event.Name, "watched/existing")
+
+	assert.NilError(t, other.Rename("watched/one", "watched/two"))
+
+	seen := map[string]store.EventType{}
+	for range 2 {
+		event = nextEvent(t, events)
+		seen[event.Name] = event.Type
+	}
+
+	assert.DeepEqual(t, seen, map[string]store.EventType{
+		"watched/one": store.EventDelete,
+		"watched/two": store.EventPut,
+	})
+
+	cancel()
+
+	for range events {
+		// Drain until closed.
+	}
+}
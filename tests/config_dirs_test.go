@@ -0,0 +1,279 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package tests_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"testing"
+
+	"go.farcloser.world/core/config"
+	"go.farcloser.world/core/loader"
+)
+
+func skipUnlessXDG(t *testing.T) {
+	t.Helper()
+
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		t.Skip("XDG directories are only used on linux and other unix-es")
+	}
+}
+
+func TestConfigDirsXDG(t *testing.T) {
+	skipUnlessXDG(t)
+
+	dir := t.TempDir()
+
+	t.Setenv("HOME", filepath.Join(dir, "home"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	t.Setenv("XDG_STATE_HOME", filepath.Join(dir, "state"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+
+	conf := config.New("app", "config.json")
+
+	for actual, expected := range map[string]string{
+		conf.GetDataRoot():    filepath.Join(dir, "data", "app"),
+		conf.GetStateRoot():   filepath.Join(dir, "state", "app"),
+		conf.GetCacheRoot():   filepath.Join(dir, "cache", "app"),
+		conf.GetLogRoot():     filepath.Join(dir, "state", "app", "log"),
+		conf.GetRuntimeRoot(): filepath.Join(dir, "run", "app"),
+	} {
+		if actual != expected {
+			t.Fatalf("expected %s, got %s", expected, actual)
+		}
+	}
+}
+
+func TestConfigDirsDefaults(t *testing.T) {
+	skipUnlessXDG(t)
+
+	if os.Geteuid() == 0 {
+		t.Skip("root defaults are system directories (/var/lib, /var/cache, /var/log and /run)")
+	}
+
+	home := t.TempDir()
+
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_DATA_HOME", "")
+	// Relative paths are ignored, as per the specification.
+	t.Setenv("XDG_STATE_HOME", "relative")
+	t.Setenv("XDG_CACHE_HOME", "")
+	t.Setenv("XDG_RUNTIME_DIR", "")
+
+	conf := config.New("app", "config.json")
+
+	for actual, expected := range map[string]string{
+		conf.GetDataRoot():    filepath.Join(home, ".local", "share", "app"),
+		conf.GetStateRoot():   filepath.Join(home, ".local", "state", "app"),
+		conf.GetCacheRoot():   filepath.Join(home, ".cache", "app"),
+		conf.GetLogRoot():     filepath.Join(home, ".local", "state", "app", "log"),
+		conf.GetRuntimeRoot(): filepath.Join(os.TempDir(), "app-"+strconv.Itoa(os.Getuid())),
+	} {
+		if actual != expected {
+			t.Fatalf("expected %s, got %s", expected, actual)
+		}
+	}
+}
+
+func TestConfigDataRootMigratesLegacy(t *testing.T) {
+	skipUnlessXDG(t)
+
+	dir := t.TempDir()
+	home := filepath.Join(dir, "home")
+	target := filepath.Join(home, ".local", "share", "app")
+
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_DATA_HOME", filepath.Join(home, ".local", "share"))
+
+	for _, legacy := range []string{".app", ".config"} {
+		if err := os.MkdirAll(filepath.Join(home, legacy), 0o700); err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(home, legacy, "data"), []byte("legacy"), 0o600); err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+	}
+
+	// XDG base directories are never moved.
+	if loc := config.New("config", "config.json").GetDataRoot(); loc != filepath.Join(home, ".local", "share", "config") {
+		t.Fatalf("unexpected data root %s", loc)
+	}
+
+	if _, err := os.Stat(filepath.Join(home, ".config", "data")); err != nil {
+		t.Fatalf("the config directory should not have been moved: %v", err)
+	}
+
+	loc := config.New("app", "config.json").GetDataRoot()
+	if loc != target {
+		t.Fatalf("unexpected data root %s", loc)
+	}
+
+	// Data of root is never moved.
+	if os.Geteuid() == 0 {
+		if _, err := os.Stat(filepath.Join(home, ".app", "data")); err != nil {
+			t.Fatalf("the legacy directory of root should not have been moved: %v", err)
+		}
+
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(loc, "data"))
+	if err != nil || string(data) != "legacy" {
+		t.Fatalf("legacy data should have been moved: %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(home, ".app")); !os.IsNotExist(err) {
+		t.Fatalf("the legacy directory should be gone: %v", err)
+	}
+
+	// Nor is data moved outside of the home directory.
+	if err = os.MkdirAll(filepath.Join(home, ".other"), 0o700); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+
+	if loc = config.New("other", "config.json").GetDataRoot(); loc != filepath.Join(dir, "data", "other") {
+		t.Fatalf("unexpected data root %s", loc)
+	}
+
+	if _, err = os.Stat(filepath.Join(home, ".other")); err != nil {
+		t.Fatalf("the legacy directory should not have been moved outside of home: %v", err)
+	}
+}
+
+func TestConfigDataRootKeepsLegacyOfRoot(t *testing.T) {
+	skipUnlessXDG(t)
+
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	home := t.TempDir()
+
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_DATA_HOME", "")
+
+	if err := os.Mkdir(filepath.Join(home, ".legacytest"), 0o700); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if loc := config.New("legacytest", "config.json").GetDataRoot(); loc != "/var/lib/legacytest" {
+		t.Fatalf("unexpected data root %s", loc)
+	}
+
+	if _, err := os.Stat(filepath.Join(home, ".legacytest")); err != nil {
+		t.Fatalf("the legacy directory of root should not have been moved to /var/lib: %v", err)
+	}
+
+	if _, err := os.Stat("/var/lib/legacytest"); !os.IsNotExist(err) {
+		t.Fatalf("nothing should have been created in /var/lib: %v", err)
+	}
+}
+
+func TestSystemConfigDirs(t *testing.T) {
+	skipUnlessXDG(t)
+
+	t.Setenv("XDG_CONFIG_DIRS", "/first:relative:/second")
+
+	if dirs := loader.SystemConfigDirs(); !slices.Equal(dirs, []string{"/etc", "/second", "/first"}) {
+		t.Fatalf("unexpected system config dirs %v", dirs)
+	}
+
+	t.Setenv("XDG_CONFIG_DIRS", "")
+
+	if dirs := loader.SystemConfigDirs(); !slices.Equal(dirs, []string{"/etc", "/etc/xdg"}) {
+		t.Fatalf("unexpected system config dirs %v", dirs)
+	}
+}
+
+func TestConfigEnsureDirs(t *testing.T) {
+	skipUnlessXDG(t)
+
+	dir := t.TempDir()
+
+	t.Setenv("HOME", filepath.Join(dir, "home"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	t.Setenv("XDG_STATE_HOME", filepath.Join(dir, "state"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+
+	// Existing directories are made private.
+	if err := os.MkdirAll(filepath.Join(dir, "data", "app"), 0o755); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := config.New("app", "config.json")
+
+	for _, ensure := range []func() (string, error){
+		conf.EnsureDataRoot,
+		conf.EnsureStateRoot,
+		conf.EnsureCacheRoot,
+		conf.EnsureLogRoot,
+		conf.EnsureRuntimeRoot,
+	} {
+		loc, err := ensure()
+		if err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+
+		info, err := os.Stat(loc)
+		if err != nil {
+			t.Fatalf("the directory should have been created: %s", err)
+		}
+
+		if !info.IsDir() || info.Mode().Perm() != 0o700 {
+			t.Fatalf("%s should be a private directory: %s", loc, info.Mode())
+		}
+	}
+}
+
+func TestConfigEnsureDirsUnavailable(t *testing.T) {
+	skipUnlessXDG(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	t.Setenv("XDG_DATA_HOME", file)
+
+	if _, err := config.New("app", "config.json").EnsureDataRoot(); !errors.Is(err, config.ErrDirectoryUnavailable) {
+		t.Fatalf("should have failed with ErrDirectoryUnavailable: %v", err)
+	}
+
+	// Without a home directory, only root has a usable location.
+	if os.Geteuid() == 0 {
+		return
+	}
+
+	t.Setenv("HOME", "")
+	t.Setenv("XDG_CACHE_HOME", "")
+
+	if _, err := config.New("app", "config.json").EnsureCacheRoot(); !errors.Is(err, config.ErrDirectoryUnavailable) {
+		t.Fatalf("should have failed with ErrDirectoryUnavailable: %v", err)
+	}
+}
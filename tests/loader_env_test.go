@@ -0,0 +1,128 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package tests_test
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.farcloser.world/core/config"
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/loader"
+	"go.farcloser.world/core/log"
+	"go.farcloser.world/core/telemetry"
+)
+
+func TestConfigApplyEnv(t *testing.T) {
+	dir := t.TempDir()
+
+	err := filesystem.WriteFile(filepath.Join(dir, "config.json"), []byte(`{
+		"logger": {"level": "error"},
+		"server": {"port": 8080}
+	}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := config.New(dir, "config.json")
+	conf.Telemetry = &telemetry.Config{}
+
+	if err = loader.Load(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	t.Setenv("ENVTEST_LOGGER_LEVEL", "warn")
+	cas := []string{filepath.Join(dir, "a.pem"), filepath.Join(dir, "b.pem")}
+	for _, ca := range cas {
+		if err = filesystem.WriteFile(ca, []byte{}, 0o600); err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+	}
+
+	t.Setenv("ENVTEST_CLIENT_ROOT_CA", cas[0]+", "+cas[1])
+	t.Setenv("ENVTEST_CLIENT_TLS_MIN", "TLS1.3")
+	t.Setenv("ENVTEST_SERVER_TLS_MIN", "0x0303")
+	t.Setenv("ENVTEST_CLIENT_TLS_HANDSHAKE_TIMEOUT", "1m30s")
+	t.Setenv("ENVTEST_CLIENT_DIALER_TIMEOUT", "1000")
+	t.Setenv("ENVTEST_TELEMETRY_ENDPOINT", "http://localhost:4317")
+	t.Setenv("ENVTEST_TELEMETRY_DISABLED", "true")
+
+	if err = loader.ApplyEnv(conf, "ENVTEST"); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if conf.Logger.Level != log.WarnLevel || conf.Server.Port != 8080 {
+		t.Fatalf("environment should override the file: %+v %+v", conf.Logger, conf.Server)
+	}
+
+	if !slices.Equal(conf.Client.RootCAs, cas) {
+		t.Fatalf("lists should be split on commas: %v", conf.Client.RootCAs)
+	}
+
+	if conf.Client.TLSMin != tls.VersionTLS13 || conf.Server.TLSMin != tls.VersionTLS12 {
+		t.Fatalf("TLS versions should be converted: %x %x", conf.Client.TLSMin, conf.Server.TLSMin)
+	}
+
+	if conf.Client.TLSHandshakeTimeout != 90*time.Second || conf.Client.DialerTimeout != 1000 {
+		t.Fatalf("durations should be converted: %+v", conf.Client)
+	}
+
+	if conf.Telemetry.Endpoint != "http://localhost:4317" || !conf.Telemetry.Disabled {
+		t.Fatalf("telemetry should be set: %+v", conf.Telemetry)
+	}
+}
+
+func TestConfigApplyEnvInvalid(t *testing.T) {
+	t.Setenv("ENVINVALIDTEST_CLIENT_TLS_MIN", "1.7")
+
+	conf := config.New(t.TempDir(), "config.json")
+
+	err := loader.ApplyEnv(conf, "ENVINVALIDTEST")
+	if err == nil {
+		t.Fatalf("invalid values should fail")
+	}
+
+	if conf.Client.TLSMin != tls.VersionTLS12 {
+		t.Fatalf("the config should be left untouched")
+	}
+}
+
+func TestConfigEnvPrefix(t *testing.T) {
+	t.Parallel()
+
+	prefix, err := loader.EnvPrefix(config.New("my-app", "config.json"))
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if prefix != "MY_APP" {
+		t.Fatalf("unexpected prefix %s", prefix)
+	}
+
+	// Paths are not application names.
+	if _, err = loader.EnvPrefix(config.New(t.TempDir(), "config.json")); err == nil {
+		t.Fatalf("paths should not be used as a prefix")
+	}
+
+	if _, err = loader.DefaultLayers(config.New(t.TempDir(), "config.json"), nil); err == nil {
+		t.Fatalf("paths should not be used as a prefix")
+	}
+}
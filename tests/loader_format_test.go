@@ -0,0 +1,140 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package tests_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.farcloser.world/core/config"
+	"go.farcloser.world/core/loader"
+	"go.farcloser.world/core/log"
+)
+
+func TestConfigFormats(t *testing.T) {
+	t.Parallel()
+
+	for name, markers := range map[string][]string{
+		"config.json":  {`"level": "warn"`},
+		"config.jsonc": {`"level": "warn"`},
+		"config.yaml":  {"level: warn", "rootCa:\n"},
+		"config.yml":   {"level: warn"},
+		"config.toml":  {"level = 'warn'", "[logger]"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+
+			conf := config.New(dir, name)
+			conf.Logger.Level = log.WarnLevel
+			conf.Client.RootCAs = []string{"one.pem", "two.pem"}
+			conf.Client.DialerTimeout = time.Minute
+
+			if err := loader.Save(conf); err != nil {
+				t.Fatalf("unexpected failure! %s", err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("unexpected failure! %s", err)
+			}
+
+			for _, marker := range markers {
+				if !strings.Contains(string(data), marker) {
+					t.Fatalf("should have been saved in the right format, with %q:\n%s", marker, data)
+				}
+			}
+
+			// The CAs must exist for the configuration to be valid.
+			for _, ca := range conf.Client.RootCAs {
+				if err = os.WriteFile(filepath.Join(dir, ca), []byte{}, 0o600); err != nil {
+					t.Fatalf("unexpected failure! %s", err)
+				}
+			}
+
+			loaded := config.New(dir, name)
+			if err = loader.Load(loaded); err != nil {
+				t.Fatalf("unexpected failure! %s", err)
+			}
+
+			if loaded.Logger.Level != log.WarnLevel || len(loaded.Client.RootCAs) != 2 ||
+				loaded.Client.DialerTimeout != time.Minute || loaded.Client.TLSMin != tls.VersionTLS12 {
+				t.Fatalf("should have loaded what was saved: %+v", loaded.Client)
+			}
+		})
+	}
+}
+
+func TestConfigFormatJSONC(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	content := `{
+	// Comments are allowed, /* even "here" */
+	"telemetry": {
+		"endpoint": "https://not/a/comment", "serviceName": "\"//\"", /* trailing commas too */
+	},
+}`
+
+	if err := os.WriteFile(filepath.Join(dir, "config.jsonc"), []byte(content), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := config.New(dir, "config.jsonc")
+	if err := loader.Load(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if conf.Telemetry.Endpoint != "https://not/a/comment" || conf.Telemetry.ServiceName != `"//"` {
+		t.Fatalf("should have kept strings as they are: %+v", conf.Telemetry)
+	}
+}
+
+func TestConfigFormatOverride(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "config.conf"), []byte("logger:\n  level: warn\n"), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := config.New(dir, "config.conf")
+	if err := loader.Load(conf); err == nil {
+		t.Fatalf("should have failed reading YAML as JSON")
+	}
+
+	conf = config.New(dir, "config.conf")
+	conf.SetFormat(loader.FormatYAML)
+
+	if err := loader.Load(conf); err != nil || conf.Logger.Level != log.WarnLevel {
+		t.Fatalf("should have read the file as YAML: %v", err)
+	}
+
+	conf.SetFormat("ini")
+
+	if err := loader.Save(conf); !errors.Is(err, loader.ErrUnknownFormat) {
+		t.Fatalf("should have returned ErrUnknownFormat: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package tests_test
+
+import (
+	"flag"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.farcloser.world/core/config"
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/loader"
+	"go.farcloser.world/core/log"
+)
+
+func TestConfigLoadLayers(t *testing.T) {
+	dir := t.TempDir()
+	system := filepath.Join(dir, "system.json")
+	user := filepath.Join(dir, "user.yaml")
+
+	err := filesystem.WriteFile(system, []byte(`{
+		"logger": {"level": "error"},
+		"client": {"dialerTimeout": 1000, "rootCa": ["a", "b"]},
+		"umask": 18
+	}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	err = filesystem.WriteFile(user, []byte("client:\n  rootCa: [c]\nserver:\n  port: 8080\n"), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	// The CAs must exist for the configuration to be valid.
+	for _, ca := range []string{"a", "b", "c"} {
+		if err = filesystem.WriteFile(filepath.Join(dir, ca), []byte{}, 0o600); err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+	}
+
+	t.Setenv("LAYERSTEST_LOGGER_LEVEL", "warn")
+	t.Setenv("LAYERSTEST_SERVER_PORT", "9090")
+	t.Setenv("LAYERSTEST_CLIENT_DISALLOW_SYSTEM_ROOT", "true")
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Int("server-port", 0, "")
+	flags.String("unrelated", "", "")
+
+	if err = flags.Parse([]string{"--server-port", "7070", "--unrelated", "value"}); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := config.New(dir, "config.json")
+
+	origins, err := loader.LoadLayers(conf,
+		loader.FileLayer(loader.LayerSystem, system),
+		loader.FileLayer(loader.LayerUser, user),
+		loader.FileLayer(loader.LayerProject, filepath.Join(dir, "missing.json")),
+		loader.EnvLayer("LAYERSTEST"),
+		loader.FlagLayer(flags),
+	)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if conf.Logger.Level != log.WarnLevel || conf.Server.Port != 7070 || conf.Umask != 18 ||
+		!conf.Client.DisallowSystemRoot || conf.Client.DialerTimeout != 1000 {
+		t.Fatalf("layers should have been applied in order: %+v %+v", conf.Client, conf.Server)
+	}
+
+	if len(conf.Client.RootCAs) != 1 || conf.Client.RootCAs[0] != "c" {
+		t.Fatalf("lists should be replaced: %v", conf.Client.RootCAs)
+	}
+
+	// Defaults and non-JSON fields are kept.
+	if conf.Client.TLSHandshakeTimeout != 10*time.Second || conf.Client.Resolve == nil {
+		t.Fatalf("defaults should have been kept: %+v", conf.Client)
+	}
+
+	for setting, layer := range map[string]string{
+		"logger.level":               loader.LayerEnv,
+		"server.port":                loader.LayerFlags,
+		"umask":                      loader.LayerSystem,
+		"client.dialerTimeout":       loader.LayerSystem,
+		"client.rootCa":              loader.LayerUser,
+		"client.tlsHandshakeTimeout": loader.LayerDefaults,
+		"reporter.dsn":               loader.LayerDefaults,
+	} {
+		if origins.Of(setting) != layer {
+			t.Fatalf("%s should come from %s, not %s", setting, layer, origins.Of(setting))
+		}
+	}
+}
+
+func TestConfigLoadLayersInvalid(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "config.json")
+
+	if err := filesystem.WriteFile(loc, []byte(`[1, 2]`), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	_, err := loader.LoadLayers(config.New(dir, "config.json"), loader.FileLayer(loader.LayerUser, loc))
+	if err == nil {
+		t.Fatalf("a file that is not an object should fail")
+	}
+}
@@ -0,0 +1,220 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package tests_test
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.farcloser.world/core/config"
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/loader"
+)
+
+func TestConfigModify(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	// Every modification reloads the file, so that none is lost.
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 20)
+
+	for range 20 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			conf := config.New(dir, "config.json")
+			errs <- loader.Modify(conf, func(*loader.Locked) error {
+				conf.Umask++
+
+				return nil
+			})
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+	}
+
+	conf := config.New(dir, "config.json")
+	if err := loader.Load(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if conf.Umask != 20 {
+		t.Fatalf("modifications should not be lost: %d", conf.Umask)
+	}
+
+	// Failed modifications are not saved.
+	errMutate := errors.New("mutate failure")
+
+	err := loader.Modify(conf, func(*loader.Locked) error {
+		conf.Umask = 0
+
+		return errMutate
+	})
+	if !errors.Is(err, errMutate) {
+		t.Fatalf("the mutate error should be returned: %v", err)
+	}
+
+	conf = config.New(dir, "config.json")
+	if err = loader.Load(conf); err != nil || conf.Umask != 20 {
+		t.Fatalf("failed modifications should not be saved: %v", err)
+	}
+}
+
+func TestConfigSaveWaitsForLock(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	conf := config.New(dir, "config.json")
+
+	if err := loader.Save(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	lock, err := filesystem.Lock(filepath.Join(dir, "config.json.lock"))
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	saved := make(chan error)
+
+	go func() {
+		conf.Umask = 18
+		saved <- loader.Save(conf)
+	}()
+
+	select {
+	case <-saved:
+		t.Fatalf("save should wait for the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err = filesystem.Unlock(lock); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if err = <-saved; err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+}
+
+func TestConfigModifyReentrant(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	conf := config.New(dir, "config.json")
+	done := make(chan error)
+
+	// Saving and loading through the lock Modify holds does not wait for it.
+	go func() {
+		done <- loader.Modify(conf, func(locked *loader.Locked) error {
+			conf.Umask = 18
+
+			if err := locked.Save(); err != nil {
+				return err
+			}
+
+			return locked.Load()
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("saving from mutate should not deadlock")
+	}
+
+	conf = config.New(dir, "config.json")
+	if err := loader.Load(conf); err != nil || conf.Umask != 18 {
+		t.Fatalf("the modification should have been saved: %v", err)
+	}
+}
+
+// counter is a configuration touching no global state, so that objects for the same file share no memory.
+type counter struct {
+	Count int `json:"count"`
+
+	location []string
+}
+
+func (*counter) OnIO() {}
+
+func (obj *counter) GetLocation() []string {
+	return obj.location
+}
+
+func TestConfigModifyExcludesOthers(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	conf := &counter{location: []string{dir, "config.json"}}
+	saved := make(chan error)
+
+	var held *loader.Locked
+
+	// Saving the object being modified from another goroutine waits for Modify to return.
+	err := loader.Modify(conf, func(locked *loader.Locked) error {
+		held = locked
+		conf.Count = 1
+
+		go func() {
+			saved <- loader.Save(conf)
+		}()
+
+		select {
+		case <-saved:
+			t.Errorf("save should wait for modify")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if err = <-saved; err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf = &counter{location: []string{dir, "config.json"}}
+	if err = loader.Load(conf); err != nil || conf.Count != 1 {
+		t.Fatalf("the modification should have been saved: %v", err)
+	}
+
+	// The lock is only usable while Modify holds it.
+	if err = held.Save(); !errors.Is(err, loader.ErrConfigSaveFail) {
+		t.Fatalf("saving once modify has returned should fail: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package tests_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.farcloser.world/core/config"
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/loader"
+	"go.farcloser.world/core/log"
+)
+
+// migrated is a configuration whose layout changed twice.
+type migrated struct {
+	*config.Core
+}
+
+// gapped is a configuration missing a migration.
+type gapped struct {
+	*config.Core
+}
+
+//nolint:gochecknoinits
+func init() {
+	err := errors.Join(
+		// Version 1 moved "logLevel" to "logger.level".
+		loader.RegisterMigration[*migrated](1, moveLogLevel),
+		// Version 2 renamed "mask" to "umask".
+		loader.RegisterMigration[*migrated](2, renameMask),
+		// Version 2 is missing.
+		loader.RegisterMigration[*gapped](1, moveLogLevel),
+		loader.RegisterMigration[*gapped](3, renameMask),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func moveLogLevel(settings map[string]any) error {
+	if level, ok := settings["logLevel"]; ok {
+		settings["logger"] = map[string]any{"level": level}
+		delete(settings, "logLevel")
+	}
+
+	return nil
+}
+
+func renameMask(settings map[string]any) error {
+	if mask, ok := settings["mask"]; ok {
+		settings["umask"] = mask
+		delete(settings, "mask")
+	}
+
+	return nil
+}
+
+func TestConfigLoadMigrate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "config.json")
+	original := []byte(`{"logLevel": "warn", "mask": 18}`)
+
+	if err := filesystem.WriteFile(loc, original, 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := &migrated{config.New(dir, "config.json")}
+
+	if err := loader.Load(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if conf.Logger.Level != log.WarnLevel || conf.Umask != 18 {
+		t.Fatalf("the config should have been migrated: %+v %d", conf.Logger, conf.Umask)
+	}
+
+	backup, err := os.ReadFile(loc + ".v0.bak")
+	if err != nil || string(backup) != string(original) {
+		t.Fatalf("the original file should have been backed up: %v", err)
+	}
+
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	saved := map[string]any{}
+	if err = json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if saved["version"] != float64(2) || saved["umask"] != float64(18) || saved["mask"] != nil {
+		t.Fatalf("the upgraded config should have been saved: %s", data)
+	}
+
+	// Loading again is a no-op.
+	if err = os.Remove(loc + ".v0.bak"); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if err = loader.Load(&migrated{config.New(dir, "config.json")}); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if _, err = os.Stat(loc + ".v0.bak"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("an up to date config should not be backed up: %v", err)
+	}
+}
+
+func TestConfigLoadMigrateTooNew(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	err := filesystem.WriteFile(filepath.Join(dir, "config.yaml"), []byte("version: 3\numask: 18\n"), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	err = loader.Load(&migrated{config.New(dir, "config.yaml")})
+	if !errors.Is(err, loader.ErrConfigVersion) {
+		t.Fatalf("newer versions should be rejected: %v", err)
+	}
+}
+
+func TestConfigLoadMigrateGap(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	err := filesystem.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"logLevel": "warn"}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	err = loader.Load(&gapped{config.New(dir, "config.json")})
+	if !errors.Is(err, loader.ErrConfigMigrateFail) {
+		t.Fatalf("missing migrations should fail: %v", err)
+	}
+
+	// Files past the gap are fine.
+	err = filesystem.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"version": 2, "mask": 18}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := &gapped{config.New(dir, "config.json")}
+	if err = loader.Load(conf); err != nil || conf.Umask != 18 {
+		t.Fatalf("files past the gap should be migrated: %v", err)
+	}
+}
+
+func TestConfigRegisterMigrationInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []int{-1, 0} {
+		err := loader.RegisterMigration[*migrated](version, moveLogLevel)
+		if !errors.Is(err, loader.ErrConfigVersion) {
+			t.Fatalf("version %d should be rejected: %v", version, err)
+		}
+	}
+}
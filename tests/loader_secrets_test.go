@@ -0,0 +1,260 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package tests_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"go.farcloser.world/core/config"
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/loader"
+	"go.farcloser.world/core/reporter"
+)
+
+func TestConfigLoadSecrets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exec: references rely on echo")
+	}
+
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "config.json")
+	pem := filepath.Join(dir, "ca.pem")
+
+	t.Setenv("SECRETSTEST_DSN", "https://key@sentry.example/1")
+
+	loader.RegisterResolver("secretstest", func(reference string) (string, error) {
+		return strings.ToUpper(reference), nil
+	})
+	loader.RegisterResolver("file", loader.FileResolver)
+	loader.RegisterResolver("exec", loader.ExecResolver)
+
+	if err := filesystem.WriteFile(pem, []byte("-----BEGIN PEM CONTENT\n"), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	// The resolved CAs that are not PEM content must exist for the configuration to be valid.
+	for _, ca := range []string{"literal", "token"} {
+		if err := filesystem.WriteFile(filepath.Join(dir, ca), []byte{}, 0o600); err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+	}
+
+	err := filesystem.WriteFile(loc, []byte(`{
+		"reporter": {"dsn": "env:SECRETSTEST_DSN"},
+		"client": {"rootCa": ["file:`+pem+`", "literal"]},
+		"server": {"clientCa": "exec:echo token"},
+		"telemetry": {"endpoint": "secretstest:value", "serviceName": "https://not.a.secret"}
+	}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := config.New(dir, "config.json")
+
+	if err = loader.Load(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if conf.Reporter.DSN != "https://key@sentry.example/1" || conf.Client.RootCAs[0] != "-----BEGIN PEM CONTENT" ||
+		conf.Client.RootCAs[1] != "literal" || conf.Server.ClientCA != "token" ||
+		conf.Telemetry.Endpoint != "VALUE" || conf.Telemetry.ServiceName != "https://not.a.secret" {
+		t.Fatalf("secrets should have been resolved: %+v %+v %+v", conf.Reporter, conf.Client, conf.Server)
+	}
+
+	dump, err := loader.Dump(conf)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if strings.Contains(string(dump), "sentry.example") || strings.Contains(string(dump), "token") ||
+		strings.Contains(string(dump), "PEM") || !strings.Contains(string(dump), "https://not.a.secret") {
+		t.Fatalf("secrets should be masked: %s", dump)
+	}
+
+	// Changed settings are saved as is.
+	conf.Server.ClientCA = "changed"
+
+	if err = loader.Save(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	for _, expected := range []string{"env:SECRETSTEST_DSN", "file:" + pem, "secretstest:value", "changed"} {
+		if !strings.Contains(string(data), expected) {
+			t.Fatalf("references should have been saved: %s", data)
+		}
+	}
+
+	if strings.Contains(string(data), "sentry.example") || strings.Contains(string(data), "PEM") {
+		t.Fatalf("secrets should never be saved: %s", data)
+	}
+}
+
+func TestConfigLoadSecretsUntrustedLayers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exec: references rely on echo")
+	}
+
+	dir := t.TempDir()
+	user := filepath.Join(dir, "user.json")
+	project := filepath.Join(dir, "project.json")
+
+	loader.RegisterResolver("exec", loader.ExecResolver)
+
+	err := filesystem.WriteFile(user, []byte(`{"reporter": {"dsn": "exec:echo user"}}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	err = filesystem.WriteFile(project, []byte(`{"telemetry": {"serviceName": "exec:echo project"}}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	t.Setenv("UNTRUSTEDTEST_TELEMETRY_ENDPOINT", "exec:echo env")
+
+	conf := config.New(dir, "config.json")
+
+	_, err = loader.LoadLayers(conf,
+		loader.FileLayer(loader.LayerUser, user),
+		loader.FileLayer(loader.LayerProject, project),
+		loader.EnvLayer("UNTRUSTEDTEST"),
+	)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if conf.Reporter.DSN != "user" {
+		t.Fatalf("references from the user file should have been resolved: %s", conf.Reporter.DSN)
+	}
+
+	if conf.Telemetry.ServiceName != "exec:echo project" || conf.Telemetry.Endpoint != "exec:echo env" {
+		t.Fatalf("references from the project file and the environment should be kept: %s %s",
+			conf.Telemetry.ServiceName, conf.Telemetry.Endpoint)
+	}
+}
+
+func TestConfigLoadSecretsApplyEnv(t *testing.T) {
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "config.json")
+
+	t.Setenv("APPLYENVTEST_DSN", "https://secret@sentry.example/1")
+	t.Setenv("APPLYENVTEST_LOGGER_LEVEL", "warn")
+
+	if err := filesystem.WriteFile(loc, []byte(`{"reporter": {"dsn": "env:APPLYENVTEST_DSN"}}`), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := config.New(dir, "config.json")
+
+	if err := loader.Load(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	// Applying the environment keeps track of the secrets resolved by Load.
+	if err := loader.ApplyEnv(conf, "APPLYENVTEST"); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if conf.Reporter.DSN != "https://secret@sentry.example/1" {
+		t.Fatalf("the secret should have been kept: %s", conf.Reporter.DSN)
+	}
+
+	dump, err := loader.Dump(conf)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if strings.Contains(string(dump), "sentry.example") {
+		t.Fatalf("secrets should be masked: %s", dump)
+	}
+
+	if err = loader.Save(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	data, err := os.ReadFile(loc)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if strings.Contains(string(data), "sentry.example") || !strings.Contains(string(data), "env:APPLYENVTEST_DSN") {
+		t.Fatalf("secrets should never be saved: %s", data)
+	}
+}
+
+func TestConfigLoadSecretsMissing(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	err := filesystem.WriteFile(filepath.Join(dir, "config.json"),
+		[]byte(`{"reporter": {"dsn": "env:SECRETSTEST_MISSING_VARIABLE"}}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	err = loader.Load(config.New(dir, "config.json"))
+	if !errors.Is(err, loader.ErrSecretResolveFail) || !errors.Is(err, loader.ErrSecretNotFound) ||
+		!strings.Contains(err.Error(), "reporter.dsn") {
+		t.Fatalf("missing secrets should fail: %v", err)
+	}
+}
+
+// Objects without Secrets keep references as is.
+type secretless struct {
+	Reporter *reporter.Config `json:"reporter"`
+
+	location []string
+}
+
+func (*secretless) OnIO() {}
+
+func (obj *secretless) GetLocation() []string {
+	return obj.location
+}
+
+func TestConfigLoadSecretsUntracked(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	err := filesystem.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"reporter": {"dsn": "env:HOME"}}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	conf := &secretless{location: []string{dir, "config.json"}}
+
+	if err = loader.Load(conf); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if conf.Reporter.DSN != "env:HOME" {
+		t.Fatalf("references should be kept: %s", conf.Reporter.DSN)
+	}
+}
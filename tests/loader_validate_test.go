@@ -0,0 +1,139 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package tests_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go.farcloser.world/core/config"
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/loader"
+	"go.farcloser.world/core/network"
+)
+
+// fieldErrors returns the paths of the FieldErrors in err, sorted.
+func fieldErrors(err error) []string {
+	paths := []string{}
+
+	var walk func(err error)
+
+	walk = func(err error) {
+		var fieldError *loader.FieldError
+		if errors.As(err, &fieldError) && fieldError == err { //nolint:errorlint
+			paths = append(paths, fieldError.Path)
+
+			return
+		}
+
+		if joined, ok := err.(interface{ Unwrap() []error }); ok { //nolint:errorlint
+			for _, inner := range joined.Unwrap() {
+				walk(inner)
+			}
+		}
+	}
+
+	walk(err)
+	slices.Sort(paths)
+
+	return paths
+}
+
+func TestConfigLoadUnknownFields(t *testing.T) {
+	t.Parallel()
+
+	for name, content := range map[string]string{
+		"config.json": `{"client": {"tlsMinn": 771, "rootCa": ["a"]}, "umask": 18, "extra": true}`,
+		"config.yaml": "client:\n  tlsMinn: 771\n  rootCa: [a]\numask: 18\nextra: true\n",
+	} {
+		dir := t.TempDir()
+
+		if err := filesystem.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+
+		err := loader.Load(config.New(dir, name))
+		if !errors.Is(err, loader.ErrConfigLoadFail) || !errors.Is(err, loader.ErrUnknownField) {
+			t.Fatalf("unknown fields should be rejected: %v", err)
+		}
+
+		if paths := fieldErrors(err); !slices.Equal(paths, []string{"client.tlsMinn", "extra"}) {
+			t.Fatalf("unexpected paths for %s: %v", name, paths)
+		}
+	}
+}
+
+func TestConfigLoadLayersUnknownFields(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "config.json")
+
+	if err := filesystem.WriteFile(loc, []byte(`{"logger": {"levell": "warn"}}`), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	_, err := loader.LoadLayers(config.New(dir, "config.json"), loader.FileLayer(loader.LayerUser, loc))
+	if !errors.Is(err, loader.ErrUnknownField) || !slices.Equal(fieldErrors(err), []string{"logger.levell"}) {
+		t.Fatalf("unknown fields should be rejected: %v", err)
+	}
+}
+
+func TestConfigLoadValidate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	// The certificate and CA paths are directories.
+	for _, name := range []string{"certs", "cas"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o700); err != nil {
+			t.Fatalf("unexpected failure! %s", err)
+		}
+	}
+
+	err := filesystem.WriteFile(filepath.Join(dir, "config.json"), []byte(`{
+		"client": {
+			"tlsMin": 769, "dialerTimeout": -1, "dialerKeepAlive": -1,
+			"rootCa": ["-----BEGIN CERTIFICATE-----", "cas", "missing.pem"], "certPath": "missing.crt"
+		},
+		"server": {"certPath": "certs", "tlsMin": 772, "clientCa": "cas"}
+	}`), 0o600)
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	err = loader.Load(config.New(dir, "config.json"))
+	if !errors.Is(err, loader.ErrConfigInvalid) || !errors.Is(err, network.ErrUnsupportedTLSVersion) ||
+		!errors.Is(err, network.ErrNegativeDuration) || !errors.Is(err, network.ErrNotAFile) ||
+		!errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("the config should be invalid: %v", err)
+	}
+
+	// The default key paths do not exist, but are not reported.
+	expected := []string{
+		"client.certPath", "client.dialerTimeout", "client.rootCa[1]", "client.rootCa[2]", "client.tlsMin",
+		"server.certPath", "server.clientCa",
+	}
+	if paths := fieldErrors(err); !slices.Equal(paths, expected) {
+		t.Fatalf("unexpected paths: %v", paths)
+	}
+}
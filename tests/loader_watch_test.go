@@ -0,0 +1,184 @@
+/*
+   Copyright Farcloser.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//revive:disable:add-constant
+package tests_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.farcloser.world/core/config"
+	"go.farcloser.world/core/filesystem"
+	"go.farcloser.world/core/loader"
+	"go.farcloser.world/core/log"
+)
+
+type reload struct {
+	conf *config.Core
+	err  error
+}
+
+func nextReload(t *testing.T, reloads <-chan *reload) *reload {
+	t.Helper()
+
+	select {
+	case next := <-reloads:
+		return next
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a reload")
+	}
+
+	return nil
+}
+
+func TestConfigWatch(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "config.json")
+
+	if err := filesystem.WriteFile(loc, []byte(`{"logger": {"level": "error"}}`), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	create := func() *config.Core {
+		return config.New(dir, "config.json")
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	reloads := make(chan *reload, 1)
+
+	err := loader.Watch(ctx, create, func(conf *config.Core, err error) {
+		reloads <- &reload{conf: conf, err: err}
+	})
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	initial := nextReload(t, reloads)
+	if initial.err != nil || initial.conf.Logger.Level != log.ErrorLevel {
+		t.Fatalf("the initial config should have been loaded: %v", initial.err)
+	}
+
+	// Files other than the config are ignored.
+	if err = os.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	if err = filesystem.WriteFile(loc, []byte(`{"logger": {"level": "debug"}}`), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	next := nextReload(t, reloads)
+	if next.err != nil || next.conf.Logger.Level != log.DebugLevel {
+		t.Fatalf("should have reloaded the config: %v", next.err)
+	}
+
+	good := next.conf
+
+	if err = filesystem.WriteFile(loc, []byte(`{"logger": `), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	next = nextReload(t, reloads)
+
+	var syntaxError *json.SyntaxError
+	if !errors.As(next.err, &syntaxError) || next.conf != good {
+		t.Fatalf("should have kept the last good config: %v", next.err)
+	}
+
+	// Removed settings fall back to their defaults.
+	if err = filesystem.WriteFile(loc, []byte(`{}`), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	next = nextReload(t, reloads)
+	if next.err != nil || next.conf.Logger.Level != log.InfoLevel {
+		t.Fatalf("should have reloaded the config: %v", next.err)
+	}
+
+	if good.Logger.Level != log.DebugLevel {
+		t.Fatalf("previous configs should not be modified")
+	}
+}
+
+func TestConfigWatchFirstChangeInvalid(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "config.json")
+
+	if err := filesystem.WriteFile(loc, []byte(`{"logger": {"level": "error"}}`), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	create := func() *config.Core {
+		return config.New(dir, "config.json")
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	reloads := make(chan *reload, 1)
+
+	err := loader.Watch(ctx, create, func(conf *config.Core, err error) {
+		reloads <- &reload{conf: conf, err: err}
+	})
+	if err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	initial := nextReload(t, reloads)
+
+	if err = filesystem.WriteFile(loc, []byte(`{"logger": `), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	// The last good config is the initial one, not defaults.
+	next := nextReload(t, reloads)
+	if next.err == nil || next.conf != initial.conf || next.conf.Logger.Level != log.ErrorLevel {
+		t.Fatalf("should have kept the initial config: %v", next.err)
+	}
+}
+
+func TestConfigWatchInitialInvalid(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	if err := filesystem.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"logger": `), 0o600); err != nil {
+		t.Fatalf("unexpected failure! %s", err)
+	}
+
+	err := loader.Watch(t.Context(), func() *config.Core {
+		return config.New(dir, "config.json")
+	}, func(*config.Core, error) {
+		t.Errorf("onChange should not be called")
+	})
+
+	var syntaxError *json.SyntaxError
+	if !errors.As(err, &syntaxError) {
+		t.Fatalf("should have failed loading the initial config: %v", err)
+	}
+}